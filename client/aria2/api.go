@@ -29,6 +29,7 @@ type ApiInputOptions struct {
 	Out                    string   `json:"out,omitempty"` // the download filename, related to dir
 	Header                 []string `json:"header,omitempty"`
 	UserAgent              string   `json:"user-agent,omitempty"`
+	AllProxy               string   `json:"all-proxy,omitempty"`
 }
 
 // https://aria2.github.io/manual/en/html/aria2c.html#aria2.getGlobalStat
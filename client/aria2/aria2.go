@@ -10,6 +10,7 @@ import (
 
 	"github.com/sagan/erodownloader/client"
 	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/constants"
 	"github.com/sagan/erodownloader/util"
 )
 
@@ -144,15 +145,44 @@ func (a *Aria2Client) Add(download client.DownloadTask) (id string, err error) {
 	params = append(params, []string{downloadUrl})
 	var header []string
 	header = append(header, "Host: "+downloadUrlObj.Host)
-	if cookieStr := config.Data.GetCookieHeader(downloadUrlObj); cookieStr != "" {
+	cookieStr := config.CookieJar.CookieHeader(downloadUrlObj)
+	userAgent := config.Data.UserAgent
+	proxy := ""
+	// the file may be served by a host other than the site itself (e.g. a storage backend),
+	// in which case only non-sensitive site settings are applied.
+	if siteConfig := config.GetSiteConfig(download.GetSite()); siteConfig != nil {
+		if siteConfig.MatchUrl(downloadUrlObj) {
+			siteHeader := siteConfig.GetHeader()
+			for name := range siteHeader {
+				header = append(header, name+": "+siteHeader.Get(name))
+			}
+			if authorization := siteConfig.GetAuthorization(); authorization != "" {
+				header = append(header, "Authorization: "+authorization)
+			}
+			if siteConfig.Cookie != "" {
+				if cookieStr != "" {
+					cookieStr += "; "
+				}
+				cookieStr += siteConfig.Cookie
+			}
+		}
+		if siteConfig.UserAgent != "" {
+			userAgent = siteConfig.UserAgent
+		}
+		if siteConfig.Proxy != "" && siteConfig.Proxy != constants.NONE {
+			proxy = siteConfig.Proxy
+		}
+	}
+	if cookieStr != "" {
 		header = append(header, "Cookie: "+cookieStr)
 	}
 	params = append(params, &ApiInputOptions{
 		Dir:       savePath,
 		Out:       download.GetFilename(),
 		Pause:     fmt.Sprint(download.GetPaused()),
-		UserAgent: config.Data.UserAgent,
+		UserAgent: userAgent,
 		Header:    header,
+		AllProxy:  proxy,
 	})
 	err = a.jsonRpc("aria2.addUri", params, &id)
 	return
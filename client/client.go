@@ -21,6 +21,7 @@ type DownloadTask interface {
 	GetFilename() string // "foobar.rar"
 	GetSavePath() string // "/root/Downloads"
 	GetPaused() bool     // add task in paused state
+	GetSite() string     // name of site which the file belongs to. Could be empty
 }
 
 type Download interface {
@@ -64,6 +65,7 @@ type BaseDownloadTask struct {
 	Filename string
 	SavePath string
 	Paused   bool
+	Site     string
 }
 
 var (
@@ -78,6 +80,10 @@ func (b *BaseDownloadTask) GetPaused() bool {
 	return b.Paused
 }
 
+func (b *BaseDownloadTask) GetSite() string {
+	return b.Site
+}
+
 func (b *BaseDownloadTask) GetSavePath() string {
 	return b.SavePath
 }
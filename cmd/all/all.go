@@ -3,10 +3,12 @@ package all
 import (
 	_ "github.com/sagan/erodownloader/cmd"
 	_ "github.com/sagan/erodownloader/cmd/add"
+	_ "github.com/sagan/erodownloader/cmd/cookies/all"
 	_ "github.com/sagan/erodownloader/cmd/dl/all"
 	_ "github.com/sagan/erodownloader/cmd/get"
 	_ "github.com/sagan/erodownloader/cmd/getr"
-	_ "github.com/sagan/erodownloader/cmd/normalize"
+	_ "github.com/sagan/erodownloader/cmd/library/all"
+	_ "github.com/sagan/erodownloader/cmd/normalize/all"
 	_ "github.com/sagan/erodownloader/cmd/normalizename"
 	_ "github.com/sagan/erodownloader/cmd/scrape"
 	_ "github.com/sagan/erodownloader/cmd/search"
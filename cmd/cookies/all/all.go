@@ -0,0 +1,8 @@
+package all
+
+import (
+	_ "github.com/sagan/erodownloader/cmd/cookies"
+	_ "github.com/sagan/erodownloader/cmd/cookies/export"
+	_ "github.com/sagan/erodownloader/cmd/cookies/importcmd"
+	_ "github.com/sagan/erodownloader/cmd/cookies/list"
+)
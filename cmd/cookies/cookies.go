@@ -0,0 +1,18 @@
+package cookies
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd"
+)
+
+var Command = &cobra.Command{
+	Use:   "cookies",
+	Short: "Manage cookie jar",
+	Long: `Manage cookie jar.
+Cookies are stored in "cookies.json" file of config dir, and are sent in http requests.`,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(Command)
+}
@@ -0,0 +1,56 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd/cookies"
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/util/cookiejar"
+)
+
+var command = &cobra.Command{
+	Use:   "export [domain]...",
+	Short: "Export cookies in Netscape cookies.txt format",
+	Long: `Export cookies in Netscape cookies.txt format.
+If domain args are provided, only export cookies of these domains (including their sub domains).`,
+	RunE: export,
+}
+
+var (
+	output string
+)
+
+func init() {
+	command.Flags().StringVarP(&output, "output", "o", "", "Write to this file instead of stdout")
+	cookies.Command.AddCommand(command)
+}
+
+func export(cmd *cobra.Command, args []string) (err error) {
+	var exportCookies []*cookiejar.Cookie
+	if len(args) == 0 {
+		exportCookies = config.CookieJar.All("")
+	}
+	for _, domain := range args {
+		exportCookies = append(exportCookies, config.CookieJar.All(domain)...)
+	}
+	var writer io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer file.Close()
+		writer = file
+	}
+	if err = cookiejar.WriteNetscape(writer, exportCookies); err != nil {
+		return fmt.Errorf("failed to write cookies: %w", err)
+	}
+	if output != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d cookies to %q\n", len(exportCookies), output)
+	}
+	return nil
+}
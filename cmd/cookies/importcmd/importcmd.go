@@ -0,0 +1,90 @@
+package importcmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd/cookies"
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/util/cookiejar"
+)
+
+var command = &cobra.Command{
+	Use:   "import {cookies.txt}...",
+	Short: "Import cookies from Netscape cookies.txt files",
+	Long: `Import cookies from Netscape cookies.txt files (exported by browser extensions or curl).
+Use "-" as filename to read from stdin. Existing cookies with the same domain, path and name are replaced.`,
+	Args: cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs),
+	RunE: importCookies,
+}
+
+var (
+	clear = false
+)
+
+func init() {
+	command.Flags().BoolVarP(&clear, "clear", "", false,
+		"Remove all existing cookies of the domains that imported cookies belong to before importing")
+	cookies.Command.AddCommand(command)
+}
+
+func importCookies(cmd *cobra.Command, args []string) (err error) {
+	errorCnt := 0
+	now := time.Now()
+	for _, filename := range args {
+		fileCookies, err := readCookiesFile(filename)
+		if err != nil {
+			fmt.Printf("X %q: %v\n", filename, err)
+			errorCnt++
+			continue
+		}
+		if clear {
+			domains := map[string]struct{}{}
+			for _, cookie := range fileCookies {
+				domains[cookie.Domain] = struct{}{}
+			}
+			for domain := range domains {
+				config.CookieJar.Clear(domain)
+			}
+		}
+		expired := 0
+		for _, cookie := range fileCookies {
+			if cookie.Expired(now) {
+				expired++
+			}
+		}
+		config.CookieJar.Add(fileCookies...)
+		fmt.Printf("✓ %q: imported %d cookies (%d expired skipped)\n",
+			filename, len(fileCookies)-expired, expired)
+	}
+	if err := config.CookieJar.Save(); err != nil {
+		return fmt.Errorf("failed to save cookies: %w", err)
+	}
+	if errorCnt > 0 {
+		return fmt.Errorf("%d errors", errorCnt)
+	}
+	return nil
+}
+
+// Read cookies of a Netscape cookies.txt file. "-" == stdin.
+func readCookiesFile(filename string) ([]*cookiejar.Cookie, error) {
+	var contents io.Reader = os.Stdin
+	if filename != constants.STDIN {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		contents = file
+	}
+	cookies, err := cookiejar.ParseNetscape(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+	return cookies, nil
+}
@@ -0,0 +1,84 @@
+package list
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd/cookies"
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/cookiejar"
+	"github.com/sagan/erodownloader/util/stringutil"
+)
+
+var command = &cobra.Command{
+	Use:     "list [domain | url]...",
+	Aliases: []string{"ls"},
+	Short:   "List cookies",
+	Long: `List cookies.
+If a domain arg is provided, list cookies of that domain (including sub domains);
+If an url arg is provided, list cookies that will be sent to that url.`,
+	RunE: list,
+}
+
+var (
+	showValue = false
+)
+
+func init() {
+	command.Flags().BoolVarP(&showValue, "show-value", "", false, "Show full cookie values")
+	cookies.Command.AddCommand(command)
+}
+
+func list(cmd *cobra.Command, args []string) (err error) {
+	var listCookies []*cookiejar.Cookie
+	if len(args) == 0 {
+		listCookies = config.CookieJar.All("")
+	}
+	for _, arg := range args {
+		if strings.Contains(arg, "://") {
+			urlObj, err := url.Parse(arg)
+			if err != nil {
+				return fmt.Errorf("invalid url %q: %w", arg, err)
+			}
+			listCookies = append(listCookies, config.CookieJar.MatchedCookies(urlObj)...)
+		} else {
+			listCookies = append(listCookies, config.CookieJar.All(arg)...)
+		}
+	}
+	nameWidth := 30
+	format := "%-30s  %-15s  %-5s  %-19s  %s\n"
+	fmt.Printf("%-*s  "+format, nameWidth, "Name", "Domain", "Path", "Flag", "Expires", "Value")
+	for _, cookie := range listCookies {
+		domain := cookie.Domain
+		if !cookie.HostOnly {
+			domain = "." + domain
+		}
+		flag := ""
+		if cookie.Secure {
+			flag += "s"
+		}
+		if cookie.HttpOnly {
+			flag += "h"
+		}
+		if flag == "" {
+			flag = "-"
+		}
+		expires := "session"
+		if cookie.Expires > 0 {
+			expires = util.FormatTime(cookie.Expires)
+		}
+		value := cookie.Value
+		if !showValue && len(value) > 16 {
+			value = value[:16] + "..."
+		}
+		stringutil.PrintStringInWidth(os.Stdout, cookie.Name, nameWidth, true)
+		fmt.Printf("  "+format, domain, cookie.Path, flag, expires, value)
+	}
+	fmt.Printf("Total %d cookies\n", len(listCookies))
+	return nil
+}
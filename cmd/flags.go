@@ -5,6 +5,8 @@ import (
 	"slices"
 
 	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/flags"
 )
 
 // an enum of string type
@@ -73,3 +75,17 @@ func AddEnumFlagP(command *cobra.Command, value *string, name string, shorthand
 	*vv.value = flag.Options[flag.DefaultOptionIndex][0]
 	command.Flags().VarP(vv, name, shorthand, vv.cobraUsage())
 }
+
+// Add "--cache", "--no-cache" and "--refresh" http response cache flags to command.
+// cacheFlag is the name of the flag that enables cache, "cache" by default;
+// it can be changed if command defines it's own "--cache" flag.
+func AddHttpCacheFlags(command *cobra.Command, cacheFlag string) {
+	if cacheFlag == "" {
+		cacheFlag = "cache"
+	}
+	command.Flags().BoolVarP(&flags.Cache, cacheFlag, "", false,
+		"Enable http response cache. Ttl is set by CacheTtl config (default 24h)")
+	command.Flags().BoolVarP(&flags.NoCache, "no-cache", "", false, "Disable http response cache")
+	command.Flags().BoolVarP(&flags.RefreshCache, "refresh", "", false,
+		"Do not use cached http responses, but still cache fresh responses")
+}
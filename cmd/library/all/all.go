@@ -0,0 +1,6 @@
+package all
+
+import (
+	_ "github.com/sagan/erodownloader/cmd/library"
+	_ "github.com/sagan/erodownloader/cmd/library/exportnfo"
+)
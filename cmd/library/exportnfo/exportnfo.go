@@ -0,0 +1,104 @@
+package exportnfo
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd/library"
+	"github.com/sagan/erodownloader/scraper"
+	"github.com/sagan/erodownloader/util"
+)
+
+var command = &cobra.Command{
+	Use:     "export-nfo {path}...",
+	Aliases: []string{"export"},
+	Short:   "Convert metadata.nfo files to other metadata formats",
+	Long: `Convert metadata.nfo files to other metadata formats, e.g. Kodi / Jellyfin album.nfo & folder.jpg,
+Audiobookshelf metadata.json (with chapters of audio files, requires ffprobe).
+Each path arg and it's sub dirs (recursively) are searched for metadata.nfo files.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: exportnfo,
+}
+
+var (
+	force   = false
+	formats string
+)
+
+func init() {
+	command.Flags().BoolVarP(&force, "force", "f", false, "Overwrite existing files")
+	command.Flags().StringVarP(&formats, "format", "", scraper.FORMAT_KODI,
+		`Comma-seperated exported metadata formats: "kodi" (album.nfo & folder.jpg), "audiobookshelf" (metadata.json)`)
+	library.Command.AddCommand(command)
+}
+
+func exportnfo(cmd *cobra.Command, args []string) (err error) {
+	formatNames := util.SplitCsv(formats)
+	if len(formatNames) == 0 {
+		return fmt.Errorf("no format provided")
+	}
+	for _, name := range formatNames {
+		if scraper.Writers[name] == nil {
+			return fmt.Errorf("invalid format %q", name)
+		}
+	}
+	var dirs []string
+	for _, arg := range args {
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && path != arg && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			if !d.IsDir() && d.Name() == scraper.METAFILE {
+				dirs = append(dirs, filepath.Dir(path))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", arg, err)
+		}
+	}
+	errorCnt := 0
+	for i, dir := range dirs {
+		fmt.Printf("(%d/%d) ", i+1, len(dirs))
+		metadata, err := scraper.ReadMetadata(filepath.Join(dir, scraper.METAFILE))
+		if err != nil || metadata == nil {
+			fmt.Printf("X %q: invalid metadata.nfo: %v\n", dir, err)
+			errorCnt++
+			continue
+		}
+		var exported, skipped []string
+		var errs []string
+		for _, name := range formatNames {
+			if err := scraper.Writers[name](dir, metadata, force); err == scraper.ErrExists {
+				skipped = append(skipped, name)
+			} else if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			} else {
+				exported = append(exported, name)
+			}
+		}
+		if len(errs) > 0 {
+			fmt.Printf("X %q: failed to export: %s\n", dir, strings.Join(errs, "; "))
+			errorCnt++
+		} else if len(exported) > 0 {
+			fmt.Printf("✓ %q: exported (%s)\n", dir, strings.Join(exported, ", "))
+		} else {
+			fmt.Printf("- %q: already exported (%s)\n", dir, strings.Join(skipped, ", "))
+		}
+	}
+	if len(dirs) == 0 {
+		fmt.Fprintf(os.Stderr, "No %s file found\n", scraper.METAFILE)
+	}
+	if errorCnt > 0 {
+		return fmt.Errorf("%d errors", errorCnt)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package library
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd"
+)
+
+var Command = &cobra.Command{
+	Use:   "library",
+	Short: "Manage local library of scraped contents",
+	Long: `Manage local library of scraped contents.
+A library content is a dir that contains "metadata.nfo" file generated by "scrape" command.`,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(Command)
+}
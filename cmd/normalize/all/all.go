@@ -0,0 +1,7 @@
+package all
+
+import (
+	_ "github.com/sagan/erodownloader/cmd/normalize"
+	_ "github.com/sagan/erodownloader/cmd/normalize/profiles"
+	_ "github.com/sagan/erodownloader/cmd/normalize/transformers"
+)
@@ -1,15 +1,20 @@
 package normalize
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/natefinch/atomic"
@@ -19,69 +24,110 @@ import (
 	"github.com/sagan/erodownloader/cmd"
 	"github.com/sagan/erodownloader/config"
 	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/scraper"
 	"github.com/sagan/erodownloader/transform"
+	"github.com/sagan/erodownloader/transform/classify"
 	"github.com/sagan/erodownloader/util"
 	"github.com/sagan/erodownloader/util/helper"
+	"github.com/sagan/erodownloader/util/pathtemplate"
 	"github.com/sagan/erodownloader/util/stringutil"
 )
 
-var command = &cobra.Command{
+var Command = &cobra.Command{
 	Use:   "normalize [--save-path {save-path}] [content-path]...",
 	Short: "normalize",
 	Long:  `normalize.`,
 	RunE:  normalize,
 }
 
+const (
+	PROFILE_AUTO    = "auto"
+	PROFILE_DEFAULT = "default"
+)
+
 var (
 	all                    = false
 	noFlac                 = false
 	doClean                = false
 	doRestore              = false
+	doUndo                 = false
 	force                  = false
 	lock                   = false
+	dryRun                 = false
 	noSkipRecentlyModified = false
 	savePath               = ""
 	moveTo                 = ""
+	jobs                   = 1
+	heavyJobs              = runtime.NumCPU()
+	binaryTimeout          = ""
+	profile                = ""
+	binaryNice             = 0
+	binaryIonice           = ""
+	binaryMemory           = ""
 	passwords              []string
 	options                []string
 )
 
 func init() {
-	command.Flags().BoolVarP(&all, "all", "a", false, `Process all. Equivalent to "--no-skip-recently-modified"`)
-	command.Flags().BoolVarP(&noSkipRecentlyModified, "no-skip-recently-modified", "", false,
+	Command.Flags().BoolVarP(&all, "all", "a", false, `Process all. Equivalent to "--no-skip-recently-modified"`)
+	Command.Flags().BoolVarP(&noSkipRecentlyModified, "no-skip-recently-modified", "", false,
 		"Process (do not skip) recently modified dirs also")
-	command.Flags().BoolVarP(&doClean, "clean", "", false, "Clean backup files and tmp files")
-	command.Flags().BoolVarP(&doRestore, "restore", "", false, `Restore "`+
+	Command.Flags().BoolVarP(&doClean, "clean", "", false, "Clean backup files and tmp files")
+	Command.Flags().BoolVarP(&doRestore, "restore", "", false, `Restore "`+
 		transform.TF_PREFIX+`.*" content dir names to original`)
-	command.Flags().BoolVarP(&noFlac, "no-flac", "", false, "Disable flac normalizer (convert wav to flac)")
-	command.Flags().BoolVarP(&force, "force", "f", false, "Force do action (Do NOT prompt for confirm)")
-	command.Flags().BoolVarP(&lock, "lock", "l", false,
+	Command.Flags().BoolVarP(&doUndo, "undo", "", false, `Undo previous normalize runs of content dir(s) `+
+		`by replaying the journal in backup dir in reverse. Use "--option bakdir=DIR" if the backup dir is elsewhere `+
+		`(e.g. content dir was moved by --move-to). Runs with "--option backup=0", which removed the original `+
+		`converted files (e.g. wav files converted to flac) without backup, can NOT be undone. `+
+		`Undo refuses if any file was modified after the run; the check compares size and mtime only, `+
+		`file contents are NOT hashed`)
+	Command.Flags().BoolVarP(&noFlac, "no-flac", "", false, "Disable flac normalizer (convert wav to flac)")
+	Command.Flags().StringVarP(&profile, "profile", "", PROFILE_DEFAULT,
+		`Used pipeline profile of transformers, e.g. "audio", "cg", "game". Run "normalize profiles" to list all profiles. `+
+			`"`+PROFILE_AUTO+`" (opt-in): detect content type of each dir and use the profile of the same name `+
+			`(fallback to "`+PROFILE_DEFAULT+`"). Use "--option content_type=TYPE" to force a content type in auto mode`)
+	Command.Flags().BoolVarP(&force, "force", "f", false, "Force do action (Do NOT prompt for confirm)")
+	Command.Flags().BoolVarP(&lock, "lock", "l", false,
 		"Lock each content-dir (prepend the '"+transform.TF_PREFIX+"' prefix to it's filename) when processing")
-	command.Flags().StringVarP(&savePath, "save-path", "", "", "Process all folders of this path dir")
-	command.Flags().StringVarP(&moveTo, "move-to", "", "", "Move successfully processed content-dir to this folder")
-	command.Flags().StringArrayVarP(&options, "option", "o", nil, `Set transformer(s) option(s). E.g. "foo=bar"`)
-	command.Flags().StringArrayVarP(&passwords, "password", "p", nil,
+	Command.Flags().BoolVarP(&dryRun, "dry-run", "d", false,
+		"Dry run. Show the planned operations of each content-dir, but do not touch anything")
+	Command.Flags().StringVarP(&savePath, "save-path", "", "", "Process all folders of this path dir")
+	Command.Flags().StringVarP(&moveTo, "move-to", "", "", "Move successfully processed content-dir to this folder")
+	Command.Flags().IntVarP(&jobs, "jobs", "j", 1,
+		"Number of content dirs processed in parallel. Implies --lock if greater than 1")
+	Command.Flags().IntVarP(&heavyJobs, "heavy-jobs", "", runtime.NumCPU(),
+		"Max number of CPU heavy jobs (e.g. wav to flac conversion of a file) running concurrently across all content dirs")
+	Command.Flags().StringVarP(&binaryTimeout, "binary-timeout", "", "2h",
+		`Timeout of each execution of external binary (e.g. flac, 7z), after which it's killed. "0" == unlimited. `+
+			`Equivalent to "--option binary_timeout=DURATION". Use "--option flac_timeout=DURATION" to set per binary`)
+	Command.Flags().IntVarP(&binaryNice, "binary-nice", "", 0,
+		`Niceness of external binaries (Linux only, -20 - 19). Equivalent to "--option binary_nice=N"`)
+	Command.Flags().StringVarP(&binaryIonice, "binary-ionice", "", "",
+		`IO scheduling class of external binaries (Linux only): "idle", "best-effort" or "realtime". `+
+			`Equivalent to "--option binary_ionice=CLASS"`)
+	Command.Flags().StringVarP(&binaryMemory, "binary-memory", "", "",
+		`Max (virtual) memory of external binaries (Linux only). E.g. "4GiB". Equivalent to "--option binary_memory=SIZE"`)
+	Command.Flags().StringArrayVarP(&options, "option", "o", nil, `Set transformer(s) option(s). E.g. "foo=bar". `+
+		`"executor_jobs=N" sets the number of files converted concurrently in a dir by executor transformers (e.g. wav). `+
+		`Option can be scoped to a transformer ("wav.backup=0") or an instance of it ("executor.1.binary=ffmpeg"). `+
+		`Run "normalize transformers" to list options of transformers`)
+	Command.Flags().StringArrayVarP(&passwords, "password", "p", nil,
 		`Set password(s) for rar / 7z file. Equivalent to "--option password=PASSWORD"`)
-	cmd.RootCmd.AddCommand(command)
+	cmd.RootCmd.AddCommand(Command)
 }
 
 func normalize(cmd *cobra.Command, args []string) (err error) {
 	if all {
 		noSkipRecentlyModified = true
 	}
-	if doClean && doRestore {
-		return fmt.Errorf("--clean and --restore flags are NOT compatible")
+	if util.CountNonZeroVariables(doClean, doRestore, doUndo, dryRun) > 1 {
+		return fmt.Errorf("--clean, --restore, --undo and --dry-run flags are NOT compatible")
 	}
-	var optionValues = url.Values{}
-	for _, option := range options {
-		values, err := url.ParseQuery(option)
-		if err != nil {
-			return fmt.Errorf("invalid option %v", option)
-		}
-		for k, v := range values {
-			optionValues[k] = v
-		}
+	optionValues, err := parseOptions(options)
+	if err != nil {
+		return err
 	}
+	userOptions := maps.Clone(optionValues)
 	for _, password := range passwords {
 		optionValues.Add("password", password)
 	}
@@ -94,6 +140,23 @@ func normalize(cmd *cobra.Command, args []string) (err error) {
 	if savePath != "" {
 		optionValues.Set("bakdir", filepath.Join(savePath, transform.BAK_DIR))
 	}
+	for key, value := range map[string]string{
+		"binary_timeout": binaryTimeout,
+		"binary_nice":    fmt.Sprint(binaryNice),
+		"binary_ionice":  binaryIonice,
+		"binary_memory":  binaryMemory,
+	} {
+		if value != "" && value != "0" && !optionValues.Has(key) {
+			optionValues.Set(key, value)
+		}
+	}
+	// validate limits options early
+	if _, err := (&transform.TransformerContext{Options: optionValues}).Limits("binary"); err != nil {
+		return err
+	}
+	if jobs < 1 {
+		return fmt.Errorf("invalid jobs %d", jobs)
+	}
 	if savePath != "" && len(args) > 0 {
 		return fmt.Errorf("--save-path arg can not be combined with other positional args")
 	}
@@ -134,8 +197,10 @@ func normalize(cmd *cobra.Command, args []string) (err error) {
 		return clean(dirs)
 	} else if doRestore {
 		return restore(dirs)
+	} else if doUndo {
+		return undo(dirs, optionValues.Get("bakdir"))
 	}
-	if moveTo != "" {
+	if moveTo != "" && !dryRun {
 		if err = os.MkdirAll(moveTo, 0700); err != nil {
 			return fmt.Errorf("failed to make move-to dir: %w", err)
 		}
@@ -173,98 +238,372 @@ func normalize(cmd *cobra.Command, args []string) (err error) {
 	}
 
 	errorCnt := 0
-	transformers := []any{[]string{"decensorship", "correctext", "decompress", "text", "nocredit", "denesting"}, -1}
-	if !noFlac && !optionValues.Has("flac_binary") {
+	profileNames := []string{profile}
+	if profile == PROFILE_AUTO {
+		profileNames = append([]string{PROFILE_DEFAULT}, classify.Types...)
+	}
+	pipelines := map[string]*pipeline{}
+	for _, name := range profileNames {
+		profileConfig := config.GetProfileConfig(name)
+		if profileConfig == nil {
+			if profile == PROFILE_AUTO && name != PROFILE_DEFAULT {
+				continue
+			}
+			return fmt.Errorf(`profile %q not found. Run "normalize profiles" to list all profiles`, name)
+		}
+		if pipelines[name], err = newPipeline(profileConfig); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+		log.Warnf("Used transformers (profile %s): %v", name, pipelines[name].normalizer)
+	}
+	// in auto mode, an option is valid if any pipeline supports it
+	for key, values := range userOptions {
+		for _, p := range pipelines {
+			if err = p.normalizer.ValidateOptions(url.Values{key: values}); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf(`%w. Run "normalize transformers" to list options of transformers`, err)
+		}
+	}
+	useFlac := false
+	for _, p := range pipelines {
+		useFlac = useFlac || p.normalizer.Has("wav")
+	}
+	if useFlac && !optionValues.Has("flac_binary") {
 		binpath, err := util.LookPathWithSelfDir("flac")
 		if err != nil {
-			log.Fatalf(`flac binary not found, please add "flac" binary to PATH`)
+			log.Fatalf(`flac binary not found, please add "flac" binary to PATH or use "--no-flac" flag`)
 		}
 		optionValues.Set("flac_binary", binpath)
-		transformers = append(transformers, "wav")
 	}
-	transformers = append(transformers, "noempty", "normalizename")
-
-	transformers = append(transformers, "clean")
-	log.Warnf("Used transformers: %v", transformers)
-	normalizer, err := transform.NewNormalizer(transformers...)
-	if err != nil {
-		return fmt.Errorf("fail to create normalizer: %w", err)
+	if jobs > 1 && !dryRun {
+		// prevent a dir from being processed by another normalize concurrently
+		lock = true
 	}
-	// each dir is a absolute full path.
-	for i, dir := range dirs {
-		fmt.Printf("(%d/%d) ", i+1, len(dirs))
-		if stat, err := os.Stat(dir); err != nil {
-			fmt.Printf("X %q: faied to access dir: %v\n", dir, err)
-			errorCnt++
-			continue
-		} else if now := time.Now().Unix(); !noSkipRecentlyModified &&
-			stat.ModTime().Unix() <= now && (now-stat.ModTime().Unix() <= 60) {
-			fmt.Printf("- %q: skip recently modified dir\n", dir)
-			continue
-		} else if entries, err := os.ReadDir(dir); err != nil {
-			fmt.Printf("X %q: failed to read dir: %v\n", dir, err)
+	transform.SetHeavyConcurrency(heavyJobs)
+	// On interrupt, running binaries are killed and dirs being processed are left untouched.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		log.Warnf("Interrupted. Canceling transforms, press Ctrl-C again to exit immediately")
+		cancel()
+	}()
+	// results[i] receives the output of dirs[i], so that outputs are printed in order.
+	results := make([]chan *normalizeOutput, len(dirs))
+	for i := range results {
+		results[i] = make(chan *normalizeOutput, 1)
+	}
+	indexes := make(chan int)
+	for range min(jobs, len(dirs)) {
+		go func() {
+			for i := range indexes {
+				results[i] <- normalizeDir(ctx, pipelines, dirs[i], optionValues)
+			}
+		}()
+	}
+	go func() {
+		for i := range dirs {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+	for i := range dirs {
+		output := <-results[i]
+		fmt.Printf("(%d/%d) %s", i+1, len(dirs), output.text)
+		if output.failed {
 			errorCnt++
-			continue
-		} else if len(entries) == 0 {
-			fmt.Printf("- %q: skip empty dir\n", dir)
-			continue
-		} else if slices.ContainsFunc(entries, func(entry fs.DirEntry) bool {
-			return !entry.IsDir() && stringutil.HasAnySuffix(entry.Name(), constants.IncompleteFileExts...)
-		}) {
-			fmt.Printf("- %q: skip incomplete dir\n", dir)
+		}
+	}
+	if dryRun {
+		fmt.Printf("\nAll Done with %d errors (dry run)\n", errorCnt)
+		if errorCnt > 0 {
+			return fmt.Errorf("%d errors", errorCnt)
+		}
+		return nil
+	}
+	fmt.Printf("\nAll Done with %d errors. Logs can be found in '%q' of bak dir(s)\n", errorCnt, transform.LOG_FILE)
+	if errorCnt > 0 {
+		return fmt.Errorf("%d errors", errorCnt)
+	}
+	return nil
+}
+
+// Parse "key=value" options.
+func parseOptions(options []string) (url.Values, error) {
+	optionValues := url.Values{}
+	for _, option := range options {
+		values, err := url.ParseQuery(option)
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %v", option)
+		}
+		for k, v := range values {
+			optionValues[k] = v
+		}
+	}
+	return optionValues, nil
+}
+
+// Normalizer of a pipeline profile.
+type pipeline struct {
+	name       string
+	normalizer transform.Transformers
+	options    url.Values // default options of profile
+}
+
+func newPipeline(profileConfig *config.ProfileConfig) (p *pipeline, err error) {
+	p = &pipeline{name: profileConfig.Name}
+	if p.options, err = parseOptions(profileConfig.Options); err != nil {
+		return nil, err
+	}
+	if p.normalizer, err = newNormalizer(profileConfig); err != nil {
+		return nil, fmt.Errorf("fail to create normalizer: %w", err)
+	}
+	if err = p.normalizer.ValidateOptions(p.options); err != nil {
+		return nil, err
+	}
+	for i, step := range p.normalizer {
+		if err = p.normalizer.ValidateOptions(step.Options); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return p, nil
+}
+
+// Return the pipeline of dir. In auto mode, it's the profile of the content type of dir,
+// which is the "content_type" option or detected by classifier; fallback to the default profile.
+func selectPipeline(pipelines map[string]*pipeline, dir string,
+	optionValues url.Values) (p *pipeline, result *classify.Result) {
+	if profile != PROFILE_AUTO {
+		return pipelines[profile], nil
+	}
+	if contentType := optionValues.Get("content_type"); contentType != "" {
+		result = &classify.Result{Type: contentType, Reason: "option"}
+	} else {
+		result = classify.Classify(dir, nil, optionValues)
+	}
+	if p = pipelines[result.Type]; p == nil {
+		p = pipelines[PROFILE_DEFAULT]
+	}
+	return p, result
+}
+
+// Create normalizer of pipeline profile. The "wav" transformer is removed if --no-flac flag is set.
+func newNormalizer(profileConfig *config.ProfileConfig) (normalizer transform.Transformers, err error) {
+	for i, stepConfig := range profileConfig.Steps {
+		names := stepConfig.Transformers
+		if noFlac {
+			names = util.FilterSlice(names, func(name string) bool { return name != "wav" })
+		}
+		if len(names) == 0 {
 			continue
 		}
-		fmt.Printf("→ %q: processing.\n", dir)
-		base := filepath.Base(dir)
-		processpath := dir
-		if lock {
-			tmppath := filepath.Join(filepath.Dir(dir), transform.TF_PREFIX+base)
-			if err := atomic.ReplaceFile(dir, tmppath); err != nil {
-				fmt.Printf("X %q: failed to lock (rename to %q): %v", dir, tmppath, err)
-				errorCnt++
-				continue
-			}
-			processpath = tmppath
+		steps, err := transform.NewNormalizer(names, stepConfig.Times)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
 		}
-		tc := normalizer.Transform(processpath, optionValues)
-		targetpath := dir // after success processed, final path of dir.
-		if tc.Err != nil {
-			if errors.Is(tc.Err, transform.ErrInvalid) {
-				fmt.Printf("! %q: invalid contents, changed=%t, bak_dir=%s.\n", dir, tc.Changed, tc.BackupDir)
-			} else {
-				fmt.Printf("X %q: changed=%t, err=%v, bak_dir=%s.\n", dir, tc.Changed, tc.Err, tc.BackupDir)
-				errorCnt++
-			}
-			if processpath != dir && !util.FileExists(dir) {
-				atomic.ReplaceFile(processpath, dir)
+		if steps[0].Options, err = parseOptions(stepConfig.Options); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		normalizer = append(normalizer, steps...)
+	}
+	if len(normalizer) == 0 {
+		return nil, fmt.Errorf("no transformers")
+	}
+	return normalizer, nil
+}
+
+type normalizeOutput struct {
+	text   string // printed lines
+	failed bool
+}
+
+func (output *normalizeOutput) printf(format string, a ...any) {
+	output.text += fmt.Sprintf(format, a...)
+}
+
+// Prevent concurrent jobs from moving dirs to the same target.
+var moveMu sync.Mutex
+
+// Normalize (or plan if dry-run) a single dir. The output is buffered and returned.
+func normalizeDir(ctx context.Context, pipelines map[string]*pipeline, dir string,
+	optionValues url.Values) *normalizeOutput {
+	output := &normalizeOutput{}
+	if ctx.Err() != nil {
+		output.printf("- %q: skip due to canceled\n", dir)
+		return output
+	}
+	// transformers may set options, e.g. "input"
+	optionValues = maps.Clone(optionValues)
+	if stat, err := os.Stat(dir); err != nil {
+		output.printf("X %q: faied to access dir: %v\n", dir, err)
+		output.failed = true
+		return output
+	} else if now := time.Now().Unix(); !noSkipRecentlyModified &&
+		stat.ModTime().Unix() <= now && (now-stat.ModTime().Unix() <= 60) {
+		output.printf("- %q: skip recently modified dir\n", dir)
+		return output
+	} else if entries, err := os.ReadDir(dir); err != nil {
+		output.printf("X %q: failed to read dir: %v\n", dir, err)
+		output.failed = true
+		return output
+	} else if len(entries) == 0 {
+		output.printf("- %q: skip empty dir\n", dir)
+		return output
+	} else if slices.ContainsFunc(entries, func(entry fs.DirEntry) bool {
+		return !entry.IsDir() && stringutil.HasAnySuffix(entry.Name(), constants.IncompleteFileExts...)
+	}) {
+		output.printf("- %q: skip incomplete dir\n", dir)
+		return output
+	}
+	p, result := selectPipeline(pipelines, dir, optionValues)
+	normalizer := p.normalizer
+	for key, values := range p.options {
+		if !optionValues.Has(key) {
+			optionValues[key] = values
+		}
+	}
+	if result != nil {
+		if result.Type != "" {
+			optionValues.Set("content_type", result.Type)
+		}
+		defer output.printf("  content type: %s, profile: %s\n", result, p.name)
+	}
+	if dryRun {
+		planDir(output, normalizer, dir, optionValues)
+		return output
+	}
+	if result != nil && result.Type != "" {
+		// persist the detected type, so that later runs and scrape use it.
+		metafile := filepath.Join(dir, scraper.METAFILE)
+		if metadata, err := scraper.ReadMetadata(metafile); err == nil && metadata.ContentType == "" {
+			metadata.ContentType = result.Type
+			if err = scraper.WriteMetadata(metafile, metadata); err != nil {
+				output.printf("! %q: failed to save content type to %s: %v\n", dir, scraper.METAFILE, err)
 			}
-			continue
+		}
+	}
+	base := filepath.Base(dir)
+	processpath := dir
+	if lock {
+		tmppath := filepath.Join(filepath.Dir(dir), transform.TF_PREFIX+base)
+		if err := atomic.ReplaceFile(dir, tmppath); errors.Is(err, fs.ErrNotExist) {
+			output.printf("- %q: skip dir being processed by another normalize\n", dir)
+			return output
+		} else if err != nil {
+			output.printf("X %q: failed to lock (rename to %q): %v\n", dir, tmppath, err)
+			output.failed = true
+			return output
+		}
+		processpath = tmppath
+	}
+	start := time.Now()
+	tc := normalizer.TransformContext(ctx, processpath, optionValues)
+	took := time.Since(start).Round(time.Second)
+	targetpath := dir // after success processed, final path of dir.
+	finalpath := processpath
+	if tc.Err != nil {
+		if errors.Is(tc.Err, transform.ErrInvalid) {
+			output.printf("! %q: invalid contents, changed=%t, bak_dir=%s, took=%s.\n",
+				dir, tc.Changed, tc.BackupDir, took)
 		} else {
-			if tc.Changed {
-				fmt.Printf("✓ %q: bak_dir=%s\n", dir, tc.BackupDir)
-			} else {
-				fmt.Printf("- %q: no_changes.\n", dir)
-			}
-			if moveTo != "" {
-				targetpath = filepath.Join(moveTo, base)
-			}
+			output.printf("X %q: changed=%t, err=%v, bak_dir=%s, took=%s.\n", dir, tc.Changed, tc.Err, tc.BackupDir, took)
+			output.failed = true
+		}
+		if processpath != dir && !util.FileExists(dir) && atomic.ReplaceFile(processpath, dir) == nil {
+			finalpath = dir
+		}
+	} else {
+		if tc.Changed {
+			output.printf("✓ %q: bak_dir=%s, took=%s\n", dir, tc.BackupDir, took)
+		} else {
+			output.printf("- %q: no_changes, took=%s.\n", dir, took)
+		}
+		if moveTo != "" {
+			targetpath = filepath.Join(moveTo, getMoveToName(processpath, base))
 		}
 		if targetpath != processpath {
+			moveMu.Lock()
 			if util.FileExists(targetpath) {
 				log.Errorf("Normalize %q final: failed to rename to %q: target already exists", processpath, targetpath)
-				if dir != processpath && !util.FileExists(dir) {
-					atomic.ReplaceFile(processpath, dir)
+				if dir != processpath && !util.FileExists(dir) && atomic.ReplaceFile(processpath, dir) == nil {
+					finalpath = dir
 				}
+			} else if err := os.MkdirAll(filepath.Dir(targetpath), 0700); err != nil {
+				log.Errorf("Normalize %q final: failed to make parent dir of %q: %v", processpath, targetpath, err)
 			} else if err := atomic.ReplaceFile(processpath, targetpath); err != nil {
 				log.Errorf("Normalize %q final: failed to rename to %q: %v", processpath, targetpath, err)
+			} else {
+				finalpath = targetpath
 			}
+			moveMu.Unlock()
 		}
 	}
-	fmt.Printf("\nAll Done with %d errors. Logs can be found in '%q' of bak dir(s)\n", errorCnt, transform.LOG_FILE)
-	if errorCnt > 0 {
-		return fmt.Errorf("%d errors", errorCnt)
+	// record the lock & move of dir, so that the run can be undone
+	if processpath != dir || finalpath != dir {
+		if err := tc.JournalMove(dir, finalpath); err != nil {
+			log.Errorf("Normalize %q: failed to write journal: %v", dir, err)
+		}
 	}
-	return nil
+	return output
+}
+
+// Print the planned operations of dir to output.
+func planDir(output *normalizeOutput, normalizer transform.Transformers, dir string, optionValues url.Values) {
+	tc := normalizer.Plan(dir, optionValues)
+	if tc.Plan == nil {
+		output.printf("X %q: %v\n", dir, tc.Err)
+		output.failed = true
+		return
+	}
+	output.printf("~ %q: %d operations planned\n", dir, len(tc.Plan.Operations))
+	for _, op := range tc.Plan.Operations {
+		output.printf("  %s\n", op)
+	}
+	if tc.Plan.Incomplete != "" {
+		output.printf("  ! plan is incomplete: %s\n", tc.Plan.Incomplete)
+	}
+	if tc.Err != nil {
+		if errors.Is(tc.Err, transform.ErrInvalid) {
+			output.printf("  ! invalid contents\n")
+			return
+		}
+		output.printf("  X err=%v\n", tc.Err)
+		output.failed = true
+		return
+	}
+	if moveTo != "" && tc.Plan.Incomplete == "" {
+		targetpath := filepath.Join(moveTo, getMoveToName(dir, filepath.Base(dir)))
+		tip := ""
+		if util.FileExists(targetpath) {
+			tip = " (target already exists)"
+		}
+		output.printf("  move to %q%s\n", targetpath, tip)
+	}
+}
+
+// Return the relative path that dir should be moved to inside move-to folder.
+// If dir has metadata.nfo and a folder name template is configured, it's rendered by the template,
+// otherwise it's the base name of dir.
+func getMoveToName(dir string, base string) string {
+	metadata, err := scraper.ReadMetadata(filepath.Join(dir, scraper.METAFILE))
+	if err != nil {
+		return base
+	}
+	template := config.GetScraperNameTemplate(metadata.GetScraperName())
+	if template == pathtemplate.Default {
+		return base
+	}
+	if name := metadata.GetTemplateFilename(template); name != "" {
+		return filepath.FromSlash(name)
+	}
+	return base
 }
 
 func clean(dirs []string) (err error) {
@@ -309,6 +648,43 @@ func clean(dirs []string) (err error) {
 	return nil
 }
 
+// Undo normalize runs of each dir. If bakDir is empty, look for journal in the backup dir inside dir,
+// or the one of it's parent dir (the save path).
+func undo(dirs []string, bakDir string) (err error) {
+	errorCnt := 0
+	for _, dir := range dirs {
+		bakDirs := []string{bakDir}
+		if bakDir == "" {
+			bakDirs = []string{filepath.Join(dir, transform.BAK_DIR), filepath.Join(filepath.Dir(dir), transform.BAK_DIR)}
+		}
+		undone := 0
+		for _, bakDir := range bakDirs {
+			if !util.FileExists(filepath.Join(bakDir, transform.JOURNAL_FILE)) {
+				continue
+			}
+			var original string
+			original, undone, err = transform.Undo(bakDir, dir)
+			if err != nil {
+				fmt.Printf("X %q: failed to undo (%d runs undone): %v\n", dir, undone, err)
+				errorCnt++
+				undone = -1
+				break
+			}
+			if undone > 0 {
+				fmt.Printf("✓ %q: %d runs undone, restored to %q\n", dir, undone, original)
+				break
+			}
+		}
+		if undone == 0 {
+			fmt.Printf("- %q: nothing to undo\n", dir)
+		}
+	}
+	if errorCnt > 0 {
+		return fmt.Errorf("%d errors", errorCnt)
+	}
+	return nil
+}
+
 func restore(dirs []string) (err error) {
 	errorCnt := 0
 	for _, dir := range dirs {
@@ -0,0 +1,53 @@
+package profiles
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd/normalize"
+	"github.com/sagan/erodownloader/config"
+)
+
+var command = &cobra.Command{
+	Use:   "profiles",
+	Short: "List pipeline profiles of normalize",
+	Long: `List pipeline profiles of normalize.
+Profiles can be defined or overrided in "Profiles" of config file.`,
+	Args: cobra.MatchAll(cobra.ExactArgs(0), cobra.OnlyValidArgs),
+	RunE: profiles,
+}
+
+func init() {
+	normalize.Command.AddCommand(command)
+}
+
+func profiles(cmd *cobra.Command, args []string) (err error) {
+	profileConfigs := config.GetProfileConfigs()
+	for _, pc := range profileConfigs {
+		source := "config"
+		if pc == config.GetInternalProfileConfig(pc.Name) {
+			source = "builtin"
+		}
+		fmt.Printf("%s (%s): %s\n", pc.Name, source, pc.Comment)
+		if len(pc.Options) > 0 {
+			fmt.Printf("  options: %s\n", strings.Join(pc.Options, " "))
+		}
+		for i, step := range pc.Steps {
+			times := ""
+			if step.Times < 0 {
+				times = " * unlimited"
+			} else if step.Times > 1 {
+				times = fmt.Sprintf(" * %d", step.Times)
+			}
+			options := ""
+			if len(step.Options) > 0 {
+				options = fmt.Sprintf(" (%s)", strings.Join(step.Options, " "))
+			}
+			fmt.Printf("  %d. %s%s%s\n", i+1, strings.Join(step.Transformers, " + "), times, options)
+		}
+	}
+	fmt.Printf("Total %d profiles\n", len(profileConfigs))
+	return nil
+}
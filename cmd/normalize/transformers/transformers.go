@@ -0,0 +1,47 @@
+package transformers
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/erodownloader/cmd/normalize"
+	"github.com/sagan/erodownloader/transform"
+)
+
+var command = &cobra.Command{
+	Use:   "transformers",
+	Short: "List transformers of normalize and their options",
+	Long: `List transformers of normalize and their options.
+Options are set by "normalize --option key=value". An option could be scoped to a transformer
+by prefixing it's name, e.g. "wav.backup=0", or to an instance of it in the pipeline, e.g. "executor.1.binary=ffmpeg".`,
+	Args: cobra.MatchAll(cobra.ExactArgs(0), cobra.OnlyValidArgs),
+	RunE: transformers,
+}
+
+func init() {
+	normalize.Command.AddCommand(command)
+}
+
+func transformers(cmd *cobra.Command, args []string) (err error) {
+	fmt.Printf("Global options:\n")
+	printOptions(transform.GlobalOptions)
+	for _, transformer := range transform.AllTransformers() {
+		heavy := ""
+		if transformer.Heavy {
+			heavy = " (heavy)"
+		}
+		fmt.Printf("%s%s:\n", transformer.Name, heavy)
+		printOptions(transformer.Options)
+	}
+	return nil
+}
+
+func printOptions(options []*transform.Option) {
+	if len(options) == 0 {
+		fmt.Printf("  -\n")
+	}
+	for _, option := range options {
+		fmt.Printf("  %-18s  %s\n", option.Name, option.Description)
+	}
+}
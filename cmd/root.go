@@ -10,6 +10,7 @@ import (
 	"github.com/sagan/erodownloader/config"
 	"github.com/sagan/erodownloader/flags"
 	"github.com/sagan/erodownloader/httpclient"
+	"github.com/sagan/erodownloader/scraper/declarative"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -33,8 +34,14 @@ func Execute() {
 			log.Fatalf("Failed to load config: %v", err)
 		}
 		httpclient.Init()
+		if err := declarative.Load(); err != nil {
+			log.Fatalf("Failed to load scrapers: %v", err)
+		}
 	}))
-	if err := RootCmd.Execute(); err != nil {
+	err := RootCmd.Execute()
+	httpclient.FlushCookies()
+	httpclient.FlushHar()
+	if err != nil {
 		os.Exit(1)
 	}
 }
@@ -50,5 +57,9 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&flags.Proxy, "proxy", "", "",
 		`Set proxy. If not set, will try to get proxy from HTTPS_PROXY env. `+
 			`E.g. "http://127.0.0.1:1080", "socks5://127.0.0.1:7890"`)
+	RootCmd.PersistentFlags().StringVarP(&flags.Record, "record", "", "",
+		`Record all http requests & responses to this HAR file. The file contains sensitive headers (e.g. cookies)`)
+	RootCmd.PersistentFlags().StringVarP(&flags.Replay, "replay", "", "",
+		`Replay http responses from this HAR file (created by --record), no network request will be made`)
 	RootCmd.PersistentFlags().CountVarP(&config.VerboseLevel, "verbose", "v", "verbose (-v, -vv, -vvv)")
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/natefinch/atomic"
 	"github.com/spf13/cobra"
@@ -12,7 +13,10 @@ import (
 	"github.com/sagan/erodownloader/cmd"
 	"github.com/sagan/erodownloader/constants"
 	"github.com/sagan/erodownloader/scraper"
+	"github.com/sagan/erodownloader/transform/classify"
 	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/helper"
+	"github.com/sagan/erodownloader/util/pathtemplate"
 )
 
 var command = &cobra.Command{
@@ -24,7 +28,12 @@ var command = &cobra.Command{
 
 var (
 	force        = false
+	merge        = false
 	noRename     = false
+	dryRun       = false
+	confirm      = false
+	jobs         = 1
+	formats      string
 	moveTo       string
 	savePath     string
 	scraperNames string
@@ -32,32 +41,58 @@ var (
 
 func init() {
 	command.Flags().BoolVarP(&force, "force", "f", false, "Force re-generate")
+	command.Flags().BoolVarP(&merge, "merge", "", false,
+		"Run all applicable scrapers and merge their metadata (see MergePrecedence config)")
+	command.Flags().BoolVarP(&dryRun, "dry-run", "d", false,
+		"Dry run. Show the differences of metadata (even if it exists and --force is not set) and planned rename, "+
+			"but do not write anything")
+	command.Flags().BoolVarP(&confirm, "confirm", "", false,
+		"Show the differences of metadata and planned rename of each dir, and ask for confirmation before applying")
 	command.Flags().BoolVarP(&noRename, "no-rename", "", false, "Do not allow renaming content dir")
 	command.Flags().StringVarP(&savePath, "save-path", "", "", "Process all folders of this path dir")
 	command.Flags().StringVarP(&scraperNames, "scraper", "", "dlsite,asmrone,hvdb,dmm",
 		"Comma-seperated used scraper names")
+	command.Flags().StringVarP(&formats, "format", "", "",
+		`Comma-seperated additional metadata formats written alongside metadata.nfo: `+
+			`"kodi" (album.nfo & folder.jpg), "audiobookshelf" (metadata.json)`)
+	command.Flags().IntVarP(&jobs, "jobs", "j", 1,
+		"Number of dirs scraped in parallel. Requests to the same host are still rate limited")
 	command.Flags().StringVarP(&moveTo, "move-to", "", "", "Move successfully scraped content-dir to this folder")
+	cmd.AddHttpCacheFlags(command, "")
 	cmd.RootCmd.AddCommand(command)
 }
 
 func add(cmd *cobra.Command, args []string) (err error) {
-	if moveTo != "" {
+	if dryRun && confirm {
+		return fmt.Errorf("--dry-run and --confirm flags are NOT compatible")
+	}
+	if moveTo != "" && !dryRun {
 		if err = os.MkdirAll(moveTo, 0700); err != nil {
 			return fmt.Errorf("failed to make move-to dir: %w", err)
 		}
 	}
+	if jobs < 1 {
+		return fmt.Errorf("invalid jobs %d", jobs)
+	}
 	if savePath != "" && len(args) > 0 {
 		return fmt.Errorf("--save-path arg can not be combined with other positional args")
 	}
 	var tmpdir string
-	var dirs []string // each dir is absolute path
-	if savePath != "" {
-		tmpdir := filepath.Join(savePath, constants.TMP_DIR)
+	if dryRun {
+		// dry run does not write anything to content dirs, use the system tmp dir instead.
+		if tmpdir, err = os.MkdirTemp("", "scrape"); err != nil {
+			return fmt.Errorf("failed to create tmp dir: %w", err)
+		}
+		defer os.RemoveAll(tmpdir)
+	} else if savePath != "" {
+		tmpdir = filepath.Join(savePath, constants.TMP_DIR)
 		if err = util.MakeCleanTmpDir(tmpdir); err != nil {
 			return fmt.Errorf("failed to create tmp dir: %w", err)
 		}
 		defer os.RemoveAll(tmpdir)
-
+	}
+	var dirs []string // each dir is absolute path
+	if savePath != "" {
 		entries, err := os.ReadDir(savePath)
 		if err != nil {
 			return fmt.Errorf("failed to read dir: %w", err)
@@ -88,58 +123,51 @@ func add(cmd *cobra.Command, args []string) (err error) {
 		}
 	}
 
+	formatNames := util.SplitCsv(formats)
+	for _, name := range formatNames {
+		if scraper.Writers[name] == nil {
+			return fmt.Errorf("invalid format %q", name)
+		}
+	}
 	scrapers, err := scraper.NewScrapers(util.SplitCsv(scraperNames)...)
 	if err != nil {
 		return fmt.Errorf("failed to create scrapers: %w", err)
 	}
-	errorCnt := 0
-	for i, dir := range dirs {
-		fmt.Printf("(%d/%d) ", i+1, len(dirs))
-		dirname := filepath.Dir(dir)
-		basename := filepath.Base(dir)
-		localtmpdir := tmpdir
-		if tmpdir == "" {
-			localtmpdir = filepath.Join(dir, constants.TMP_DIR)
-			if err = util.MakeCleanTmpDir(localtmpdir); err != nil {
-				fmt.Printf("X %q: failed to create tmp dir: %v\n", dir, err)
-				errorCnt++
-				continue
+	// results[i] receives the output of dirs[i], so that outputs are printed in order.
+	results := make([]chan *scrapeOutput, len(dirs))
+	for i := range results {
+		results[i] = make(chan *scrapeOutput, 1)
+	}
+	indexes := make(chan int)
+	for range min(jobs, len(dirs)) {
+		go func() {
+			for i := range indexes {
+				results[i] <- scrapeDir(dirs[i], tmpdir, scrapers, formatNames)
 			}
+		}()
+	}
+	go func() {
+		for i := range dirs {
+			indexes <- i
 		}
-
-		metadata, err := scrapers.Scrape(dir, localtmpdir, force)
-		if tmpdir == "" {
-			os.RemoveAll(localtmpdir)
-		}
-		if err == nil {
-			targetpath := dirname
-			if moveTo != "" {
-				targetpath = moveTo
-			}
-			if !noRename && metadata.ShouldRename {
-				newname := metadata.GetCanonicalFilename()
-				targetpath = filepath.Join(targetpath, newname)
+		close(indexes)
+	}()
+	errorCnt := 0
+	for i := range dirs {
+		output := <-results[i]
+		fmt.Printf("(%d/%d) %s", i+1, len(dirs), output.text)
+		if output.pending != nil {
+			if helper.AskYesNoConfirm("Apply above changes") {
+				output.text = ""
+				applyDir(output, formatNames)
+				fmt.Print(output.text)
 			} else {
-				targetpath = filepath.Join(targetpath, basename)
-			}
-			renameTip := ""
-			if dir != targetpath {
-				if util.FileExists(targetpath) {
-					renameTip = fmt.Sprintf("rename target %q already exists", targetpath)
-				} else if err := atomic.ReplaceFile(dir, targetpath); err != nil {
-					renameTip = fmt.Sprintf("rename to %q failed: %v", targetpath, err)
-				} else {
-					renameTip = fmt.Sprintf("renamed to %q", targetpath)
-				}
+				output.pending.Discard()
+				output.cleanup()
+				fmt.Printf("- %q: skipped\n", output.pending.Dirname)
 			}
-			if renameTip != "" {
-				renameTip = fmt.Sprintf(" (%s)", renameTip)
-			}
-			fmt.Printf("✓ %q: scrapped (%s)%s\n", dir, metadata.GeneratedBy, renameTip)
-		} else if err == scraper.ErrExists {
-			fmt.Printf("- %q: metadata exists (already scrapped before)\n", dir)
-		} else {
-			fmt.Printf("X %q: failed to scrap: %v\n", dir, err)
+		}
+		if output.failed {
 			errorCnt++
 		}
 	}
@@ -149,3 +177,142 @@ func add(cmd *cobra.Command, args []string) (err error) {
 	}
 	return nil
 }
+
+type scrapeOutput struct {
+	text    string // printed lines
+	failed  bool
+	pending *scraper.Pending // scraped but not yet saved metadata, waiting for user's confirmation
+	cleanup func()
+}
+
+func (output *scrapeOutput) printf(format string, a ...any) {
+	output.text += fmt.Sprintf(format, a...)
+}
+
+// Prevent concurrent jobs from renaming dirs to the same target.
+var renameMu sync.Mutex
+
+// Scrape a single dir. If neither dry-run nor confirm, save metadata and rename or move it if required.
+// The output is buffered and returned.
+func scrapeDir(dir string, tmpdir string, scrapers scraper.Scrapes, formatNames []string) *scrapeOutput {
+	output := &scrapeOutput{cleanup: func() {}}
+	if tmpdir == "" {
+		tmpdir = filepath.Join(dir, constants.TMP_DIR)
+		if err := util.MakeCleanTmpDir(tmpdir); err != nil {
+			output.printf("X %q: failed to create tmp dir: %v\n", dir, err)
+			output.failed = true
+			return output
+		}
+		output.cleanup = func() { os.RemoveAll(tmpdir) }
+	}
+
+	// dry run always scrapes, to show the differences with existing metadata.
+	pending, err := scrapers.Fetch(dir, tmpdir, force || dryRun, merge)
+	if err == scraper.ErrExists {
+		output.cleanup()
+		output.printf("- %q: metadata exists (already scrapped before)\n", dir)
+		return output
+	} else if err != nil {
+		output.cleanup()
+		output.printf("X %q: failed to scrap: %v\n", dir, err)
+		output.failed = true
+		return output
+	}
+	if pending.Metadata.ContentType == "" {
+		pending.Metadata.ContentType = classify.Classify(dir, pending.Metadata, nil).Type
+	}
+	if !dryRun && !confirm {
+		output.pending = pending
+		applyDir(output, formatNames)
+		return output
+	}
+	var oldMetadata *scraper.Metadata
+	if metafile := filepath.Join(dir, scraper.METAFILE); !util.FileExists(metafile) {
+		output.printf("~ %q: would scrape (%s)\n", dir, pending.Metadata.GeneratedBy)
+	} else {
+		if force {
+			output.printf("~ %q: would re-scrape (%s)\n", dir, pending.Metadata.GeneratedBy)
+		} else {
+			output.printf("- %q: metadata exists, would re-scrape with --force (%s)\n", dir, pending.Metadata.GeneratedBy)
+		}
+		if oldMetadata, err = scraper.ReadMetadata(metafile); err != nil {
+			output.printf("  ! failed to read existing %s: %v\n", scraper.METAFILE, err)
+		}
+	}
+	for _, diff := range scraper.DiffMetadata(oldMetadata, pending.Metadata) {
+		output.printf("  %s\n", diff)
+	}
+	for _, file := range pending.Metadata.Files {
+		if !util.FileExists(filepath.Join(dir, file)) {
+			output.printf("  file: +%s\n", file)
+		}
+	}
+	if targetpath := getTargetPath(dir, pending.Metadata); targetpath != dir {
+		tip := ""
+		if util.FileExists(targetpath) {
+			tip = " (target already exists)"
+		}
+		output.printf("  rename: %q => %q%s\n", dir, targetpath, tip)
+	}
+	if dryRun {
+		pending.Discard()
+		output.cleanup()
+	} else {
+		output.pending = pending
+	}
+	return output
+}
+
+// Save pending metadata of output, write additional formats, and rename or move the dir if required.
+func applyDir(output *scrapeOutput, formatNames []string) {
+	pending := output.pending
+	output.pending = nil
+	dir := pending.Dirname
+	metadata := pending.Metadata
+	if err := pending.Save(); err != nil {
+		output.cleanup()
+		output.printf("X %q: failed to scrap: %v\n", dir, err)
+		output.failed = true
+		return
+	}
+	for _, name := range formatNames {
+		if err := scraper.Writers[name](dir, metadata, force); err != nil && err != scraper.ErrExists {
+			output.printf("! %q: failed to write %s metadata: %v\n", dir, name, err)
+		}
+	}
+	// the cleanup of tmpdir inside dir must be done before renaming it
+	output.cleanup()
+	targetpath := getTargetPath(dir, metadata)
+	renameTip := ""
+	if dir != targetpath {
+		renameMu.Lock()
+		if util.FileExists(targetpath) {
+			renameTip = fmt.Sprintf("rename target %q already exists", targetpath)
+		} else if err := os.MkdirAll(filepath.Dir(targetpath), 0700); err != nil {
+			renameTip = fmt.Sprintf("failed to make parent dir of %q: %v", targetpath, err)
+		} else if err := atomic.ReplaceFile(dir, targetpath); err != nil {
+			renameTip = fmt.Sprintf("rename to %q failed: %v", targetpath, err)
+		} else {
+			renameTip = fmt.Sprintf("renamed to %q", targetpath)
+		}
+		renameMu.Unlock()
+	}
+	if renameTip != "" {
+		renameTip = fmt.Sprintf(" (%s)", renameTip)
+	}
+	output.printf("✓ %q: scrapped (%s)%s\n", dir, metadata.GeneratedBy, renameTip)
+}
+
+// Return the path which dir should be renamed or moved to.
+// The canonical name could be a relative path of multiple components (see NameTemplate config).
+func getTargetPath(dir string, metadata *scraper.Metadata) string {
+	name := filepath.Base(dir)
+	if !noRename && metadata.CanonicalFilename != "" && (metadata.ShouldRename || moveTo != "") {
+		name = metadata.CanonicalFilename
+	}
+	root := pathtemplate.Root(dir, name)
+	if moveTo != "" {
+		root = moveTo
+	}
+	return filepath.Join(root, filepath.FromSlash(name))
+}
@@ -30,6 +30,7 @@ var (
 func init() {
 	command.Flags().BoolVarP(&force, "force", "f", false, "Force do action (Do NOT prompt for confirm)")
 	command.Flags().BoolVarP(&add, "add", "", false, "Add files to download queue")
+	cmd.AddHttpCacheFlags(command, "")
 	cmd.RootCmd.AddCommand(command)
 }
 
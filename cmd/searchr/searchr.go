@@ -31,6 +31,7 @@ var command = &cobra.Command{
 
 var (
 	cacheOnly          = false
+	refresh            = false
 	sum                = false
 	add                = false
 	addAsCompleted     = false
@@ -48,6 +49,8 @@ var (
 
 func init() {
 	command.Flags().BoolVarP(&cacheOnly, "cache", "", false, "Use cached index file only")
+	command.Flags().BoolVarP(&refresh, "refresh", "", false,
+		"Force fully refresh the resources index of site (e.g. re-calculate sizes of all alist resource dirs)")
 	command.Flags().BoolVarP(&sum, "sum", "", false, "Show summary only")
 	command.Flags().BoolVarP(&force, "force", "f", false, "Force do action (Do NOT prompt for confirm)")
 	command.Flags().BoolVarP(&add, "add", "", false, "Add resources to download queue")
@@ -65,10 +68,14 @@ func init() {
 		"Skip resource with size larger than (>) this value. -1 == no limit")
 	cmd.AddEnumFlagP(command, &sort, "sort", "", common.ResourceSortFlag)
 	cmd.AddEnumFlagP(command, &order, "order", "", common.OrderFlag)
+	cmd.AddHttpCacheFlags(command, "http-cache")
 	cmd.RootCmd.AddCommand(command)
 }
 
 func searchr(cmd *cobra.Command, args []string) (err error) {
+	if cacheOnly && refresh {
+		return fmt.Errorf("--cache and --refresh flags are NOT compatible")
+	}
 	if util.CountNonZeroVariables(add, addAsCompleted, addAsSkip) > 1 {
 		return fmt.Errorf("--add, --add-completed and --add-skip flags are NOT compatible")
 	}
@@ -96,6 +103,11 @@ func searchr(cmd *cobra.Command, args []string) (err error) {
 			qs += "&"
 		}
 		qs += "cache=1"
+	} else if refresh {
+		if qs != "" {
+			qs += "&"
+		}
+		qs += "refresh=1"
 	}
 
 	siteInstance, err := site.CreateSite(sitename)
@@ -274,7 +274,9 @@ func watch(cmd *cobra.Command, args []string) (err error) {
 		} else {
 			fmt.Fprintf(os.Stderr, "Add new resource download %s %s to client\n",
 				resourceDownload.Number, resourceDownload.GetFilename())
-			savePath := clientInstance.GetConfig().SavePath + client.Sep(clientInstance) + resourceDownload.GetFilename()
+			sep := client.Sep(clientInstance)
+			savePath := clientInstance.GetConfig().SavePath + sep +
+				config.GetSiteNameTemplate(resourceDownload.Site).Path(resourceDownload.TemplateFields(), sep)
 			if !dryRun {
 				_, newDownloads, err := helper.AddDownloadTask(clientInstance, resourceDownload.ResourceId, savePath)
 				handleAddResourceError(db, failedCnt, resourceDownload, err)
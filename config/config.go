@@ -1,12 +1,12 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"slices"
 	"strings"
 	"sync"
 
@@ -17,11 +17,16 @@ import (
 
 	"github.com/sagan/erodownloader/schema"
 	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/cookiejar"
+	"github.com/sagan/erodownloader/util/pathtemplate"
 )
 
 const DEFAULT_PORT = 6968 // 'E' (0x69) + 'D' (0x68)
 const DEFAULT_ZIPMODE = 1 // Zip filename encoding detection mode. 0 -  strict; 1 - guess the best (shift_jis > gbk)
 
+// Cookie jar file in config dir
+const COOKIES_FILE = "cookies.json"
+
 type Config struct {
 	Sites        []*SiteConfig
 	Clients      []*ClientConfig
@@ -33,7 +38,100 @@ type Config struct {
 	UserAgent    string
 	Port         int             // web ui port
 	Token        string          //web ui token
-	Cookies      []*fhttp.Cookie // used keys: name, value, domain, path
+	Cookies      []*fhttp.Cookie // Deprecated: imported to cookie jar (cookies.json) on first run
+	RateLimits   []*RateLimitConfig
+	// Default ttl of http response cache (enabled by --cache flag), e.g. "24h". Empty == default (24h)
+	CacheTtl string
+	Scrapers []*ScraperConfig
+	// Per field precedence of scrapers when merging metadata (scrape --merge). E.g. { narrator = ["hvdb"] }.
+	// Fields: title, author, series, number, date, source, text, narrator, tags, other_edition_number, cover.
+	// Unlisted scrapers follow in --scraper order. List fields (narrator, tags...) are unioned in precedence order
+	MergePrecedence map[string][]string
+	// Names of cloudflare challenge solvers, tried in order: "flaresolverr", "browser", "manual".
+	// Default: ["flaresolverr", "browser"]; a solver is skipped if it's not configured. "none" == do not solve
+	ChallengeSolvers []string
+	// Netscape cookies.txt exported from browser, used by "browser" challenge solver
+	BrowserCookiesFile string
+	// User agent of the browser that BrowserCookiesFile is exported from
+	BrowserUserAgent string
+	// Folder name template of contents, used by scrape renames, normalize --move-to and watch save path.
+	// E.g. "{author}/{date:2006}/<[{number}] >{title}". Default: "<[{number}]><[{author}]>{title}".
+	// See util/pathtemplate for the syntax
+	NameTemplate string
+	// Pipeline profiles of normalize transformers, selected by "normalize --profile NAME".
+	// A profile of the same name as a builtin one ("default", "audio", "cg", "game") overrides it
+	Profiles []*ProfileConfig
+}
+
+// Pipeline profile of normalize. Steps are executed in order.
+type ProfileConfig struct {
+	Name    string
+	Comment string
+	// Default transformer options of profile ("key=value"), which are overrided by "--option" flags
+	Options []string
+	Steps   []*ProfileStepConfig
+}
+
+// A step of pipeline profile. The Transformers are executed in order as a loop,
+// which stops when the last transformer makes no change or the loop has been executed Times times.
+type ProfileStepConfig struct {
+	Transformers []string
+	Times        int // 0 == 1. -1 == unlimited (until no change)
+	// Transformer options ("key=value") applied only in this step, override the global ones
+	Options []string
+}
+
+// Config of a scraper. If Type is set, it's a declarative scraper defined by the config,
+// otherwise it's the settings of a builtin scraper.
+type ScraperConfig struct {
+	Name string
+	// Ttl of cached http responses of scraper, override the site and default cache ttl. "none" == do not cache
+	CacheTtl string
+	Comment  string
+	Type     string // declarative scraper type: "html" or "json"
+	Version  string // default "0.1.0"
+	// Page (html) or api (json) url of work. "{{number}}" is replaced by work number
+	Url string
+	// Regexp of work number in content dir name, must has a "number" sub group. E.g. `\b(?P<number>RJ\d{5,12})\b`
+	NumberPattern string
+	Source        string // default to scraper name
+	Cookie        string // html: cookie header sent to site
+	// html: treat request errors as work not found
+	IgnoreErrors bool
+	// html: treat redirected page as work not found
+	NoRedirect bool
+	// html: try page snapshot of web archive if the page is 404
+	UseWebArchiveFor404 bool
+	// Below fields are css selectors (html) or dot-separated field pathes (json) of work metadata.
+	// A json path could contain array indexes, e.g. "data.tags.0.name";
+	// arrays are flattened if not indexed, e.g. "data.tags.name" selects names of all tags.
+	Title       string
+	Author      string
+	Series      string
+	Date        string
+	DateFormats []string // Go time layouts of date. E.g. "2006年01月02日"
+	Narrator    string
+	Tags        string
+	Cover       []string // tried in order. html: "{{number}}" is replaced by work number
+	Text        []string // all text sections are joined by "\n\n"
+	// html: add tag if the selector element exists. E.g. [".ai-badge => AI"]
+	SelectorTags []string
+	// Rename tags. E.g. ["Voice / ASMR => ボイス・ASMR"]
+	TagMapper  []string
+	RemoveTags []string
+	// Rename content dir to canonical "[number][author]title" name
+	Rename bool
+	// Override global folder name template of contents scraped by this scraper
+	NameTemplate string
+}
+
+// Rate limit of http requests to a domain.
+type RateLimitConfig struct {
+	Domain      string // "example.com", also applies to it's sub domains (sharing the rate limit). "*" == all domains
+	Interval    string // min average interval between requests. E.g. "3s", "500ms"
+	Burst       int    // max requests that can be sent at once
+	Concurrency int    // max concurrent requests. 0 == unlimited
+	Comment     string
 }
 
 type SiteConfig struct {
@@ -43,6 +141,38 @@ type SiteConfig struct {
 	Url      string
 	Internal bool
 	Comment  string
+	Username string   // login username
+	Password string   // login password
+	Token    string   // authorization token, sent as "Authorization" header to site
+	Headers  []string // additional http request headers. E.g. ["Referer: https://example.com/"]
+	Cookie   string   // cookie header of site. E.g. "a=1; b=2"
+	// Override global user agent
+	UserAgent string
+	// Override global proxy. "none" == do not use proxy for site
+	Proxy string
+	// Verify TLS certificate of site. By default the verification is skipped
+	VerifyTls bool
+	// Override global flaresolverr url. "none" == do not use flaresolverr for site
+	FlareSolverr string
+	// Override global challenge solvers. ["none"] == do not solve challenge of site
+	ChallengeSolvers []string
+	// Rate limit of requests to site (shared by all hosts of site), override the domain rate limits. E.g. "3s"
+	RateInterval string
+	RateBurst    int
+	Concurrency  int // max concurrent requests to site host. 0 == unlimited
+	// Ttl of cached http responses of site, override the default cache ttl. "none" == do not cache
+	CacheTtl string
+	// alist: expose each matched dir under these root dirs as a resource. E.g. ["/ASMR", "/Voices"].
+	ResourceRoots []string
+	// alist: regexp of resource dir name, must has a "number" sub group. Default to match RJ / VJ / BJ / d_ numbers.
+	ResourceNumberPattern string
+	// alist: max depth of sub dirs under root dirs that will be crawled. 0 == default (3).
+	ResourceMaxDepth int
+	// alist: min interval of crawling root dirs when searching resources. E.g. "6h". Default "1h"
+	ResourceRefreshInterval string
+	// Override global folder name template of resources downloaded from this site
+	NameTemplate string
+	tokenMu      sync.RWMutex
 }
 
 type ClientConfig struct {
@@ -70,10 +200,14 @@ var (
 	ConfigType        = "" // "toml"
 	Data              *Config
 	Db                *gorm.DB
+	CookieJar         *cookiejar.Jar
 
 	sitesConfigMap           = map[string]*SiteConfig{}
 	internalSitesConfigMap   = map[string]*SiteConfig{}
 	clientsConfigMap         = map[string]*ClientConfig{}
+	scrapersConfigMap        = map[string]*ScraperConfig{}
+	profilesConfigMap        = map[string]*ProfileConfig{}
+	internalProfilesMap      = map[string]*ProfileConfig{}
 	internalClientsConfigMap = map[string]*ClientConfig{}
 )
 
@@ -85,25 +219,55 @@ func (siteConfig *SiteConfig) GetName() string {
 	return name
 }
 
-// Return effective cookie header ("a=1; b=2" format) of provided urlObj.
-// Currently, cookie path is ignored.
-func (c *Config) GetCookieHeader(urlObj *url.URL) string {
-	urlDomain := urlObj.Hostname()
-	cookieStr := ""
-	cookieSep := ""
-	for _, cookie := range c.Cookies {
-		cookieDomain := strings.TrimPrefix(cookie.Domain, ".")
-		if urlDomain == cookieDomain || strings.HasSuffix(urlDomain, "."+cookieDomain) {
-			purecookie := &http.Cookie{
-				Name:  cookie.Name,
-				Value: cookie.Value,
-			}
-			cookieStr += cookieSep + purecookie.String()
-			cookieSep = "; "
-			break
+// Whether urlObj belongs to the site (has the same hostname as site url).
+func (siteConfig *SiteConfig) MatchUrl(urlObj *url.URL) bool {
+	if siteConfig.Url == "" || urlObj == nil {
+		return false
+	}
+	siteUrlObj, err := url.Parse(siteConfig.Url)
+	if err != nil {
+		return false
+	}
+	return siteUrlObj.Hostname() != "" && siteUrlObj.Hostname() == urlObj.Hostname()
+}
+
+// Return parsed additional http request headers of site.
+func (siteConfig *SiteConfig) GetHeader() http.Header {
+	header := http.Header{}
+	for _, line := range siteConfig.Headers {
+		name, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			log.Warnf("site %s: invalid header %q", siteConfig.GetName(), line)
+			continue
 		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
 	}
-	return cookieStr
+	return header
+}
+
+// Return "Authorization" header value of site, or empty string if site has no credentials.
+// Token is used as is; username & password are used for basic auth.
+func (siteConfig *SiteConfig) GetAuthorization() string {
+	if token := siteConfig.GetToken(); token != "" {
+		return token
+	}
+	if siteConfig.Username != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(siteConfig.Username+":"+siteConfig.Password))
+	}
+	return ""
+}
+
+// Token may be updated at runtime (e.g. by login of site), so always access it via GetToken / SetToken.
+func (siteConfig *SiteConfig) GetToken() string {
+	siteConfig.tokenMu.RLock()
+	defer siteConfig.tokenMu.RUnlock()
+	return siteConfig.Token
+}
+
+func (siteConfig *SiteConfig) SetToken(token string) {
+	siteConfig.tokenMu.Lock()
+	defer siteConfig.tokenMu.Unlock()
+	siteConfig.Token = token
 }
 
 func Load() (err error) {
@@ -134,6 +298,24 @@ func Load() (err error) {
 		}
 		sitesConfigMap[sc.GetName()] = sc
 	}
+	for _, sc := range Data.Scrapers {
+		if scrapersConfigMap[sc.Name] != nil {
+			log.Fatalf("Invalid config file: duplicate scraper name %s found", sc.Name)
+		}
+		scrapersConfigMap[sc.Name] = sc
+	}
+	for _, pc := range Data.Profiles {
+		if profilesConfigMap[pc.Name] != nil {
+			log.Fatalf("Invalid config file: duplicate profile name %s found", pc.Name)
+		}
+		if pc.Name == "" || len(pc.Steps) == 0 {
+			log.Fatalf("Invalid config file: profile %q must have name and steps", pc.Name)
+		}
+		profilesConfigMap[pc.Name] = pc
+	}
+	if err = validateNameTemplates(); err != nil {
+		log.Fatalf("Invalid config file: %v", err)
+	}
 	for _, cc := range Data.Clients {
 		if clientsConfigMap[cc.Name] != nil {
 			log.Fatalf("Invalid config file: duplicate client name %s found", cc.Name)
@@ -154,6 +336,10 @@ func Load() (err error) {
 		}
 	}
 
+	if err = loadCookieJar(); err != nil {
+		return fmt.Errorf("failed to load cookies: %w", err)
+	}
+
 	Db, err = schema.Init(filepath.Join(ConfigDir, "data.db"), VerboseLevel)
 	if err != nil {
 		return fmt.Errorf("failed to open data.db: %w", err)
@@ -171,6 +357,117 @@ func GetSiteConfig(name string) *SiteConfig {
 	return internalSitesConfigMap[name]
 }
 
+// Return the config of site which urlObj belongs to. Return nil if not found.
+// If multiple sites match, user sites take precedence over internal sites.
+func GetSiteConfigByUrl(urlObj *url.URL) *SiteConfig {
+	if urlObj == nil {
+		return nil
+	}
+	if Data != nil {
+		for _, sc := range Data.Sites {
+			if sc.MatchUrl(urlObj) {
+				return sc
+			}
+		}
+	}
+	for _, sc := range InternalSites {
+		if sc.MatchUrl(urlObj) {
+			return sc
+		}
+	}
+	return nil
+}
+
+// Return config of scraper. Return nil if scraper has no config.
+func GetScraperConfig(name string) *ScraperConfig {
+	return scrapersConfigMap[name]
+}
+
+// Return pipeline profile of normalize. User profiles take precedence over builtin ones. Return nil if not found.
+func GetProfileConfig(name string) *ProfileConfig {
+	if profilesConfigMap[name] != nil {
+		return profilesConfigMap[name]
+	}
+	return internalProfilesMap[name]
+}
+
+// Return builtin pipeline profile. Return nil if not found.
+func GetInternalProfileConfig(name string) *ProfileConfig {
+	return internalProfilesMap[name]
+}
+
+// Return all pipeline profiles, builtin ones first. Overrided builtin profiles are replaced by user ones.
+func GetProfileConfigs() (profiles []*ProfileConfig) {
+	for _, pc := range InternalProfiles {
+		profiles = append(profiles, GetProfileConfig(pc.Name))
+	}
+	if Data != nil {
+		for _, pc := range Data.Profiles {
+			if internalProfilesMap[pc.Name] == nil {
+				profiles = append(profiles, pc)
+			}
+		}
+	}
+	return profiles
+}
+
+// Add config of a scraper that is defined outside config file (e.g. in scrapers dir).
+func AddScraperConfig(sc *ScraperConfig) error {
+	if scrapersConfigMap[sc.Name] != nil {
+		return fmt.Errorf("duplicate scraper name %s found", sc.Name)
+	}
+	if sc.NameTemplate != "" {
+		if _, err := pathtemplate.Parse(sc.NameTemplate); err != nil {
+			return fmt.Errorf("scraper %s: %w", sc.Name, err)
+		}
+	}
+	scrapersConfigMap[sc.Name] = sc
+	Data.Scrapers = append(Data.Scrapers, sc)
+	return nil
+}
+
+// Return folder name template of site, fallback to global NameTemplate, then the default one.
+func GetSiteNameTemplate(name string) *pathtemplate.Template {
+	if sc := GetSiteConfig(name); sc != nil && sc.NameTemplate != "" {
+		return pathtemplate.MustParse(sc.NameTemplate)
+	}
+	return getNameTemplate()
+}
+
+// Return folder name template of scraper, fallback to global NameTemplate, then the default one.
+func GetScraperNameTemplate(name string) *pathtemplate.Template {
+	if sc := GetScraperConfig(name); sc != nil && sc.NameTemplate != "" {
+		return pathtemplate.MustParse(sc.NameTemplate)
+	}
+	return getNameTemplate()
+}
+
+func getNameTemplate() *pathtemplate.Template {
+	if Data != nil && Data.NameTemplate != "" {
+		return pathtemplate.MustParse(Data.NameTemplate)
+	}
+	return pathtemplate.Default
+}
+
+func validateNameTemplates() error {
+	templates := []string{Data.NameTemplate}
+	for _, sc := range Data.Sites {
+		templates = append(templates, sc.NameTemplate)
+	}
+	for _, sc := range Data.Scrapers {
+		templates = append(templates, sc.NameTemplate)
+	}
+	for _, template := range templates {
+		if template == "" {
+			continue
+		}
+		if _, err := pathtemplate.Parse(template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func GetClientConfig(name string) *ClientConfig {
 	if name == "" {
 		return nil
@@ -181,23 +478,30 @@ func GetClientConfig(name string) *ClientConfig {
 	return internalClientsConfigMap[name]
 }
 
-func UpdateCookies(userAgent string, cookies []*fhttp.Cookie) error {
-	mu.Lock()
-	defer mu.Unlock()
-	Data.UserAgent = userAgent
-	for _, cookie := range cookies {
-		i := slices.IndexFunc(Data.Cookies, func(c *fhttp.Cookie) bool {
-			return c.Domain == cookie.Domain && c.Path == cookie.Path && c.Name == cookie.Name
-		})
-		if i != -1 {
-			Data.Cookies[i].Value = cookie.Value
-			continue
+// Load cookie jar. On first run, the legacy cookies in config file are imported into it.
+func loadCookieJar() (err error) {
+	cookiesFile := filepath.Join(ConfigDir, COOKIES_FILE)
+	exists := util.FileExists(cookiesFile)
+	if CookieJar, err = cookiejar.New(cookiesFile); err != nil {
+		return err
+	}
+	if !exists && len(Data.Cookies) > 0 {
+		for _, cookie := range Data.Cookies {
+			urlObj := &url.URL{Scheme: "https", Host: strings.TrimPrefix(cookie.Domain, "."), Path: "/"}
+			CookieJar.SetCookies(urlObj, []*fhttp.Cookie{cookie})
 		}
-		Data.Cookies = append(Data.Cookies, cookie)
+		log.Infof("Imported %d cookies from config file to %s", len(Data.Cookies), cookiesFile)
+		return CookieJar.Save()
 	}
-	viper.Set("useragent", Data.UserAgent)
-	viper.Set("cookies", Data.Cookies)
-	return viper.WriteConfig()
+	return nil
+}
+
+// Save cookies received from urlObj (e.g. by challenge solvers) to cookie jar.
+func UpdateCookies(urlObj *url.URL, cookies []*fhttp.Cookie) error {
+	mu.Lock()
+	defer mu.Unlock()
+	CookieJar.SetCookies(urlObj, cookies)
+	return CookieJar.Save()
 }
 
 func init() {
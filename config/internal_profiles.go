@@ -0,0 +1,52 @@
+package config
+
+// Builtin pipeline profiles of normalize.
+var InternalProfiles = []*ProfileConfig{
+	{
+		Name:    "default",
+		Comment: "General contents",
+		Steps: []*ProfileStepConfig{
+			{Transformers: []string{"decensorship", "correctext", "decompress", "text", "nocredit", "denesting"}, Times: -1},
+			{Transformers: []string{"wav"}},
+			{Transformers: []string{"noempty"}},
+			{Transformers: []string{"normalizename"}},
+			{Transformers: []string{"clean"}},
+		},
+	},
+	{
+		Name:    "audio",
+		Comment: "Voice / ASMR / music works. Also write metadata.nfo to audio tags",
+		Steps: []*ProfileStepConfig{
+			{Transformers: []string{"decensorship", "correctext", "decompress", "text", "nocredit", "denesting"}, Times: -1},
+			{Transformers: []string{"wav"}},
+			{Transformers: []string{"audiotag"}},
+			{Transformers: []string{"noempty"}},
+			{Transformers: []string{"normalizename"}},
+			{Transformers: []string{"clean"}},
+		},
+	},
+	{
+		Name:    "cg",
+		Comment: "CG / image collections",
+		Steps: []*ProfileStepConfig{
+			{Transformers: []string{"decensorship", "correctext", "decompress", "text", "nocredit", "denesting"}, Times: -1},
+			{Transformers: []string{"noempty"}},
+			{Transformers: []string{"normalizename"}},
+			{Transformers: []string{"clean"}},
+		},
+	},
+	{
+		Name:    "game",
+		Comment: "Games. Files inside are never renamed or converted",
+		Steps: []*ProfileStepConfig{
+			{Transformers: []string{"decompress", "denesting"}, Times: -1},
+			{Transformers: []string{"clean"}},
+		},
+	},
+}
+
+func init() {
+	for _, profile := range InternalProfiles {
+		internalProfilesMap[profile.Name] = profile
+	}
+}
@@ -6,6 +6,7 @@ import (
 )
 
 const NONE = "none"
+const STDIN = "-"
 const NAME = "erodownloader"
 const TMP_DIR = ".edtmp"
 const ORIG_DIR = ".orig"
@@ -50,6 +51,9 @@ var Utf8bom = []byte{0xEF, 0xBB, 0xBF}
 // common img exts: .webp, .png, .jpg...
 var ImgExts = []string{".webp", ".png", ".jpg", ".jpeg"}
 
+// common audio exts
+var AudioExts = []string{".mp3", ".flac", ".wav", ".m4a", ".m4b", ".aac", ".ogg", ".opus", ".wma"}
+
 // common archive exts: ".rar", ".zip", ".7z"...
 var ArchiveExts = []string{".rar", ".zip", ".7z"}
 
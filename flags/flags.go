@@ -2,7 +2,12 @@
 package flags
 
 var (
-	DumpHeaders = false
-	DumpBodies  = false
-	Proxy       = ""
+	DumpHeaders  = false
+	DumpBodies   = false
+	Proxy        = ""
+	Cache        = false // enable http response cache, use default ttl if ttl is not configured
+	NoCache      = false // disable http response cache. Take precedence over other cache flags
+	RefreshCache = false // do not use cached http responses, but still cache new responses
+	Record       = ""    // record all http requests to this har file
+	Replay       = ""    // replay http responses from this har file, instead of sending requests
 )
@@ -0,0 +1,320 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/natefinch/atomic"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/flags"
+)
+
+// Default ttl of cached responses if ttl is not configured.
+const DEFAULT_CACHE_TTL = time.Hour * 24
+
+// Dir name (in config dir) of http response cache.
+const CACHE_DIR = "cache"
+
+// A cached http response, stored as a json file in cache dir.
+type CacheEntry struct {
+	Method       string      `json:"method,omitempty"`
+	Url          string      `json:"url,omitempty"`
+	ResUrl       string      `json:"res_url,omitempty"` // final url of response, after redirects
+	StatusCode   int         `json:"status_code,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         []byte      `json:"body,omitempty"`
+	Time         int64       `json:"time,omitempty"`    // unix timestamp (seconds) of response
+	Expires      int64       `json:"expires,omitempty"` // unix timestamp (seconds)
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+}
+
+// Parse a cache ttl string. "" => 0 (not set); "none" => -1 (do not cache).
+func ParseCacheTtl(ttl string) time.Duration {
+	if ttl == "" {
+		return 0
+	}
+	if ttl == constants.NONE {
+		return -1
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		log.Warnf("Invalid cache ttl %q, ignore it", ttl)
+		return 0
+	}
+	if d <= 0 {
+		return -1
+	}
+	return d
+}
+
+// Return effective cache ttl of req. <= 0 means the response should not be cached.
+// Cache is only enabled by "--cache" flag, and always disabled when recording or replaying har.
+// Ttl precedence: per call options > site config > global config > default.
+func getCacheTtl(req *azuretls.Request, options *Options) time.Duration {
+	if !flags.Cache || flags.NoCache || flags.Record != "" || flags.Replay != "" || req.IgnoreBody {
+		return -1
+	}
+	method := getMethod(req)
+	if method != http.MethodGet && method != http.MethodHead && !options.RetryNonIdempotent {
+		return -1
+	}
+	if options.CacheTtl != 0 {
+		return options.CacheTtl
+	}
+	if urlObj, err := url.Parse(req.Url); err == nil {
+		if siteConfig := config.GetSiteConfigByUrl(urlObj); siteConfig != nil {
+			if ttl := ParseCacheTtl(siteConfig.CacheTtl); ttl != 0 {
+				return ttl
+			}
+		}
+	}
+	if config.Data != nil {
+		if ttl := ParseCacheTtl(config.Data.CacheTtl); ttl != 0 {
+			return ttl
+		}
+	}
+	return DEFAULT_CACHE_TTL
+}
+
+// Cache key of a request: hash of method, url, body and the credentials that identify the account
+// (see getCredentials), so that cached responses are not shared across accounts.
+func getCacheKey(req *azuretls.Request) string {
+	hash := sha256.New()
+	hash.Write([]byte(getMethod(req) + " " + req.Url + "\n"))
+	switch body := req.Body.(type) {
+	case nil:
+	case []byte:
+		hash.Write(body)
+	case string:
+		hash.Write([]byte(body))
+	default:
+		fmt.Fprint(hash, body)
+	}
+	if credentials := getCredentials(req); len(credentials) > 0 {
+		hash.Write([]byte("\n" + strings.Join(credentials, "\n")))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Whether header of name is a credential header, e.g. "Authorization", "Cookie", "X-Api-Key", "X-Auth-Token".
+func isCredentialHeader(name string) bool {
+	name = strings.ToLower(name)
+	return name == "cookie" || slices.ContainsFunc([]string{"auth", "token", "key", "session"}, func(str string) bool {
+		return strings.Contains(name, str)
+	})
+}
+
+// Return sorted "name: value" of credentials that identify the account of req: credential headers of req
+// and site config, site authorization and cookie. Cookies of cookie jar are not included, as many of them
+// (e.g. cloudflare "__cf_bm") are rotated on every response.
+func getCredentials(req *azuretls.Request) (credentials []string) {
+	for _, header := range req.OrderedHeaders {
+		if len(header) > 1 && isCredentialHeader(header[0]) {
+			credentials = append(credentials, strings.ToLower(header[0])+": "+strings.Join(header[1:], ", "))
+		}
+	}
+	urlObj, err := url.Parse(req.Url)
+	if err != nil {
+		return credentials
+	}
+	if siteConfig := config.GetSiteConfigByUrl(urlObj); siteConfig != nil {
+		for name, values := range siteConfig.GetHeader() {
+			if isCredentialHeader(name) {
+				credentials = append(credentials, "site "+strings.ToLower(name)+": "+strings.Join(values, ", "))
+			}
+		}
+		if authorization := siteConfig.GetAuthorization(); authorization != "" {
+			credentials = append(credentials, "site authorization: "+authorization)
+		}
+		if siteConfig.Cookie != "" {
+			credentials = append(credentials, "site cookie: "+siteConfig.Cookie)
+		}
+	}
+	slices.Sort(credentials)
+	return credentials
+}
+
+// Return upper cased method of req. Empty method is GET.
+func getMethod(req *azuretls.Request) string {
+	if req.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(req.Method)
+}
+
+func getCacheFile(key string) string {
+	return filepath.Join(config.ConfigDir, CACHE_DIR, key[:2], key+".json")
+}
+
+func readCache(key string) *CacheEntry {
+	contents, err := os.ReadFile(getCacheFile(key))
+	if err != nil {
+		return nil
+	}
+	var entry *CacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		log.Debugf("invalid cache file of %s: %v", key, err)
+		return nil
+	}
+	return entry
+}
+
+func writeCache(key string, entry *CacheEntry) error {
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	cachefile := getCacheFile(key)
+	if err := os.MkdirAll(filepath.Dir(cachefile), 0700); err != nil {
+		return err
+	}
+	return atomic.WriteFile(cachefile, bytes.NewReader(contents))
+}
+
+// Parse response cache headers. Return the max freshness lifetime allowed by server (-1 == unlimited),
+// and whether the response can be stored.
+func parseCacheHeaders(header fhttp.Header) (maxAge time.Duration, store bool) {
+	maxAge, store = -1, true
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch name {
+		case "no-store":
+			store = false
+		case "no-cache":
+			maxAge = 0
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && maxAge != 0 {
+				maxAge = time.Duration(max(seconds, 0)) * time.Second
+			}
+		}
+	}
+	if maxAge == -1 && header.Get("Expires") != "" {
+		if t, err := fhttp.ParseTime(header.Get("Expires")); err == nil {
+			maxAge = max(time.Until(t), 0)
+		} else {
+			maxAge = 0 // invalid Expires (e.g. "0") means already expired
+		}
+	}
+	return
+}
+
+// Convert a cached entry to response of req.
+func (entry *CacheEntry) response(req *azuretls.Request) *azuretls.Response {
+	header := fhttp.Header{}
+	for name, values := range entry.Header {
+		header[name] = values
+	}
+	resUrl := entry.ResUrl
+	if resUrl == "" {
+		resUrl = entry.Url
+	}
+	resReq := cloneRequest(req)
+	resReq.Url = resUrl
+	return &azuretls.Response{
+		StatusCode:    entry.StatusCode,
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		Body:          entry.Body,
+		Header:        header,
+		Url:           resUrl,
+		Request:       resReq,
+		ContentLength: int64(len(entry.Body)),
+	}
+}
+
+// Do req with cache. The response of a successful (2xx) request is cached for ttl
+// (capped by "Cache-Control" / "Expires" response headers; "no-store" responses
+// and the ones rejected by options.CacheValidate are not cached).
+// Expired entries that have "ETag" / "Last-Modified" are revalidated using conditional request.
+func doWithCache(req *azuretls.Request, ttl time.Duration, options *Options,
+	do func(req *azuretls.Request) (*azuretls.Response, error)) (*azuretls.Response, error) {
+	key := getCacheKey(req)
+	var entry *CacheEntry
+	if !flags.RefreshCache {
+		entry = readCache(key)
+	}
+	now := time.Now()
+	if entry != nil {
+		if entry.Method == getMethod(req) && entry.Url == req.Url && now.Unix() < entry.Expires {
+			log.Debugf("use cached response of %s %s (time=%s)", req.Method, req.Url,
+				time.Unix(entry.Time, 0).Format(time.RFC3339))
+			return entry.response(req), nil
+		}
+		if entry.ETag != "" || entry.LastModified != "" {
+			req = cloneRequest(req)
+			if entry.ETag != "" {
+				req.OrderedHeaders.Set("If-None-Match", entry.ETag)
+			}
+			if entry.LastModified != "" {
+				req.OrderedHeaders.Set("If-Modified-Since", entry.LastModified)
+			}
+		} else {
+			entry = nil
+		}
+	}
+	res, err := do(req)
+	if err != nil || res == nil {
+		return res, err
+	}
+	if res.StatusCode == http.StatusNotModified && entry != nil {
+		log.Debugf("cached response of %s %s revalidated", req.Method, req.Url)
+		maxAge, _ := parseCacheHeaders(res.Header)
+		entry.Expires = getExpires(now, ttl, maxAge)
+		if err := writeCache(key, entry); err != nil {
+			log.Warnf("Failed to write http cache of %s: %v", req.Url, err)
+		}
+		return entry.response(req), nil
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 || res.IgnoreBody {
+		return res, err
+	}
+	maxAge, store := parseCacheHeaders(res.Header)
+	if !store || options.CacheValidate != nil && !options.CacheValidate(res.Body) {
+		return res, err
+	}
+	entry = &CacheEntry{
+		Method:       getMethod(req),
+		Url:          req.Url,
+		ResUrl:       res.Url,
+		StatusCode:   res.StatusCode,
+		Header:       http.Header{},
+		Body:         res.Body,
+		Time:         now.Unix(),
+		Expires:      getExpires(now, ttl, maxAge),
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+	for name, values := range res.Header {
+		// Do not store cookies. They are managed by client.
+		if name != "Set-Cookie" {
+			entry.Header[name] = values
+		}
+	}
+	if err := writeCache(key, entry); err != nil {
+		log.Warnf("Failed to write http cache of %s: %v", req.Url, err)
+	}
+	return res, nil
+}
+
+func getExpires(now time.Time, ttl time.Duration, maxAge time.Duration) int64 {
+	if maxAge >= 0 {
+		ttl = min(ttl, maxAge)
+	}
+	return now.Add(ttl).Unix()
+}
@@ -0,0 +1,112 @@
+package httpclient
+
+import (
+	"fmt"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/util"
+)
+
+type FlaresolverrApiRequest struct {
+	Cmd               string                          `json:"cmd,omitempty"`
+	Url               string                          `json:"url,omitempty"`
+	MaxTimeout        int                             `json:"maxTimeout,omitempty"`
+	ReturnOnlyCookies bool                            `json:"returnOnlyCookies,omitempty"`
+	Cookies           []*FlaresolverrApiRequestCookie `json:"cookies,omitempty"`
+}
+
+type FlaresolverrApiRequestCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type FlaresolverrApiResponseCookie struct {
+	Name     string
+	Value    string
+	Domain   string
+	Path     string
+	Expires  float64 // unix timestamp. -1 == session cookie
+	Secure   bool
+	HttpOnly bool
+}
+
+type FlaresolverrApiResponse struct {
+	Status   string            `json:"status,omitempty"`  // "ok"
+	Message  string            `json:"message,omitempty"` // "Challenge solved!"
+	Solution *FlaresolverrData `json:"solution,omitempty"`
+}
+
+// "solution" field in flaresolverr API response
+type FlaresolverrData struct {
+	Url       string                           `json:"url,omitempty"`
+	Headers   map[string]string                `json:"headers,omitempty"`
+	Status    int                              `json:"status,omitempty"`
+	UserAgent string                           `json:"userAgent,omitempty"`
+	Response  string                           `json:"response,omitempty"`
+	Cookies   []*FlaresolverrApiResponseCookie `json:"cookies,omitempty"`
+}
+
+// Solve challenge using a FlareSolverr instance. See https://github.com/FlareSolverr/FlareSolverr .
+type flareSolverrSolver struct{}
+
+func (flareSolverrSolver) Solve(ctx *ChallengeContext) (*ChallengeSolution, error) {
+	flaresolverr := config.Data.FlareSolverr
+	if ctx.SiteConfig != nil && ctx.SiteConfig.FlareSolverr != "" {
+		flaresolverr = ctx.SiteConfig.FlareSolverr
+	}
+	if flaresolverr == "" || flaresolverr == constants.NONE {
+		return nil, ErrSolverUnavailable
+	}
+	payload := &FlaresolverrApiRequest{
+		Cmd:               "request.get",
+		Url:               ctx.Url.String(),
+		MaxTimeout:        300000,
+		ReturnOnlyCookies: true,
+	}
+	if config.CookieJar != nil {
+		for _, cookie := range config.CookieJar.Cookies(ctx.Url) {
+			payload.Cookies = append(payload.Cookies,
+				&FlaresolverrApiRequestCookie{Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+	var resBody *FlaresolverrApiResponse
+	err := PostAndFetchJson(flaresolverr, payload, &resBody, false, &Options{MaxAttempts: 1, CacheTtl: -1, Solver: true})
+	if err != nil {
+		return nil, fmt.Errorf("flaresolverr api request error: %w", err)
+	}
+	if resBody.Status != "ok" || resBody.Solution == nil {
+		return nil, fmt.Errorf("flaresolverr failed: status=%s, message=%s", resBody.Status, resBody.Message)
+	}
+	data := resBody.Solution
+	// If returnOnlyCookies is set, status is 0
+	if data.Status != 200 && data.Status != 0 {
+		return nil, fmt.Errorf("flaresolverr failed: status=%d", data.Status)
+	}
+	log.Tracef("flaresolverr solved: %v", data)
+	cookies := util.Map(data.Cookies, func(c *FlaresolverrApiResponseCookie) *fhttp.Cookie {
+		cookie := &fhttp.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if c.Expires > 0 {
+			cookie.Expires = time.Unix(int64(c.Expires), 0)
+		} else {
+			cookie.MaxAge = 86400 * 365
+		}
+		return cookie
+	})
+	return &ChallengeSolution{UserAgent: data.UserAgent, Cookies: cookies}, nil
+}
+
+func init() {
+	RegisterSolver("flaresolverr", flareSolverrSolver{})
+}
@@ -0,0 +1,361 @@
+package httpclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/natefinch/atomic"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/flags"
+	"github.com/sagan/erodownloader/version"
+)
+
+// HTTP Archive (HAR) 1.2. See http://www.softwareishard.com/blog/har-12-spec/ .
+// Only the fields used by recording & replaying are defined.
+type Har struct {
+	Log *HarLog `json:"log"`
+}
+
+type HarLog struct {
+	Version string      `json:"version"`
+	Creator *HarCreator `json:"creator"`
+	Entries []*HarEntry `json:"entries"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime string       `json:"startedDateTime"`
+	Time            int64        `json:"time"` // ms
+	Request         *HarRequest  `json:"request"`
+	Response        *HarResponse `json:"response"`
+	Cache           struct{}     `json:"cache"`
+	Timings         *HarTimings  `json:"timings"`
+	Comment         string       `json:"comment,omitempty"` // request error, if any
+}
+
+type HarRequest struct {
+	Method      string          `json:"method"`
+	Url         string          `json:"url"`
+	HttpVersion string          `json:"httpVersion"`
+	Headers     []*HarNameValue `json:"headers"`
+	QueryString []*HarNameValue `json:"queryString"`
+	Cookies     []*HarNameValue `json:"cookies"`
+	PostData    *HarPostData    `json:"postData,omitempty"`
+	HeadersSize int64           `json:"headersSize"`
+	BodySize    int64           `json:"bodySize"`
+}
+
+type HarResponse struct {
+	Status      int             `json:"status"`
+	StatusText  string          `json:"statusText"`
+	HttpVersion string          `json:"httpVersion"`
+	Headers     []*HarNameValue `json:"headers"`
+	Cookies     []*HarNameValue `json:"cookies"`
+	Content     *HarContent     `json:"content"`
+	RedirectURL string          `json:"redirectURL"`
+	HeadersSize int64           `json:"headersSize"`
+	BodySize    int64           `json:"bodySize"`
+	Url         string          `json:"_url,omitempty"` // final url of response, after redirects
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HarContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"` // "base64" for binary contents
+	Comment  string `json:"comment,omitempty"`  // why text is omitted, if any
+}
+
+type HarTimings struct {
+	Send    int64 `json:"send"`
+	Wait    int64 `json:"wait"`
+	Receive int64 `json:"receive"`
+}
+
+// Max size of response body that is recorded in har. Larger bodies are omitted.
+const MAX_HAR_BODY_SIZE = 10 * 1024 * 1024
+
+// Min interval of writing recorded har file. Recorded requests are batched.
+const HAR_SAVE_INTERVAL = time.Second * 5
+
+// A recorded request error, or no recorded response found in replay mode.
+var ErrNotRecorded = fmt.Errorf("no recorded response found in har file")
+
+var (
+	harMu         sync.Mutex
+	harRecord     *Har           // --record
+	harReplay     *Har           // --replay
+	harReplayUsed map[int]bool   // index of replayed entries
+	harReplayLast map[string]int // "method url" => index of last replayed entry
+	harSaveTimer  *time.Timer
+)
+
+// Load har file for replaying, or create an empty har for recording, according to flags.
+func initHar() error {
+	if flags.Record != "" && flags.Replay != "" {
+		return fmt.Errorf("--record and --replay flags are NOT compatible")
+	}
+	if flags.Record != "" {
+		harRecord = &Har{Log: &HarLog{
+			Version: "1.2",
+			Creator: &HarCreator{Name: constants.NAME, Version: version.Version},
+			Entries: []*HarEntry{},
+		}}
+		log.Warnf("Record http requests to %q. Note the file contains sensitive headers, e.g. cookies", flags.Record)
+		return writeHar()
+	}
+	if flags.Replay != "" {
+		contents, err := os.ReadFile(flags.Replay)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(contents, &harReplay); err != nil || harReplay.Log == nil {
+			return fmt.Errorf("invalid har file (err=%v)", err)
+		}
+		harReplayUsed = map[int]bool{}
+		harReplayLast = map[string]int{}
+		log.Warnf("Replay http requests from %q (%d entries), no network request will be made",
+			flags.Replay, len(harReplay.Log.Entries))
+	}
+	return nil
+}
+
+// Write pending recorded requests to har file. It should be called before program exits.
+func FlushHar() {
+	harMu.Lock()
+	defer harMu.Unlock()
+	if harSaveTimer != nil {
+		harSaveTimer.Stop()
+		harSaveTimer = nil
+	}
+	if harRecord == nil {
+		return
+	}
+	if err := writeHar(); err != nil {
+		log.Errorf("Failed to write har file: %v", err)
+	}
+}
+
+func writeHar() error {
+	contents, err := json.MarshalIndent(harRecord, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomic.WriteFile(flags.Record, bytes.NewReader(contents))
+}
+
+func getRequestBody(req *azuretls.Request) string {
+	switch body := req.Body.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(body)
+	case string:
+		return body
+	default:
+		return fmt.Sprint(body)
+	}
+}
+
+// Record a finished request to har. The response body of a IgnoreBody (streaming) request,
+// or a body larger than MAX_HAR_BODY_SIZE, is not recorded. The har file is written later, see FlushHar.
+func recordHar(req *azuretls.Request, res *azuretls.Response, err error, start time.Time) {
+	entry := &HarEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            time.Since(start).Milliseconds(),
+		Request: &HarRequest{
+			Method:      getMethod(req),
+			Url:         req.Url,
+			HttpVersion: "HTTP/1.1",
+			Headers:     []*HarNameValue{},
+			QueryString: []*HarNameValue{},
+			Cookies:     []*HarNameValue{},
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Timings: &HarTimings{Send: 0, Wait: time.Since(start).Milliseconds(), Receive: 0},
+	}
+	for _, header := range req.OrderedHeaders {
+		if len(header) >= 2 {
+			entry.Request.Headers = append(entry.Request.Headers, &HarNameValue{Name: header[0], Value: header[1]})
+		}
+	}
+	if urlObj, err := url.Parse(req.Url); err == nil {
+		for name, values := range urlObj.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, &HarNameValue{Name: name, Value: value})
+			}
+		}
+	}
+	if body := getRequestBody(req); body != "" {
+		entry.Request.BodySize = int64(len(body))
+		entry.Request.PostData = &HarPostData{MimeType: req.OrderedHeaders.Get("Content-Type"), Text: body}
+	}
+	if err != nil {
+		entry.Comment = err.Error()
+	}
+	entry.Response = &HarResponse{
+		Headers:     []*HarNameValue{},
+		Cookies:     []*HarNameValue{},
+		Content:     &HarContent{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if res != nil {
+		body := res.Body
+		entry.Response.Status = res.StatusCode
+		entry.Response.StatusText = http.StatusText(res.StatusCode)
+		entry.Response.HttpVersion = "HTTP/1.1"
+		entry.Response.RedirectURL = res.Header.Get("Location")
+		entry.Response.Url = res.Url
+		for name, values := range res.Header {
+			for _, value := range values {
+				entry.Response.Headers = append(entry.Response.Headers, &HarNameValue{Name: name, Value: value})
+			}
+		}
+		for _, cookie := range azuretls.ReadSetCookies(res.Header) {
+			entry.Response.Cookies = append(entry.Response.Cookies, &HarNameValue{Name: cookie.Name, Value: cookie.Value})
+		}
+		entry.Response.BodySize = int64(len(body))
+		entry.Response.Content.Size = int64(len(body))
+		entry.Response.Content.MimeType = res.Header.Get("Content-Type")
+		if res.IgnoreBody {
+			entry.Response.BodySize = res.ContentLength
+			entry.Response.Content.Size = res.ContentLength
+			entry.Response.Content.Comment = "body of streaming response is not recorded"
+		} else if len(body) > MAX_HAR_BODY_SIZE {
+			entry.Response.Content.Comment = "large body is not recorded"
+		} else if utf8.Valid(body) {
+			entry.Response.Content.Text = string(body)
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+			entry.Response.Content.Encoding = "base64"
+		}
+	}
+	harMu.Lock()
+	defer harMu.Unlock()
+	harRecord.Log.Entries = append(harRecord.Log.Entries, entry)
+	if harSaveTimer == nil {
+		harSaveTimer = time.AfterFunc(HAR_SAVE_INTERVAL, FlushHar)
+	}
+}
+
+// Find the recorded response of req. Entries are matched by method, url and request body;
+// if no such entry found, match by method and url only. Entries of same request are replayed in recorded order,
+// the last one is re-used if all of them have been replayed.
+func replayHar(req *azuretls.Request) (*azuretls.Response, error) {
+	harMu.Lock()
+	defer harMu.Unlock()
+	method := getMethod(req)
+	body := getRequestBody(req)
+	key := method + " " + req.Url
+	index := -1
+	for _, matchBody := range []bool{true, false} {
+		for i, entry := range harReplay.Log.Entries {
+			if harReplayUsed[i] || entry.Request == nil || entry.Request.Method != method || entry.Request.Url != req.Url {
+				continue
+			}
+			recordedBody := ""
+			if entry.Request.PostData != nil {
+				recordedBody = entry.Request.PostData.Text
+			}
+			if !matchBody || recordedBody == body {
+				index = i
+				break
+			}
+		}
+		if index != -1 {
+			break
+		}
+	}
+	if index == -1 {
+		if last, ok := harReplayLast[key]; ok {
+			index = last
+		} else {
+			return nil, fmt.Errorf("%w: %s %s", ErrNotRecorded, method, req.Url)
+		}
+	}
+	harReplayUsed[index] = true
+	harReplayLast[key] = index
+	entry := harReplay.Log.Entries[index]
+	if entry.Response == nil || entry.Response.Status == 0 {
+		return nil, fmt.Errorf("%w: recorded error: %s", ErrNotRecorded, entry.Comment)
+	}
+	header := fhttp.Header{}
+	for _, h := range entry.Response.Headers {
+		header.Add(h.Name, h.Value)
+	}
+	var resBody []byte
+	if entry.Response.Content != nil {
+		if entry.Response.Content.Encoding == "base64" {
+			var err error
+			if resBody, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text); err != nil {
+				return nil, fmt.Errorf("invalid recorded response body: %w", err)
+			}
+		} else {
+			resBody = []byte(entry.Response.Content.Text)
+		}
+	}
+	resUrl := entry.Response.Url
+	if resUrl == "" {
+		resUrl = req.Url
+	}
+	resReq := cloneRequest(req)
+	resReq.Url = resUrl
+	res := &azuretls.Response{
+		StatusCode:    entry.Response.Status,
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText),
+		Header:        header,
+		Url:           resUrl,
+		Request:       resReq,
+		ContentLength: int64(len(resBody)),
+		IgnoreBody:    req.IgnoreBody,
+	}
+	if req.IgnoreBody {
+		res.RawBody = io.NopCloser(bytes.NewReader(resBody))
+	} else {
+		res.Body = resBody
+	}
+	log.Debugf("replay %s %s => status=%d", method, req.Url, res.StatusCode)
+	return res, nil
+}
+
+// Send req using client, or replay it from har file. If recording, the request is recorded.
+func doRequest(client *azuretls.Session, req *azuretls.Request) (res *azuretls.Response, err error) {
+	if harReplay != nil {
+		return replayHar(req)
+	}
+	start := time.Now()
+	res, err = client.Do(req)
+	if harRecord != nil {
+		recordHar(req, res, err, start)
+	}
+	return res, err
+}
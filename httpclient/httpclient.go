@@ -1,7 +1,6 @@
 package httpclient
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,14 +9,12 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Noooste/azuretls-client"
-	fhttp "github.com/Noooste/fhttp"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
 
 	"github.com/sagan/erodownloader/config"
 	"github.com/sagan/erodownloader/constants"
@@ -25,56 +22,14 @@ import (
 	"github.com/sagan/erodownloader/util"
 )
 
-type FlaresolverrApiRequest struct {
-	Cmd               string `json:"cmd,omitempty"`
-	Url               string `json:"url,omitempty"`
-	MaxTimeout        int    `json:"maxTimeout,omitempty"`
-	ReturnOnlyCookies bool   `json:"returnOnlyCookies,omitempty"`
-}
-
-type FlaresolverrApiResponseCookie struct {
-	Name    string
-	Value   string
-	Domain  string
-	Path    string
-	Expires int64
-}
-
-type FlaresolverrApiResponse struct {
-	Status   string            `json:"status,omitempty"`  // "ok"
-	Message  string            `json:"message,omitempty"` // "Challenge solved!"
-	Solution *FlaresolverrData `json:"solution,omitempty"`
-}
-
-type FlaresolverrReq struct {
-	Client       *azuretls.Session
-	Req          *azuretls.Request
-	Flaresolverr string
-}
-
-// "solution" field in flaresolverr API response
-type FlaresolverrData struct {
-	Url       string                           `json:"url,omitempty"`
-	Headers   map[string]string                `json:"headers,omitempty"`
-	Status    int                              `json:"status,omitempty"`
-	UserAgent string                           `json:"userAgent,omitempty"`
-	Response  string                           `json:"response,omitempty"`
-	Cookies   []*FlaresolverrApiResponseCookie `json:"cookies,omitempty"`
-}
-
 var (
-	defaultClient      *azuretls.Session
-	localClient        *azuretls.Session                               // no proxy
-	defaultRateLimiter = rate.NewLimiter(rate.Every(time.Second*3), 3) // 3 requests per 3 seconds
-	strictRateLimiter  = rate.NewLimiter(rate.Every(time.Second*9), 3) // 3 requests per 9 seconds
-	flareSolverrReqCh  = make(chan *FlaresolverrReq)
-	flareSolverrDataCh = make(chan *FlaresolverrData)
+	defaultClient *azuretls.Session
+	localClient   *azuretls.Session // no proxy
+	defaultProxy  string
+	siteClients   = map[string]*azuretls.Session{} // "proxy|verifyTls" => session, for sites with own settings
+	siteClientsMu sync.Mutex
 )
 
-var strictRateLimiterDomains = []string{
-	"asmrconnecting.xyz",
-}
-
 // "Access denied", "Attention Required! | Cloudflare"
 var CF_ACCESS_DENIED_TITLES = []string{
 	"Access denied",
@@ -87,101 +42,248 @@ var CF_CHALLENGE_TITLES = []string{
 	"DDoS-Guard",
 }
 
+var (
+	ErrCloudflareChallenge = fmt.Errorf("request blocked by cloudflare challenge")
+)
+
 func IsLocalUrl(urlObj *url.URL) bool {
 	return constants.PrivateIpRegexp.MatchString(urlObj.Hostname()) || urlObj.Hostname() == "localhost"
 }
 
-func getRateLimiter(req *azuretls.Request) *rate.Limiter {
-	if req == nil {
+// Called before each request, including the requests of redirect hops.
+func preHook(ctx *azuretls.Context) error {
+	if ctx.Request == nil {
 		return nil
 	}
+	if ctx.Request.Response != nil { // the response of previous redirect hop
+		saveCookies(ctx.Request.Response)
+	}
+	applyCookies(ctx.Request)
+	if hl := getHostLimiter(ctx.Request.Url); hl != nil {
+		hl.wait()
+	}
+	return nil
+}
+
+// Set "Cookie" header of req using cookies in cookie jar. Cookies in jar take precedence over
+// the same name cookies that already exist in "Cookie" header (e.g. provided by caller or site config).
+// Session cookie jar of azuretls is not used.
+func applyCookies(req *azuretls.Request) {
+	req.NoCookie = true
 	urlObj, err := url.Parse(req.Url)
-	if err != nil || IsLocalUrl(urlObj) {
-		return nil
+	if err != nil || config.CookieJar == nil {
+		return
+	}
+	cookies := config.CookieJar.Cookies(urlObj)
+	if len(cookies) == 0 {
+		return
+	}
+	var pairs []string
+	names := map[string]struct{}{}
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+		names[cookie.Name] = struct{}{}
+	}
+	for _, pair := range strings.Split(req.OrderedHeaders.Get("Cookie"), ";") {
+		pair = strings.TrimSpace(pair)
+		name, _, _ := strings.Cut(pair, "=")
+		if _, ok := names[name]; pair != "" && !ok {
+			pairs = append(pairs, pair)
+		}
 	}
-	if slices.Contains(strictRateLimiterDomains, urlObj.Hostname()) {
-		return strictRateLimiter
+	req.OrderedHeaders.Set("Cookie", strings.Join(pairs, "; "))
+}
+
+// Min interval of saving cookie jar to file. Changes of cookies are batched.
+const COOKIES_SAVE_INTERVAL = time.Second * 5
+
+var (
+	cookiesSaveTimer   *time.Timer
+	cookiesSaveTimerMu sync.Mutex
+)
+
+// Save cookies set by res to cookie jar. The jar file is saved later, see FlushCookies.
+func saveCookies(res *azuretls.Response) {
+	if config.CookieJar == nil || harReplay != nil || len(res.Header["Set-Cookie"]) == 0 {
+		return
+	}
+	urlObj, err := url.Parse(res.Url)
+	if err != nil {
+		return
+	}
+	config.CookieJar.SetCookies(urlObj, azuretls.ReadSetCookies(res.Header))
+	cookiesSaveTimerMu.Lock()
+	defer cookiesSaveTimerMu.Unlock()
+	if cookiesSaveTimer == nil {
+		cookiesSaveTimer = time.AfterFunc(COOKIES_SAVE_INTERVAL, FlushCookies)
 	}
-	return defaultRateLimiter
+}
+
+// Save pending changes of cookie jar to file. It should be called before program exits.
+func FlushCookies() {
+	cookiesSaveTimerMu.Lock()
+	if cookiesSaveTimer != nil {
+		cookiesSaveTimer.Stop()
+		cookiesSaveTimer = nil
+	}
+	cookiesSaveTimerMu.Unlock()
+	if config.CookieJar == nil {
+		return
+	}
+	if err := config.CookieJar.Save(); err != nil {
+		log.Warnf("Failed to save cookies: %v", err)
+	}
+}
+
+// Create a new session. If verifyTls is false, TLS certificate verification is skipped.
+func newSession(proxy string, verifyTls bool) (*azuretls.Session, error) {
+	session := azuretls.NewSession()
+	session.InsecureSkipVerify = !verifyTls
+	if proxy != "" {
+		if err := session.SetProxy(proxy); err != nil {
+			return nil, fmt.Errorf("failed to set proxy to %q: %w", proxy, err)
+		}
+	}
+	session.PreHookWithContext = preHook
+	return session, nil
+}
+
+// Get the session that should be used to request urlObj on behalf of siteConfig (could be nil).
+func getClient(urlObj *url.URL, siteConfig *config.SiteConfig) (*azuretls.Session, error) {
+	if urlObj != nil && IsLocalUrl(urlObj) {
+		return localClient, nil
+	}
+	if siteConfig == nil || (siteConfig.Proxy == "" && !siteConfig.VerifyTls) {
+		return defaultClient, nil
+	}
+	proxy := defaultProxy
+	if siteConfig.Proxy != "" {
+		proxy = siteConfig.Proxy
+	}
+	if proxy == constants.NONE {
+		proxy = ""
+	}
+	siteClientsMu.Lock()
+	defer siteClientsMu.Unlock()
+	key := fmt.Sprintf("%s|%t", proxy, siteConfig.VerifyTls)
+	if siteClients[key] == nil {
+		session, err := newSession(proxy, siteConfig.VerifyTls)
+		if err != nil {
+			return nil, err
+		}
+		siteClients[key] = session
+	}
+	return siteClients[key], nil
+}
+
+// Return all created sessions.
+func allClients() []*azuretls.Session {
+	siteClientsMu.Lock()
+	defer siteClientsMu.Unlock()
+	clients := []*azuretls.Session{defaultClient, localClient}
+	for _, session := range siteClients {
+		clients = append(clients, session)
+	}
+	return clients
 }
 
 func Init() {
-	defaultClient = azuretls.NewSession()
-	localClient = azuretls.NewSession()
-	defaultClient.InsecureSkipVerify = true
-	localClient.InsecureSkipVerify = true
+	var err error
 	if proxy := util.FirstNonZeroArg(flags.Proxy, os.Getenv("HTTPS_PROXY"),
 		os.Getenv("https_proxy")); proxy != "" && proxy != constants.NONE {
-		if err := defaultClient.SetProxy(proxy); err != nil {
-			log.Fatalf("failed to set proxy to %q: %v", proxy, err)
-		}
+		defaultProxy = proxy
 		log.Warnf("Set proxy to %q (does not apply to local addresses)", proxy)
 	}
-	loadConfig()
-	defaultClient.PreHookWithContext = func(ctx *azuretls.Context) error {
-		if rateLimiter := getRateLimiter(ctx.Request); rateLimiter != nil {
-			rateLimiter.Wait(context.TODO())
-		}
-		return nil
+	if defaultClient, err = newSession(defaultProxy, false); err != nil {
+		log.Fatalf("%v", err)
+	}
+	localClient = util.Unwrap(newSession("", false))
+	if err = initHar(); err != nil {
+		log.Fatalf("Failed to init har: %v", err)
 	}
-	go func(input <-chan *FlaresolverrReq, output chan *FlaresolverrData) {
-		for {
-			req := <-input
-			payload := &FlaresolverrApiRequest{
-				Cmd:               "request.get",
-				Url:               req.Req.Url,
-				MaxTimeout:        300000,
-				ReturnOnlyCookies: true,
-			}
-			var resBody *FlaresolverrApiResponse
-			err := PostAndFetchJson(req.Flaresolverr, payload, &resBody, false)
-			if err != nil {
-				log.Tracef("flaresolverr api request error: %v", err)
-				output <- &FlaresolverrData{
-					Status: 500,
-				}
-			} else if resBody.Status != "ok" {
-				output <- &FlaresolverrData{
-					Status: 503,
-				}
-			} else {
-				output <- resBody.Solution
-			}
-		}
-	}(flareSolverrReqCh, flareSolverrDataCh)
 }
 
-func loadConfig() {
-	// session headers is broken !
-	// if config.Data.UserAgent != "" {
-	// 	defaultClient.OrderedHeaders.Set("User-Agent", config.Data.UserAgent)
-	// }
-	for _, cookie := range config.Data.Cookies {
-		urlStr := "https://" + strings.TrimPrefix(cookie.Domain, ".") + "/"
-		if urlObj, err := url.Parse(urlStr); err == nil {
-			defaultClient.CookieJar.SetCookies(urlObj, []*fhttp.Cookie{cookie})
+// Apply site settings (headers, credentials, cookie) to req. Existing headers of req are preserved.
+func applySiteConfig(req *azuretls.Request, siteConfig *config.SiteConfig) {
+	header := siteConfig.GetHeader()
+	for name := range header {
+		if req.OrderedHeaders.Get(name) == "" {
+			req.OrderedHeaders.Set(name, header.Get(name))
+		}
+	}
+	if authorization := siteConfig.GetAuthorization(); authorization != "" &&
+		req.OrderedHeaders.Get("Authorization") == "" {
+		req.OrderedHeaders.Set("Authorization", authorization)
+	}
+	if siteConfig.Cookie != "" {
+		if cookie := req.OrderedHeaders.Get("Cookie"); cookie != "" {
+			req.OrderedHeaders.Set("Cookie", strings.TrimSuffix(strings.TrimSpace(cookie), ";")+"; "+siteConfig.Cookie)
+		} else {
+			req.OrderedHeaders.Set("Cookie", siteConfig.Cookie)
 		}
 	}
 }
 
-func flareSolverr(client *azuretls.Session, req *azuretls.Request, flaresolverr string) *FlaresolverrData {
-	flareSolverrReqCh <- &FlaresolverrReq{Client: client, Req: req, Flaresolverr: flaresolverr}
-	return <-flareSolverrDataCh
+// Do a http request. Transient failures are retried, and responses are cached if cache is enabled,
+// see Options for details. options is optional, at most one options could be provided.
+func HttpRequest(req *azuretls.Request, useFlareSolverr bool, options ...*Options) (
+	res *azuretls.Response, err error) {
+	opts := getOptions(options)
+	do := func(req *azuretls.Request) (*azuretls.Response, error) {
+		return doWithRetry(req, opts, func(req *azuretls.Request) (*azuretls.Response, error) {
+			return httpRequest(req, useFlareSolverr, opts.Solver)
+		})
+	}
+	if ttl := getCacheTtl(req, opts); ttl > 0 {
+		return doWithCache(req, ttl, opts, do)
+	}
+	return do(req)
 }
 
-func HttpRequest(req *azuretls.Request, useFlareSolverr bool) (
+// Do a http request, single attempt. solver: the request is sent by a challenge solver.
+func httpRequest(req *azuretls.Request, useFlareSolverr bool, solver bool) (
 	res *azuretls.Response, err error) {
-	client := defaultClient
-	if urlObj, err := url.Parse(req.Url); err == nil && IsLocalUrl(urlObj) {
-		client = localClient
+	urlObj, err := url.Parse(req.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	siteConfig := config.GetSiteConfigByUrl(urlObj)
+	client, err := getClient(urlObj, siteConfig)
+	if err != nil {
+		return nil, err
 	}
 	req.TimeOut = time.Second * 30000
-	if config.Data.UserAgent != "" {
-		req.OrderedHeaders.Set("User-Agent", config.Data.UserAgent)
+	userAgent := config.Data.UserAgent
+	if siteConfig != nil {
+		applySiteConfig(req, siteConfig)
+		if siteConfig.UserAgent != "" {
+			userAgent = siteConfig.UserAgent
+		}
+	}
+	// cookies of solved challenge only work with the user agent that solved it
+	if !solver {
+		if record := getChallengeRecord(urlObj.Hostname()); record != nil && record.UserAgent != "" {
+			userAgent = record.UserAgent
+		}
+	}
+	if userAgent != "" {
+		req.OrderedHeaders.Set("User-Agent", userAgent)
+	}
+	hl := getHostLimiter(req.Url)
+	if hl != nil {
+		release := hl.acquire()
+		defer release()
 	}
 	util.LogAzureHttpRequest(req)
-	res, err = client.Do(req)
+	start := time.Now()
+	res, err = doRequest(client, req)
 	util.LogAzureHttpResponse(res, err)
+	if res != nil {
+		saveCookies(res)
+		if hl != nil {
+			hl.onResponse(res.StatusCode, res.Header)
+		}
+	}
 	if err != nil {
 		// workaround for a azuretls bug that request to a host always returns EOF after sending some requests.
 		// the error may be EOF, or the below:
@@ -201,57 +303,58 @@ func HttpRequest(req *azuretls.Request, useFlareSolverr bool) (
 				return res, fmt.Errorf("your ip is possibly blocked by cloudflare")
 			}
 		}
-		challenge := false
-		for _, title := range CF_CHALLENGE_TITLES {
-			if strings.Contains(string(res.Body), "<title>"+title+"</title") {
-				challenge = true
-				break
-			}
-		}
-		if !challenge {
+		if !isChallenge(res) {
 			return res, err
 		}
-		if !useFlareSolverr || config.Data.FlareSolverr == "" || config.Test1 {
-			return res, fmt.Errorf("request blocked by cloudflare challenge, setup flaresolverr to proceed")
+		if !useFlareSolverr || solver || config.Test1 {
+			return res, ErrNoChallengeSolver
 		}
-		log.Tracef("Detected cloudflare challenge, solving using %s", config.Data.FlareSolverr)
-		data := flareSolverr(client, req, config.Data.FlareSolverr)
-		if data.Status != 200 && data.Status != 0 { // If returnOnlyCookies is set, status is 0
-			return res, fmt.Errorf("failed to resolve cloueflare challenge, status=%d", data.Status)
+		record, err := solveChallenge(urlObj, siteConfig, req.OrderedHeaders.Get("User-Agent"), start)
+		if err != nil {
+			return res, err
 		}
-		log.Tracef("flaresolverr solved: %v", data)
-		cookies := util.Map(data.Cookies, func(c *FlaresolverrApiResponseCookie) *fhttp.Cookie {
-			return &fhttp.Cookie{
-				Name:   c.Name,
-				Value:  c.Value,
-				Path:   c.Path,
-				Domain: c.Domain,
-				MaxAge: 86400 * 365,
-			}
-		})
-		config.UpdateCookies(data.UserAgent, cookies)
-		loadConfig()
-		return client.Do(&azuretls.Request{
+		if record.UserAgent != "" {
+			req.OrderedHeaders.Set("User-Agent", record.UserAgent)
+		}
+		res, err = doRequest(client, &azuretls.Request{
 			Url:            req.Url,
 			Method:         req.Method,
 			Body:           req.Body,
 			OrderedHeaders: req.OrderedHeaders,
 			TimeOut:        req.TimeOut,
+			IgnoreBody:     req.IgnoreBody,
 		})
+		if res != nil {
+			saveCookies(res)
+			if res.StatusCode == 403 && isChallenge(res) {
+				return res, fmt.Errorf("%w: solution by %s does not work", ErrCloudflareChallenge, record.Solver)
+			}
+		}
+		return res, err
 	}
 	return res, err
 }
 
+// Whether res is a cloudflare (or alike) challenge page.
+func isChallenge(res *azuretls.Response) bool {
+	for _, title := range CF_CHALLENGE_TITLES {
+		if strings.Contains(string(res.Body), "<title>"+title+"</title") {
+			return true
+		}
+	}
+	return false
+}
+
 // If addext is true, the ext of fileUrl will be appended to filename.
 // The ext of fileUrl is guessed from response content-type and / or fileUrl path.
 // Return created filename and ext of fileUrl.
-func SaveUrl(fileUrl string, filename string, addext bool, useFlareSolverr bool) (
+func SaveUrl(fileUrl string, filename string, addext bool, useFlareSolverr bool, options ...*Options) (
 	createdfile string, ext string, err error) {
 	res, err := HttpRequest(&azuretls.Request{
 		Method:     http.MethodGet,
 		Url:        fileUrl,
 		IgnoreBody: true,
-	}, useFlareSolverr)
+	}, useFlareSolverr, options...)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to fetch %q: %w", fileUrl, err)
 	}
@@ -277,7 +380,7 @@ func SaveUrl(fileUrl string, filename string, addext bool, useFlareSolverr bool)
 	return filename, ext, err
 }
 
-func FetchUrl(url string, header http.Header, useFlareSolverr bool) (*azuretls.Response, error) {
+func FetchUrl(url string, header http.Header, useFlareSolverr bool, options ...*Options) (*azuretls.Response, error) {
 	req := &azuretls.Request{
 		Method: http.MethodGet,
 		Url:    url,
@@ -285,7 +388,7 @@ func FetchUrl(url string, header http.Header, useFlareSolverr bool) (*azuretls.R
 	for name := range header {
 		req.OrderedHeaders.Set(name, header.Get(name))
 	}
-	res, err := HttpRequest(req, useFlareSolverr)
+	res, err := HttpRequest(req, useFlareSolverr, options...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch url: %w", err)
 	}
@@ -295,8 +398,8 @@ func FetchUrl(url string, header http.Header, useFlareSolverr bool) (*azuretls.R
 	return res, nil
 }
 
-func FetchJson(url string, v any, useFlareSolverr bool) error {
-	res, err := FetchUrl(url, nil, useFlareSolverr)
+func FetchJson(url string, v any, useFlareSolverr bool, options ...*Options) error {
+	res, err := FetchUrl(url, nil, useFlareSolverr, options...)
 	if err != nil {
 		return err
 	}
@@ -306,7 +409,7 @@ func FetchJson(url string, v any, useFlareSolverr bool) error {
 	return err
 }
 
-func PostAndFetchJson(url string, reqBody any, resBody any, useFlareSolverr bool) (err error) {
+func PostAndFetchJson(url string, reqBody any, resBody any, useFlareSolverr bool, options ...*Options) (err error) {
 	reqData, err := json.Marshal(reqBody)
 	if err != nil {
 		return fmt.Errorf("failed to marshal json: %w", err)
@@ -318,7 +421,7 @@ func PostAndFetchJson(url string, reqBody any, resBody any, useFlareSolverr bool
 			{"Content-Type", "application/json"},
 		},
 		Url: url,
-	}, useFlareSolverr)
+	}, useFlareSolverr, options...)
 	if err != nil {
 		return err
 	}
@@ -335,6 +438,7 @@ func CloseHost(urlStr string) {
 		return
 	}
 	log.Debugf("remove %s from connection pool", urlStr)
-	defaultClient.Connections.Remove(urlObj)
-	localClient.Connections.Remove(urlObj)
+	for _, session := range allClients() {
+		session.Connections.Remove(urlObj)
+	}
 }
@@ -0,0 +1,228 @@
+package httpclient
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	"github.com/sagan/erodownloader/config"
+)
+
+const DEFAULT_RATE_INTERVAL = time.Second * 3
+const DEFAULT_RATE_BURST = 3
+
+// Max wait time of a "Retry-After" response header that will be honored.
+const MAX_RETRY_AFTER = time.Minute * 10
+
+// Successful responses count required to restore a slowed down limiter one step back.
+const RATE_RECOVER_RESPONSES = 20
+
+// Default rate limits. Rate limits in config file take precedence over these.
+// All hosts matched by the same domain rule share one rate limit bucket, e.g. "*" is a global bucket of
+// all hosts that have no specific rate limit.
+var DefaultRateLimits = []*config.RateLimitConfig{
+	{Domain: "*", Interval: "3s", Burst: 3},                  // 1 request per 3 seconds, burst 3
+	{Domain: "asmrconnecting.xyz", Interval: "9s", Burst: 3}, // 1 request per 9 seconds, burst 3
+}
+
+// Rate limit bucket, shared by all hosts of the same site or matched by the same domain rule.
+type rateBucket struct {
+	name        string
+	limiter     *rate.Limiter
+	baseLimit   rate.Limit
+	concurrency chan struct{} // nil == unlimited
+	mu          sync.Mutex
+	requests    int64
+	waited      time.Duration
+}
+
+// Rate limiter of a host. The rate limit bucket could be shared by multiple hosts,
+// but the throttle state (set by 429 responses of server) is per host.
+type hostLimiter struct {
+	host       string
+	bucket     *rateBucket
+	mu         sync.Mutex
+	throttle   *rate.Limiter // additional slowed down limiter of host. nil == not throttled
+	pauseUntil time.Time     // do not send requests until this time (set by "Retry-After")
+	successes  int           // successful responses since last slow down
+	throttled  int64         // 429 responses count
+}
+
+var (
+	hostLimiters   = map[string]*hostLimiter{}
+	rateBuckets    = map[string]*rateBucket{}
+	hostLimitersMu sync.Mutex
+)
+
+// Return the effective rate limit config of host. Site config takes precedence over domain rate limits;
+// the most specific domain matched is used. Unset fields are filled with defaults.
+// The Domain of returned config is the key of rate limit bucket: "site:<name>" for site config,
+// "*.<domain>" for matched domain rule, or "*" for the default one.
+func getRateLimitConfig(host string) *config.RateLimitConfig {
+	rateLimit := &config.RateLimitConfig{Domain: host}
+	if siteConfig := config.GetSiteConfigByUrl(&url.URL{Host: host}); siteConfig != nil &&
+		(siteConfig.RateInterval != "" || siteConfig.RateBurst > 0 || siteConfig.Concurrency > 0) {
+		rateLimit.Domain = "site:" + siteConfig.Name
+		rateLimit.Interval = siteConfig.RateInterval
+		rateLimit.Burst = siteConfig.RateBurst
+		rateLimit.Concurrency = siteConfig.Concurrency
+	} else {
+		var rateLimits []*config.RateLimitConfig
+		if config.Data != nil {
+			rateLimits = append(rateLimits, config.Data.RateLimits...)
+		}
+		rateLimits = append(rateLimits, DefaultRateLimits...)
+		var matched *config.RateLimitConfig
+		for _, rl := range rateLimits {
+			if rl.Domain == "*" && matched == nil {
+				matched = rl
+			} else if (host == rl.Domain || strings.HasSuffix(host, "."+rl.Domain)) &&
+				(matched == nil || matched.Domain == "*" || len(rl.Domain) > len(matched.Domain)) {
+				matched = rl
+			}
+		}
+		if matched != nil {
+			rateLimit.Domain = "*"
+			if matched.Domain != "*" {
+				rateLimit.Domain += "." + matched.Domain
+			}
+			rateLimit.Interval = matched.Interval
+			rateLimit.Burst = matched.Burst
+			rateLimit.Concurrency = matched.Concurrency
+		}
+	}
+	if rateLimit.Burst <= 0 {
+		rateLimit.Burst = DEFAULT_RATE_BURST
+	}
+	return rateLimit
+}
+
+func getHostLimiter(urlStr string) *hostLimiter {
+	urlObj, err := url.Parse(urlStr)
+	if err != nil || IsLocalUrl(urlObj) {
+		return nil
+	}
+	host := urlObj.Hostname()
+	hostLimitersMu.Lock()
+	defer hostLimitersMu.Unlock()
+	if hostLimiters[host] != nil {
+		return hostLimiters[host]
+	}
+	rateLimit := getRateLimitConfig(host)
+	if rateBuckets[rateLimit.Domain] == nil {
+		interval := DEFAULT_RATE_INTERVAL
+		if rateLimit.Interval != "" {
+			if interval, err = time.ParseDuration(rateLimit.Interval); err != nil {
+				log.Warnf("Invalid rate limit interval %q of %s, use default", rateLimit.Interval, rateLimit.Domain)
+				interval = DEFAULT_RATE_INTERVAL
+			}
+		}
+		limit := rate.Every(interval)
+		bucket := &rateBucket{
+			name:      rateLimit.Domain,
+			limiter:   rate.NewLimiter(limit, rateLimit.Burst),
+			baseLimit: limit,
+		}
+		if rateLimit.Concurrency > 0 {
+			bucket.concurrency = make(chan struct{}, rateLimit.Concurrency)
+		}
+		log.Debugf("rate limit of %s: interval=%v, burst=%d, concurrency=%d",
+			rateLimit.Domain, interval, rateLimit.Burst, rateLimit.Concurrency)
+		rateBuckets[rateLimit.Domain] = bucket
+	}
+	hostLimiters[host] = &hostLimiter{host: host, bucket: rateBuckets[rateLimit.Domain]}
+	return hostLimiters[host]
+}
+
+// Wait until a request to host is allowed.
+func (hl *hostLimiter) wait() {
+	start := time.Now()
+	hl.mu.Lock()
+	pauseUntil, throttle := hl.pauseUntil, hl.throttle
+	hl.mu.Unlock()
+	if d := time.Until(pauseUntil); d > 0 {
+		log.Warnf("Pause requests to %s for %v (throttled by server)", hl.host, d.Round(time.Second))
+		time.Sleep(d)
+	}
+	if throttle != nil {
+		throttle.Wait(context.TODO())
+	}
+	bucket := hl.bucket
+	bucket.limiter.Wait(context.TODO())
+	waited := time.Since(start)
+	bucket.mu.Lock()
+	bucket.requests++
+	bucket.waited += waited
+	requests, total := bucket.requests, bucket.waited
+	bucket.mu.Unlock()
+	log.Debugf("rate limit %s (%s): waited=%v, requests=%d, total_waited=%v, limit=%.3f/s, burst=%d, inflight=%d",
+		bucket.name, hl.host, waited.Round(time.Millisecond), requests, total.Round(time.Millisecond),
+		float64(bucket.limiter.Limit()), bucket.limiter.Burst(), len(bucket.concurrency))
+}
+
+// Acquire a concurrency slot. The returned release func must be called after the request finished.
+func (hl *hostLimiter) acquire() (release func()) {
+	if hl.bucket.concurrency == nil {
+		return func() {}
+	}
+	hl.bucket.concurrency <- struct{}{}
+	return sync.OnceFunc(func() { <-hl.bucket.concurrency })
+}
+
+// Update limiter according to response status. On 429 (or 503 with "Retry-After" header),
+// requests to host are slowed down (halved) and paused for the "Retry-After" duration;
+// It's then gradually restored after enough successful responses. Other hosts sharing the bucket are not affected.
+func (hl *hostLimiter) onResponse(statusCode int, header fhttp.Header) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	retryAfter := parseRetryAfter(header.Get("Retry-After"))
+	if statusCode == 429 || (statusCode == 503 && retryAfter > 0) {
+		hl.throttled++
+		hl.successes = 0
+		if hl.throttle == nil {
+			hl.throttle = rate.NewLimiter(hl.bucket.baseLimit/2, 1)
+		} else {
+			hl.throttle.SetLimit(hl.throttle.Limit() / 2)
+		}
+		if retryAfter > 0 {
+			hl.pauseUntil = time.Now().Add(min(retryAfter, MAX_RETRY_AFTER))
+		}
+		log.Warnf("Requests to %s throttled (status=%d, retry_after=%v, throttled=%d), slow down limit to %.3f/s",
+			hl.host, statusCode, retryAfter, hl.throttled, float64(hl.throttle.Limit()))
+		return
+	}
+	if statusCode >= 200 && statusCode < 400 && hl.throttle != nil {
+		hl.successes++
+		if hl.successes >= RATE_RECOVER_RESPONSES {
+			hl.successes = 0
+			if limit := hl.throttle.Limit() * 2; limit >= hl.bucket.baseLimit {
+				hl.throttle = nil
+				log.Debugf("rate limit %s restored", hl.host)
+			} else {
+				hl.throttle.SetLimit(limit)
+				log.Debugf("rate limit %s restored to %.3f/s", hl.host, float64(limit))
+			}
+		}
+	}
+}
+
+// Parse "Retry-After" header, which could be seconds or a http date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := fhttp.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
@@ -0,0 +1,157 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	log "github.com/sirupsen/logrus"
+)
+
+const DEFAULT_MAX_ATTEMPTS = 4
+const DEFAULT_MIN_BACKOFF = time.Second * 2
+const DEFAULT_MAX_BACKOFF = time.Minute
+
+// Per call options of http requests. Zero value fields fallback to defaults.
+type Options struct {
+	// Max attempts (including the first one) for transient failures. 1 == no retry.
+	MaxAttempts int
+	// Backoff before the first retry, it's doubled for each successive retry (with jitter).
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Also retry (and cache) non-idempotent requests (e.g. POST). Set it if the endpoint is known to be idempotent.
+	RetryNonIdempotent bool
+	// Ttl of cached response (if cache is enabled). 0 == use site / default config; < 0 == do not cache. See cache.go.
+	CacheTtl time.Duration
+	// Whether the body of a successful response can be cached, e.g. not an api error. nil == always
+	CacheValidate func(body []byte) bool
+	// Request of a challenge solver (e.g. FlareSolverr api). Solved challenge records are not applied to it.
+	Solver bool
+}
+
+// Status codes of transient server side failures.
+// 500 is excluded as some sites use it for permanent errors (e.g. hvdb for not found works).
+var RetryableStatusCodes = []int{408, 429, 502, 503, 504, 520, 521, 522, 523, 524, 525, 526, 527, 530}
+
+var idempotentMethods = []string{"", http.MethodGet, http.MethodHead, http.MethodOptions,
+	http.MethodPut, http.MethodDelete, http.MethodTrace}
+
+func getOptions(options []*Options) *Options {
+	o := &Options{}
+	if len(options) > 0 && options[0] != nil {
+		*o = *options[0]
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = DEFAULT_MIN_BACKOFF
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	return o
+}
+
+// Whether a failed request could succeed if retried.
+// err: timeouts, connection resets and cloudflare challenge (if a solver is available) are retryable.
+// res: the retryable status codes are listed in RetryableStatusCodes.
+func IsRetryable(res *azuretls.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, ErrNoChallengeSolver) || errors.Is(err, ErrSolveAborted) {
+			return false
+		}
+		if errors.Is(err, ErrCloudflareChallenge) ||
+			errors.Is(err, context.DeadlineExceeded) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, syscall.ECONNABORTED) ||
+			(errors.As(err, &netErr) && netErr.Timeout()) {
+			return true
+		}
+		msg := strings.ToLower(err.Error())
+		for _, str := range []string{"timeout", "connection reset", "use of closed network connection",
+			"connected party did not properly respond", "tls handshake", "unexpected eof", "broken pipe"} {
+			if strings.Contains(msg, str) {
+				return true
+			}
+		}
+		return false
+	}
+	return res != nil && slices.Contains(RetryableStatusCodes, res.StatusCode)
+}
+
+// Return backoff before the attempt-th (1-based) retry: exponential with "equal jitter".
+func getBackoff(options *Options, attempt int) time.Duration {
+	backoff := options.MinBackoff << (attempt - 1)
+	if backoff <= 0 || backoff > options.MaxBackoff {
+		backoff = options.MaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Clone the exported fields of req, so it can be sent again.
+func cloneRequest(req *azuretls.Request) *azuretls.Request {
+	return &azuretls.Request{
+		Method:             req.Method,
+		Url:                req.Url,
+		Body:               req.Body,
+		OrderedHeaders:     req.OrderedHeaders.Clone(),
+		DisableRedirects:   req.DisableRedirects,
+		MaxRedirects:       req.MaxRedirects,
+		NoCookie:           req.NoCookie,
+		TimeOut:            req.TimeOut,
+		InsecureSkipVerify: req.InsecureSkipVerify,
+		IgnoreBody:         req.IgnoreBody,
+		Proto:              req.Proto,
+		ForceHTTP1:         req.ForceHTTP1,
+	}
+}
+
+// Call do with req, retry transient failures.
+// Only idempotent requests are retried, unless options.RetryNonIdempotent is set.
+// On final failure, the result of last attempt is returned.
+func doWithRetry(req *azuretls.Request, options *Options,
+	do func(req *azuretls.Request) (*azuretls.Response, error)) (res *azuretls.Response, err error) {
+	maxAttempts := options.MaxAttempts
+	if !options.RetryNonIdempotent && !slices.Contains(idempotentMethods, strings.ToUpper(req.Method)) {
+		maxAttempts = 1
+	}
+	if maxAttempts == 1 {
+		return do(req)
+	}
+	for attempt := 1; ; attempt++ {
+		res, err = do(cloneRequest(req))
+		if attempt >= maxAttempts || !IsRetryable(res, err) {
+			if attempt > 1 {
+				log.Debugf("%s %s finished after %d attempts (err=%v)", req.Method, req.Url, attempt, err)
+			}
+			return res, err
+		}
+		backoff := getBackoff(options, attempt)
+		if harReplay != nil {
+			backoff = 0
+		}
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+			if res.RawBody != nil {
+				res.CloseBody()
+			}
+		}
+		log.Warnf("%s %s failed (attempt %d/%d, status=%d, err=%v), retry in %v",
+			req.Method, req.Url, attempt, maxAttempts, status, err, backoff.Round(time.Millisecond))
+		time.Sleep(backoff)
+	}
+}
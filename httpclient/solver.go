@@ -0,0 +1,336 @@
+package httpclient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/natefinch/atomic"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/util/cookiejar"
+)
+
+// Solved challenges file in config dir
+const CHALLENGES_FILE = "challenges.json"
+
+// The cookie that proves a cloudflare challenge has been passed
+const CF_CLEARANCE_COOKIE = "cf_clearance"
+
+// Solver names tried in order if not configured.
+var DEFAULT_CHALLENGE_SOLVERS = []string{"flaresolverr", "browser"}
+
+// A solver of cloudflare (or alike) challenge. Solvers are registered by name,
+// and are tried in the order of ChallengeSolvers config.
+type ChallengeSolver interface {
+	// Solve the challenge of ctx.Url. Return ErrSolverUnavailable if the solver is not configured or usable.
+	Solve(ctx *ChallengeContext) (*ChallengeSolution, error)
+}
+
+type ChallengeContext struct {
+	Url        *url.URL
+	SiteConfig *config.SiteConfig // could be nil
+	UserAgent  string             // user agent of the challenged request
+}
+
+type ChallengeSolution struct {
+	UserAgent string // the cookies are only valid with this user agent. Empty == current user agent
+	Cookies   []*fhttp.Cookie
+}
+
+// A solved challenge of a domain, persisted in challenges file. The solution cookies are stored in cookie jar.
+// The solution is reused until it expires or a challenge is encountered again.
+type ChallengeRecord struct {
+	Domain    string `json:"domain"` // also applies to it's sub domains
+	Solver    string `json:"solver"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Time      int64  `json:"time"`              // unix timestamp (nanoseconds) when solved
+	Expires   int64  `json:"expires,omitempty"` // unix timestamp (seconds). 0 == until invalid
+}
+
+var (
+	ErrSolverUnavailable = fmt.Errorf("solver is not available")
+	ErrSolveAborted      = fmt.Errorf("aborted by user")
+	ErrNoChallengeSolver = fmt.Errorf("%w, setup a challenge solver to proceed", ErrCloudflareChallenge)
+)
+
+var (
+	solvers          = map[string]ChallengeSolver{}
+	solveMu          sync.Mutex                  // serialize solving
+	challengeMu      sync.Mutex                  // protect challengeRecords. Never hold it while solving
+	challengeRecords map[string]*ChallengeRecord // domain => record. nil == not loaded yet
+)
+
+func RegisterSolver(name string, solver ChallengeSolver) {
+	solvers[name] = solver
+}
+
+func (r *ChallengeRecord) Expired(now time.Time) bool {
+	return r.Expires != 0 && r.Expires <= now.Unix()
+}
+
+func loadChallengeRecords() {
+	if challengeRecords != nil {
+		return
+	}
+	challengeRecords = map[string]*ChallengeRecord{}
+	contents, err := os.ReadFile(filepath.Join(config.ConfigDir, CHALLENGES_FILE))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to read challenges file: %v", err)
+		}
+		return
+	}
+	if err = json.Unmarshal(contents, &challengeRecords); err != nil {
+		log.Warnf("Malformed challenges file: %v", err)
+		challengeRecords = map[string]*ChallengeRecord{}
+	}
+}
+
+// Persist challenge records, discarding expired ones. Nothing is saved in replay mode.
+func saveChallengeRecords() {
+	if harReplay != nil {
+		return
+	}
+	now := time.Now()
+	for domain, record := range challengeRecords {
+		if record.Expired(now) {
+			delete(challengeRecords, domain)
+		}
+	}
+	contents, err := json.MarshalIndent(challengeRecords, "", "  ")
+	if err == nil {
+		err = atomic.WriteFile(filepath.Join(config.ConfigDir, CHALLENGES_FILE), bytes.NewReader(contents))
+	}
+	if err != nil {
+		log.Warnf("Failed to save challenges file: %v", err)
+	}
+}
+
+// Find the unexpired record of host or it's parent domains. challengeMu must be hold.
+func findChallengeRecord(host string) *ChallengeRecord {
+	loadChallengeRecords()
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	now := time.Now()
+	for domain := host; domain != ""; {
+		if record := challengeRecords[domain]; record != nil && !record.Expired(now) {
+			return record
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return nil
+}
+
+// Return the solved challenge record of host. Return nil if none.
+func getChallengeRecord(host string) *ChallengeRecord {
+	challengeMu.Lock()
+	defer challengeMu.Unlock()
+	return findChallengeRecord(host)
+}
+
+// If the record of host was solved after start, return it. Otherwise drop it (if any) as it's no longer valid.
+func dropInvalidChallengeRecord(urlObj *url.URL, host string, start time.Time) *ChallengeRecord {
+	challengeMu.Lock()
+	defer challengeMu.Unlock()
+	record := findChallengeRecord(host)
+	if record == nil {
+		return nil
+	}
+	if record.Time > start.UnixNano() {
+		return record
+	}
+	log.Infof("Challenge solution of %s (by %s) is no longer valid", record.Domain, record.Solver)
+	delete(challengeRecords, record.Domain)
+	if config.CookieJar != nil {
+		config.CookieJar.Delete(urlObj, CF_CLEARANCE_COOKIE)
+	}
+	saveChallengeRecords()
+	return nil
+}
+
+func getSolverNames(siteConfig *config.SiteConfig) []string {
+	names := config.Data.ChallengeSolvers
+	if siteConfig != nil && len(siteConfig.ChallengeSolvers) > 0 {
+		names = siteConfig.ChallengeSolvers
+	}
+	if len(names) == 0 {
+		names = DEFAULT_CHALLENGE_SOLVERS
+	}
+	if slices.Contains(names, constants.NONE) {
+		return nil
+	}
+	return names
+}
+
+// Solve the challenge of urlObj, which is encountered by a request started at start.
+// If the challenge has been solved by another request after start, that solution is returned directly;
+// otherwise the existing solution of domain (if any) is considered invalid and dropped.
+// Solution cookies are saved to cookie jar.
+// Solving is serialized by solveMu; challengeMu is not held while solving,
+// as solvers may send http requests themselves (e.g. to FlareSolverr api).
+func solveChallenge(urlObj *url.URL, siteConfig *config.SiteConfig, userAgent string, start time.Time) (
+	*ChallengeRecord, error) {
+	solveMu.Lock()
+	defer solveMu.Unlock()
+	host := strings.TrimSuffix(strings.ToLower(urlObj.Hostname()), ".")
+	if record := dropInvalidChallengeRecord(urlObj, host, start); record != nil {
+		return record, nil
+	}
+	names := getSolverNames(siteConfig)
+	ctx := &ChallengeContext{Url: urlObj, SiteConfig: siteConfig, UserAgent: userAgent}
+	log.Infof("Detected cloudflare challenge of %s, solving it", host)
+	var errs []error
+	for _, name := range names {
+		solver := solvers[name]
+		if solver == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown solver", name))
+			continue
+		}
+		solution, err := solver.Solve(ctx)
+		if err != nil {
+			if !errors.Is(err, ErrSolverUnavailable) {
+				log.Warnf("Challenge solver %s failed: %v", name, err)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		record := &ChallengeRecord{
+			Domain:    host,
+			Solver:    name,
+			UserAgent: solution.UserAgent,
+			Time:      time.Now().UnixNano(),
+		}
+		for _, cookie := range solution.Cookies {
+			if cookie.Name != CF_CLEARANCE_COOKIE {
+				continue
+			}
+			if domain := strings.TrimPrefix(strings.ToLower(cookie.Domain), "."); domain != "" &&
+				(host == domain || strings.HasSuffix(host, "."+domain)) {
+				record.Domain = domain
+			}
+			if cookie.MaxAge > 0 {
+				record.Expires = time.Now().Unix() + int64(cookie.MaxAge)
+			} else if !cookie.Expires.IsZero() {
+				record.Expires = cookie.Expires.Unix()
+			}
+		}
+		if config.CookieJar != nil {
+			if harReplay != nil {
+				config.CookieJar.SetCookies(urlObj, solution.Cookies)
+			} else if err := config.UpdateCookies(urlObj, solution.Cookies); err != nil {
+				log.Warnf("Failed to save challenge solution cookies: %v", err)
+			}
+		}
+		challengeMu.Lock()
+		loadChallengeRecords()
+		challengeRecords[record.Domain] = record
+		saveChallengeRecords()
+		challengeMu.Unlock()
+		log.Infof("Solved challenge of %s using %s", record.Domain, name)
+		return record, nil
+	}
+	if !slices.ContainsFunc(errs, func(err error) bool { return !errors.Is(err, ErrSolverUnavailable) }) {
+		return nil, ErrNoChallengeSolver
+	}
+	return nil, fmt.Errorf("%w: failed to solve it: %w", ErrCloudflareChallenge, errors.Join(errs...))
+}
+
+// Use cookies of a browser session that has passed the challenge, exported to a Netscape cookies.txt file.
+type browserSolver struct{}
+
+func (browserSolver) Solve(ctx *ChallengeContext) (*ChallengeSolution, error) {
+	if config.Data.BrowserCookiesFile == "" {
+		return nil, ErrSolverUnavailable
+	}
+	file, err := os.Open(config.Data.BrowserCookiesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	browserCookies, err := cookiejar.ParseNetscape(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid browser cookies file: %w", err)
+	}
+	var cookies []*fhttp.Cookie
+	found := false
+	now := time.Now()
+	for _, cookie := range browserCookies {
+		cookie.Domain = strings.ToLower(cookie.Domain)
+		if cookie.Expired(now) || !cookie.Match(ctx.Url) {
+			continue
+		}
+		if cookie.Name == CF_CLEARANCE_COOKIE {
+			found = true
+		}
+		cookies = append(cookies, cookie.HttpCookie())
+	}
+	if !found {
+		return nil, fmt.Errorf("no unexpired %s cookie of %s in browser cookies file, re-export it from browser",
+			CF_CLEARANCE_COOKIE, ctx.Url.Hostname())
+	}
+	userAgent := config.Data.BrowserUserAgent
+	if userAgent == "" {
+		log.Warnf("BrowserUserAgent is not set. The %s cookie only works with the user agent of browser",
+			CF_CLEARANCE_COOKIE)
+	}
+	return &ChallengeSolution{UserAgent: userAgent, Cookies: cookies}, nil
+}
+
+// Prompt user to pass the challenge in browser and paste the cf_clearance cookie. Requires stdin to be a tty.
+type manualSolver struct{}
+
+func (manualSolver) Solve(ctx *ChallengeContext) (*ChallengeSolution, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, ErrSolverUnavailable
+	}
+	defaultUserAgent := config.Data.BrowserUserAgent
+	if defaultUserAgent == "" {
+		defaultUserAgent = ctx.UserAgent
+	}
+	reader := bufio.NewReader(os.Stdin)
+	prompt := func(prompt string) string {
+		fmt.Fprint(os.Stderr, prompt)
+		input, _ := reader.ReadString('\n')
+		return strings.TrimSpace(input)
+	}
+	fmt.Fprintf(os.Stderr, "Cloudflare challenge of %s needs to be solved manually.\n", ctx.Url)
+	fmt.Fprintf(os.Stderr, "Open the url in browser and pass the challenge, "+
+		"then copy the value of %s cookie (e.g. from browser devtools).\n", CF_CLEARANCE_COOKIE)
+	value := prompt(CF_CLEARANCE_COOKIE + " (leave empty to abort): ")
+	if value == "" {
+		return nil, ErrSolveAborted
+	}
+	userAgent := prompt(fmt.Sprintf("User agent of browser (leave empty to use %q): ", defaultUserAgent))
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	return &ChallengeSolution{
+		UserAgent: userAgent,
+		Cookies: []*fhttp.Cookie{{
+			Name:     CF_CLEARANCE_COOKIE,
+			Value:    value,
+			Domain:   ctx.Url.Hostname(),
+			Path:     "/",
+			Secure:   ctx.Url.Scheme == "https",
+			HttpOnly: true,
+		}},
+	}, nil
+}
+
+func init() {
+	RegisterSolver("browser", browserSolver{})
+	RegisterSolver("manual", manualSolver{})
+}
@@ -7,7 +7,7 @@ import (
 	"time"
 
 	"github.com/glebarez/sqlite"
-	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/pathtemplate"
 	"github.com/sagan/erodownloader/util/stringutil"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -57,18 +57,42 @@ type Download struct {
 	Client     string    `json:"client"`
 }
 
+// A remote dir that is exposed as a resource by the "directory-as-resource" provider of a site.
+// It's a cache of remote dir info.
+type DirResource struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Site      string    `gorm:"index" json:"site"`
+	Path      string    `json:"path"` // "/ASMR/RJ123456"
+	Number    string    `json:"number"`
+	Title     string    `json:"title"`
+	Author    string    `json:"author"`
+	Size      int64     `json:"size"`     // sum size of all files inside the dir
+	Modified  int64     `json:"modified"` // modified unix timestamp (seconds) of dir in remote site
+}
+
 // Return suitable folder name
 func (r *ResourceDownload) GetFilename() (filename string) {
-	author := util.CleanBasenameComponent(r.Author)
-	title := util.CleanBasenameComponent(r.Title)
-	filename += fmt.Sprintf("[%s]", r.Number)
-	if author != "" {
-		filename += fmt.Sprintf("[%s]", author)
+	return pathtemplate.Default.Path(r.TemplateFields(), "/")
+}
+
+// Return values of folder name template fields.
+func (r *ResourceDownload) TemplateFields() map[string]string {
+	tags := r.Tags.GetMetaArray("genre")
+	for _, tag := range r.Tags {
+		if !strings.Contains(tag, ":") {
+			tags = append(tags, tag)
+		}
 	}
-	if title != "" {
-		filename += title
+	return map[string]string{
+		"number":   r.Number,
+		"title":    r.Title,
+		"author":   r.Author,
+		"narrator": strings.Join(r.Tags.GetMetaArray("narrator"), ", "),
+		"tags":     strings.Join(tags, ", "),
+		"site":     r.Site,
 	}
-	return util.CleanBasename(filename)
 }
 
 func (d *Download) GetFilename() string {
@@ -79,6 +103,10 @@ func (d *Download) GetPaused() bool {
 	return d.Status == "paused"
 }
 
+func (d *Download) GetSite() string {
+	return d.Site
+}
+
 func (d *Download) GetSavePath() string {
 	return d.SavePath
 }
@@ -141,6 +169,6 @@ func Init(dbfile string, verboseLevel int) (db *gorm.DB, err error) {
 	if err != nil {
 		return
 	}
-	err = db.AutoMigrate(&Download{}, &ResourceDownload{})
+	err = db.AutoMigrate(&Download{}, &ResourceDownload{}, &DirResource{})
 	return
 }
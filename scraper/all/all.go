@@ -3,6 +3,7 @@ package all
 import (
 	_ "github.com/sagan/erodownloader/scraper"
 	_ "github.com/sagan/erodownloader/scraper/asmrone"
+	_ "github.com/sagan/erodownloader/scraper/declarative"
 	_ "github.com/sagan/erodownloader/scraper/dlsite"
 	_ "github.com/sagan/erodownloader/scraper/dmm"
 	_ "github.com/sagan/erodownloader/scraper/hentaicovid"
@@ -54,6 +54,7 @@ func (awi *AsmroneWorkInfo) GetTags() (tags []string) {
 
 func init() {
 	jsonScraper := &jsonscraper.JsonScraper[AsmroneWorkInfo]{
+		Name:         ASMRONE,
 		NumberRegexp: numberRegexp,
 		GetRename:    scraper.GetRename,
 		Source:       dlsite.DLSITE,
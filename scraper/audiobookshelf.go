@@ -0,0 +1,167 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/natefinch/atomic"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/stringutil"
+)
+
+// Audiobookshelf book metadata file.
+// See https://www.audiobookshelf.org/docs#book-directory-structure .
+const ABS_METADATA = "metadata.json"
+
+const FORMAT_AUDIOBOOKSHELF = "audiobookshelf"
+
+type AbsMetadata struct {
+	Title         string        `json:"title"`
+	Authors       []string      `json:"authors"`
+	Narrators     []string      `json:"narrators"`
+	Series        []string      `json:"series"`
+	Genres        []string      `json:"genres"`
+	Tags          []string      `json:"tags"`
+	PublishedYear string        `json:"publishedYear,omitempty"`
+	PublishedDate string        `json:"publishedDate,omitempty"`
+	Description   string        `json:"description,omitempty"`
+	Explicit      bool          `json:"explicit"`
+	Chapters      []*AbsChapter `json:"chapters"`
+}
+
+type AbsChapter struct {
+	Id    int     `json:"id"`
+	Start float64 `json:"start"` // seconds
+	End   float64 `json:"end"`
+	Title string  `json:"title"`
+}
+
+// Write Audiobookshelf metadata.json. Each audio file (sorted by path in natural order) becomes a chapter.
+// Durations of audio files are probed using ffprobe; if it's not found in PATH, chapters are not written.
+func WriteAudiobookshelfMetadata(dirname string, metadata *Metadata, force bool) error {
+	metafile := filepath.Join(dirname, ABS_METADATA)
+	if !force && util.FileExists(metafile) {
+		return ErrExists
+	}
+	absMetadata := &AbsMetadata{
+		Title:         metadata.Title,
+		Authors:       []string{},
+		Narrators:     metadata.Narrator,
+		Series:        []string{},
+		Genres:        []string{},
+		Tags:          metadata.Tags,
+		PublishedDate: metadata.Date,
+		Description:   metadata.Text,
+		Explicit:      slices.Contains(metadata.Tags, TAG_R18),
+		Chapters:      []*AbsChapter{},
+	}
+	if metadata.Author != "" {
+		absMetadata.Authors = append(absMetadata.Authors, metadata.Author)
+	}
+	if metadata.Series != "" {
+		absMetadata.Series = append(absMetadata.Series, metadata.Series)
+	}
+	if absMetadata.Narrators == nil {
+		absMetadata.Narrators = []string{}
+	}
+	if absMetadata.Tags == nil {
+		absMetadata.Tags = []string{}
+	}
+	if len(metadata.Date) >= 4 {
+		absMetadata.PublishedYear = metadata.Date[:4]
+	}
+	chapters, err := getAudioChapters(dirname)
+	if err != nil {
+		log.Warnf("Failed to get chapters of %q: %v", dirname, err)
+	} else if len(chapters) > 0 {
+		absMetadata.Chapters = chapters
+	}
+	contents, err := json.MarshalIndent(absMetadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomic.WriteFile(metafile, bytes.NewReader(contents))
+}
+
+// Preferred audio formats of chapters, in order. Other formats are used only if none of these exists.
+var chapterAudioExts = []string{".flac", ".mp3", ".wav"}
+
+// Return chapters of audio files in dirname (recursively). Hidden files and dirs are ignored.
+// Works often contain the same tracks in multiple formats / folders (e.g. "mp3/", "wav/"),
+// so only the files of a single format (see chapterAudioExts) in a single folder
+// (the one that has most files of that format) are used.
+func getAudioChapters(dirname string) ([]*AbsChapter, error) {
+	dirFiles := map[string]map[string][]string{} // ext => dir => files
+	err := filepath.WalkDir(dirname, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dirname {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !d.IsDir() && slices.Contains(constants.AudioExts, ext) {
+			if dirFiles[ext] == nil {
+				dirFiles[ext] = map[string][]string{}
+			}
+			dirFiles[ext][filepath.Dir(path)] = append(dirFiles[ext][filepath.Dir(path)], path)
+		}
+		return nil
+	})
+	if err != nil || len(dirFiles) == 0 {
+		return nil, err
+	}
+	var dirs map[string][]string
+	for _, ext := range append(slices.Clone(chapterAudioExts), constants.AudioExts...) {
+		if dirs = dirFiles[ext]; dirs != nil {
+			break
+		}
+	}
+	var files []string
+	selectedDir := ""
+	for dir, dirFiles := range dirs {
+		if len(dirFiles) > len(files) || len(dirFiles) == len(files) && (len(dir) < len(selectedDir) ||
+			len(dir) == len(selectedDir) && stringutil.NaturalCompare(dir, selectedDir) < 0) {
+			files, selectedDir = dirFiles, dir
+		}
+	}
+	ffprobe, err := util.LookPathWithSelfDir("ffprobe")
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe not found: %w", err)
+	}
+	slices.SortFunc(files, stringutil.NaturalCompare)
+	var chapters []*AbsChapter
+	start := 0.0
+	for i, file := range files {
+		output, err := exec.Command(ffprobe, "-v", "error", "-show_entries", "format=duration",
+			"-of", "default=noprint_wrappers=1:nokey=1", file).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to probe %q: %w", file, err)
+		}
+		duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration of %q: %q", file, output)
+		}
+		chapters = append(chapters, &AbsChapter{
+			Id:    i,
+			Start: start,
+			End:   start + duration,
+			Title: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		})
+		start += duration
+	}
+	return chapters, nil
+}
@@ -0,0 +1,322 @@
+// Declarative scrapers, defined by "[[scrapers]]" with a type in config file,
+// or by yaml files in "scrapers" dir of config dir (one scraper per file, name default to file basename).
+// They are compiled into HtmlScraper / JsonScraper and registered on load.
+package declarative
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/scraper"
+	"github.com/sagan/erodownloader/scraper/html"
+	"github.com/sagan/erodownloader/scraper/jsonscraper"
+	"github.com/sagan/erodownloader/util"
+)
+
+// Scrapers dir in config dir
+const SCRAPERS_DIR = "scrapers"
+
+const DEFAULT_VERSION = "0.1.0"
+
+// Separator of "key => value" style list items, e.g. TagMapper.
+const MAPPER_SEP = "=>"
+
+// Load declarative scrapers from config file and scrapers dir, and register them.
+func Load() error {
+	scraperConfigs := []*config.ScraperConfig{}
+	for _, sc := range config.Data.Scrapers {
+		if sc.Type != "" {
+			scraperConfigs = append(scraperConfigs, sc)
+		}
+	}
+	dir := filepath.Join(config.ConfigDir, SCRAPERS_DIR)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read scrapers dir: %w", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		sc, err := readScraperConfig(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("invalid scraper file %q: %w", entry.Name(), err)
+		}
+		if sc.Name == "" {
+			sc.Name = strings.TrimSuffix(entry.Name(), ext)
+		}
+		if err = config.AddScraperConfig(sc); err != nil {
+			return err
+		}
+		scraperConfigs = append(scraperConfigs, sc)
+	}
+	for _, sc := range scraperConfigs {
+		s, err := New(sc)
+		if err != nil {
+			return fmt.Errorf("invalid scraper %s: %w", sc.Name, err)
+		}
+		if scraper.Exists(sc.Name) {
+			return fmt.Errorf("invalid scraper %s: name conflicts with an existing scraper", sc.Name)
+		}
+		scraper.Register(s)
+		log.Debugf("Registered %s scraper %s", sc.Type, sc.Name)
+	}
+	return nil
+}
+
+func readScraperConfig(filename string) (sc *config.ScraperConfig, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err = v.ReadConfig(file); err != nil {
+		return nil, err
+	}
+	if err = v.Unmarshal(&sc); err != nil {
+		return nil, err
+	}
+	if sc == nil {
+		return nil, fmt.Errorf("empty file")
+	}
+	return sc, nil
+}
+
+// Compile a declarative scraper config into a scraper.
+func New(sc *config.ScraperConfig) (*scraper.Scraper, error) {
+	if sc.Name == "" {
+		return nil, fmt.Errorf("name is empty")
+	}
+	if sc.Url == "" {
+		return nil, fmt.Errorf("url is empty")
+	}
+	if sc.Title == "" {
+		return nil, fmt.Errorf("title is empty")
+	}
+	numberRegexp, err := regexp.Compile(sc.NumberPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number pattern: %w", err)
+	}
+	if sc.NumberPattern == "" || numberRegexp.SubexpIndex("number") == -1 {
+		return nil, fmt.Errorf(`number pattern must has a "number" sub group`)
+	}
+	selectorTags, err := parseMapper(sc.SelectorTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector tags: %w", err)
+	}
+	tagMapper, err := parseMapper(sc.TagMapper)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag mapper: %w", err)
+	}
+	source := util.FirstNonZeroArg(sc.Source, sc.Name)
+	getUrl := func(number string) string {
+		return strings.ReplaceAll(sc.Url, "{{number}}", url.QueryEscape(number))
+	}
+	var getRename func(originalname string, metadata *scraper.Metadata) (string, bool)
+	if sc.Rename {
+		getRename = scraper.GetRename
+	}
+	s := &scraper.Scraper{
+		Name:    sc.Name,
+		Version: util.FirstNonZeroArg(sc.Version, DEFAULT_VERSION),
+	}
+	switch sc.Type {
+	case "html":
+		htmlScraper := &html.HtmlScraper{
+			Name:                sc.Name,
+			IgnoreErrors:        sc.IgnoreErrors,
+			NoRedirect:          sc.NoRedirect,
+			UseWebArchiveFor404: sc.UseWebArchiveFor404,
+			Cookie:              sc.Cookie,
+			TitleSelector:       sc.Title,
+			AuthorSelector:      sc.Author,
+			SeriesNameSelector:  sc.Series,
+			DateSelector:        sc.Date,
+			DateFormats:         sc.DateFormats,
+			NarratorSelector:    sc.Narrator,
+			TagsSelector:        sc.Tags,
+			CoverSelector:       sc.Cover,
+			TextSelectors:       sc.Text,
+			NumberRegexp:        numberRegexp,
+			SelectorTags:        selectorTags,
+			TagMapper:           tagMapper,
+			RemoveTags:          sc.RemoveTags,
+			Source:              source,
+			GetUrl:              getUrl,
+			GetRename:           getRename,
+		}
+		s.Pre = htmlScraper.Pre
+		s.Do = htmlScraper.Do
+	case "json":
+		if len(selectorTags) > 0 {
+			return nil, fmt.Errorf("selector tags is not supported by json scraper")
+		}
+		jsonScraper := &jsonscraper.JsonScraper[any]{
+			Name:         sc.Name,
+			Source:       source,
+			NumberRegexp: numberRegexp,
+			GetUrl:       getUrl,
+			GetRename:    getRename,
+			GetData: func(data *any) (*scraper.Metadata, error) {
+				return getJsonMetadata(sc, *data, source, tagMapper), nil
+			},
+			GetCover: func(data *any) string {
+				for _, path := range sc.Cover {
+					if values := getJsonValues(*data, path); len(values) > 0 {
+						return values[0]
+					}
+				}
+				return ""
+			},
+		}
+		s.Pre = jsonScraper.Pre
+		s.Do = jsonScraper.Do
+	default:
+		return nil, fmt.Errorf("invalid type %q", sc.Type)
+	}
+	return s, nil
+}
+
+// Parse "key => value" list items into a map.
+func parseMapper(items []string) (map[string]string, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	mapper := map[string]string{}
+	for _, item := range items {
+		key, value, found := strings.Cut(item, MAPPER_SEP)
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !found || key == "" || value == "" {
+			return nil, fmt.Errorf(`invalid item %q, must be "key %s value"`, item, MAPPER_SEP)
+		}
+		mapper[key] = value
+	}
+	return mapper, nil
+}
+
+func getJsonMetadata(sc *config.ScraperConfig, data any, source string,
+	tagMapper map[string]string) *scraper.Metadata {
+	first := func(path string) string {
+		if values := getJsonValues(data, path); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	metadata := &scraper.Metadata{
+		Title:    first(sc.Title),
+		Author:   first(sc.Author),
+		Series:   first(sc.Series),
+		Narrator: getJsonValues(data, sc.Narrator),
+		Tags:     getJsonValues(data, sc.Tags),
+		Source:   source,
+	}
+	if date := first(sc.Date); date != "" {
+		if len(sc.DateFormats) == 0 {
+			metadata.Date = date
+		}
+		for _, format := range sc.DateFormats {
+			if t, err := time.Parse(format, date); err == nil {
+				metadata.Date = t.Format("2006-01-02")
+				break
+			}
+		}
+	}
+	var texts []string
+	for _, path := range sc.Text {
+		if text := strings.TrimSpace(strings.Join(getJsonValues(data, path), "\n")); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	metadata.Text = strings.Join(texts, "\n\n")
+	if tagMapper != nil {
+		metadata.Tags = util.Map(metadata.Tags, func(tag string) string {
+			if newTag, ok := tagMapper[tag]; ok {
+				return newTag
+			}
+			return tag
+		})
+	}
+	if len(sc.RemoveTags) > 0 {
+		metadata.Tags = util.FilterSlice(metadata.Tags, func(tag string) bool {
+			return !slices.Contains(sc.RemoveTags, tag)
+		})
+	}
+	return metadata
+}
+
+// Return the string values of path in json data. Arrays are flattened unless indexed.
+// Numbers and booleans are converted to strings; objects and nulls are ignored.
+func getJsonValues(data any, path string) (values []string) {
+	if path == "" {
+		return nil
+	}
+	nodes := []any{data}
+	for _, key := range strings.Split(path, ".") {
+		var next []any
+		for _, node := range nodes {
+			next = append(next, getJsonChildren(node, key)...)
+		}
+		nodes = next
+	}
+	for _, node := range flatten(nodes) {
+		switch v := node.(type) {
+		case string:
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		case float64:
+			values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			values = append(values, strconv.FormatBool(v))
+		}
+	}
+	return values
+}
+
+func getJsonChildren(node any, key string) []any {
+	switch v := node.(type) {
+	case map[string]any:
+		if child, ok := v[key]; ok {
+			return []any{child}
+		}
+	case []any:
+		if index, err := strconv.Atoi(key); err == nil {
+			if index >= 0 && index < len(v) {
+				return []any{v[index]}
+			}
+			return nil
+		}
+		var children []any
+		for _, item := range v {
+			children = append(children, getJsonChildren(item, key)...)
+		}
+		return children
+	}
+	return nil
+}
+
+func flatten(nodes []any) (flattened []any) {
+	for _, node := range nodes {
+		if array, ok := node.([]any); ok {
+			flattened = append(flattened, flatten(array)...)
+		} else {
+			flattened = append(flattened, node)
+		}
+	}
+	return flattened
+}
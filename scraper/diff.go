@@ -0,0 +1,60 @@
+package scraper
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Max displayed length of changed text field in diff.
+const DIFF_TEXT_LENGTH = 60
+
+// Return field-by-field differences between old and new metadata, one line for each changed field.
+// E.g. `title: "foo" => "bar"`, `tags: +a, -b`. old can be nil, in which case all fields of new are listed.
+func DiffMetadata(old *Metadata, new *Metadata) (diffs []string) {
+	if old == nil {
+		old = &Metadata{}
+	}
+	for _, field := range mergeValueFields {
+		oldValue, newValue := *field.get(old), *field.get(new)
+		if oldValue == newValue {
+			continue
+		}
+		if field.name == "text" {
+			oldValue, newValue = truncateDiffText(oldValue), truncateDiffText(newValue)
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: %q => %q", field.name, oldValue, newValue))
+	}
+	for _, field := range mergeListFields {
+		oldValues, newValues := *field.get(old), *field.get(new)
+		var changes []string
+		for _, value := range newValues {
+			if !slices.Contains(oldValues, value) {
+				changes = append(changes, "+"+value)
+			}
+		}
+		for _, value := range oldValues {
+			if !slices.Contains(newValues, value) {
+				changes = append(changes, "-"+value)
+			}
+		}
+		if len(changes) > 0 {
+			diffs = append(diffs, fmt.Sprintf("%s: %s", field.name, strings.Join(changes, ", ")))
+		}
+	}
+	if old.ContentType != new.ContentType {
+		diffs = append(diffs, fmt.Sprintf("content type: %q => %q", old.ContentType, new.ContentType))
+	}
+	if old.GeneratedBy != new.GeneratedBy {
+		diffs = append(diffs, fmt.Sprintf("generated by: %q => %q", old.GeneratedBy, new.GeneratedBy))
+	}
+	return diffs
+}
+
+func truncateDiffText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > DIFF_TEXT_LENGTH {
+		text = string(runes[:DIFF_TEXT_LENGTH]) + "..."
+	}
+	return text
+}
@@ -70,6 +70,7 @@ var RjNumberRegexp = regexp.MustCompile(`\b(?P<number>RJ\d{5,12})(\b|_)`)
 
 func init() {
 	htmlScraper := &html.HtmlScraper{
+		Name:                DLSITE,
 		UseWebArchiveFor404: true,
 		TitleSelector:       "#work_name",
 		AuthorSelector:      ".maker_name",
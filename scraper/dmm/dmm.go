@@ -23,6 +23,7 @@ var NumberRegexp = regexp.MustCompile(`\b(?P<number>d_\d{5,12})(\b|_)`)
 
 func init() {
 	htmlScraper := &html.HtmlScraper{
+		Name:                DMM,
 		UseWebArchiveFor404: true,
 		Cookie:              "setover18=1; ckcy=1; is_intarnal=true; age_check_done=1;",
 		TitleSelector:       "h1.productTitle__txt",
@@ -17,6 +17,7 @@ const VERSION = "0.1.0"
 
 func init() {
 	htmlScraper := &html.HtmlScraper{
+		Name:                NAME,
 		NoRedirect:          true,
 		UseWebArchiveFor404: false,
 		AuthorSelector:      `#work_maker li:contains("Author/サークル名:") span`,
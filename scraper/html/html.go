@@ -21,6 +21,7 @@ import (
 )
 
 type HtmlScraper struct {
+	Name                string // scraper name, used to get scraper config
 	IgnoreErrors        bool
 	NoRedirect          bool
 	UseWebArchiveFor404 bool
@@ -82,7 +83,8 @@ func (hs *HtmlScraper) Do(dirname string, tmpdir string) (*scraper.Metadata, err
 	if hs.Cookie != "" {
 		header = http.Header{"Cookie": []string{hs.Cookie}}
 	}
-	res, err := httpclient.FetchUrl(baseUrl, header, true)
+	httpOptions := scraper.GetHttpOptions(hs.Name)
+	res, err := httpclient.FetchUrl(baseUrl, header, true, httpOptions)
 	if hs.NoRedirect {
 		if res != nil && res.Request.Url != baseUrl {
 			return nil, scraper.ErrNotFound
@@ -102,7 +104,7 @@ func (hs *HtmlScraper) Do(dirname string, tmpdir string) (*scraper.Metadata, err
 			}
 			for _, webarchiveUrl := range webarchiveUrls {
 				var webarchiveData *WebArchiveAvailableData
-				err1 = httpclient.FetchJson(webarchiveUrl, &webarchiveData, false)
+				err1 = httpclient.FetchJson(webarchiveUrl, &webarchiveData, false, httpOptions)
 				if err1 != nil {
 					return
 				}
@@ -110,7 +112,8 @@ func (hs *HtmlScraper) Do(dirname string, tmpdir string) (*scraper.Metadata, err
 					webarchiveData.ArchivedSnapshots.Closest.Status != "200" {
 					continue
 				}
-				res1, err1 := httpclient.FetchUrl(webarchiveData.ArchivedSnapshots.Closest.Url, nil, true)
+				res1, err1 := httpclient.FetchUrl(webarchiveData.ArchivedSnapshots.Closest.Url, nil, true,
+					httpOptions)
 				if err1 == nil {
 					res = res1
 					isWebArchive = true
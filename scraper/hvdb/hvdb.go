@@ -18,6 +18,7 @@ const VERSION = "0.1.0"
 
 func init() {
 	htmlScraper := &html.HtmlScraper{
+		Name:                NAME,
 		NoRedirect:          true,
 		UseWebArchiveFor404: true,
 		TitleSelector:       `.infoLabel`,
@@ -15,6 +15,7 @@ import (
 
 // T: the response data type, e.g. a struct.
 type JsonScraper[T any] struct {
+	Name         string // scraper name, used to get scraper config
 	Source       string
 	GetUrl       func(number string) (url string)
 	GetData      func(data *T) (metadata *scraper.Metadata, err error)
@@ -38,7 +39,7 @@ func (js *JsonScraper[T]) Do(dirname string, tmpdir string) (metadata *scraper.M
 		return nil, scraper.ErrNotFound
 	}
 	var data *T
-	err = httpclient.FetchJson(baseUrl, &data, true)
+	err = httpclient.FetchJson(baseUrl, &data, true, scraper.GetHttpOptions(js.Name))
 	if err != nil {
 		if strings.Contains(err.Error(), "status=404") {
 			return nil, scraper.ErrNotFound
@@ -53,6 +54,9 @@ func (js *JsonScraper[T]) Do(dirname string, tmpdir string) (metadata *scraper.M
 	if metadata.Title == "" {
 		return nil, scraper.ErrNotFound
 	}
+	if metadata.Number == "" {
+		metadata.Number = number
+	}
 
 	var files []string
 	if util.ExistsFileWithAnySuffix(filepath.Join(dirname, scraper.COVER), constants.ImgExts...) == "" {
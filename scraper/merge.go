@@ -0,0 +1,141 @@
+package scraper
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/util"
+)
+
+// Name of the pseudo field of cover (and other meta files) in merge precedence rules.
+const MERGE_FIELD_FILES = "cover"
+
+// Single value fields of metadata. The value of scraper with highest precedence is used.
+var mergeValueFields = []struct {
+	name string
+	get  func(m *Metadata) *string
+}{
+	{"title", func(m *Metadata) *string { return &m.Title }},
+	{"author", func(m *Metadata) *string { return &m.Author }},
+	{"series", func(m *Metadata) *string { return &m.Series }},
+	{"number", func(m *Metadata) *string { return &m.Number }},
+	{"date", func(m *Metadata) *string { return &m.Date }},
+	{"source", func(m *Metadata) *string { return &m.Source }},
+	{"text", func(m *Metadata) *string { return &m.Text }},
+}
+
+// List fields of metadata. Values of all scrapers are unioned, in precedence order.
+var mergeListFields = []struct {
+	name string
+	get  func(m *Metadata) *[]string
+}{
+	{"narrator", func(m *Metadata) *[]string { return &m.Narrator }},
+	{"tags", func(m *Metadata) *[]string { return &m.Tags }},
+	{"other_edition_number", func(m *Metadata) *[]string { return &m.OtherEditionNumber }},
+}
+
+// Return results sorted by the precedence of field configured in MergePrecedence config.
+// Scrapers not listed follow in their original order.
+func sortByPrecedence(results []*scrapeResult, field string) []*scrapeResult {
+	var names []string
+	if config.Data != nil {
+		names = config.Data.MergePrecedence[field]
+	}
+	sorted := make([]*scrapeResult, 0, len(results))
+	for _, name := range names {
+		for _, result := range results {
+			if result.scraper.Name == name {
+				sorted = append(sorted, result)
+			}
+		}
+	}
+	for _, result := range results {
+		if !slices.Contains(names, result.scraper.Name) {
+			sorted = append(sorted, result)
+		}
+	}
+	return sorted
+}
+
+// Merge results of multiple scrapers. Return merged metadata, and the dirs that contain it's meta files.
+// The source scrapers of each field are recorded in Provenance.
+func mergeResults(basename string, results []*scrapeResult) (metadata *Metadata, fileDirs map[string]string) {
+	metadata = &Metadata{Provenance: map[string]string{}}
+	fileDirs = map[string]string{}
+	for _, field := range mergeValueFields {
+		for _, result := range sortByPrecedence(results, field.name) {
+			if value := *field.get(result.metadata); value != "" {
+				*field.get(metadata) = value
+				metadata.Provenance[field.name] = result.scraper.Name
+				break
+			}
+		}
+	}
+	for _, field := range mergeListFields {
+		var sources []string
+		for _, result := range sortByPrecedence(results, field.name) {
+			if values := *field.get(result.metadata); len(values) > 0 {
+				*field.get(metadata) = append(*field.get(metadata), values...)
+				sources = append(sources, result.scraper.Name)
+			}
+		}
+		if len(sources) > 0 {
+			*field.get(metadata) = util.UniqueSlice(*field.get(metadata))
+			metadata.Provenance[field.name] = strings.Join(sources, "+")
+		}
+	}
+	slices.Sort(metadata.Tags)
+	var fileSources []string
+	for _, result := range sortByPrecedence(results, MERGE_FIELD_FILES) {
+		used := false
+		for _, file := range result.metadata.Files {
+			if _, ok := fileDirs[file]; !ok {
+				fileDirs[file] = result.tmpdir
+				metadata.Files = append(metadata.Files, file)
+				used = true
+			}
+		}
+		if used {
+			fileSources = append(fileSources, result.scraper.Name)
+		}
+	}
+	if len(fileSources) > 0 {
+		metadata.Provenance[MERGE_FIELD_FILES] = strings.Join(fileSources, "+")
+	}
+	var generatedBy []string
+	for _, result := range results {
+		generatedBy = append(generatedBy, result.scraper.Name+"-v"+result.scraper.Version)
+		// rename the content dir if the scraper of title supports renaming
+		if result.scraper.Name == metadata.Provenance["title"] && result.metadata.CanonicalFilename != "" {
+			metadata.CanonicalFilename, metadata.ShouldRename = GetRename(basename, metadata)
+		}
+	}
+	metadata.GeneratedBy = constants.NAME + "-" + strings.Join(generatedBy, "+")
+	return metadata, fileDirs
+}
+
+// Format provenance as "field=scraper" csv, sorted by field.
+func formatProvenance(provenance map[string]string) string {
+	var items []string
+	for field, source := range provenance {
+		items = append(items, field+"="+source)
+	}
+	slices.Sort(items)
+	return strings.Join(items, ", ")
+}
+
+func parseProvenance(str string) map[string]string {
+	items := util.SplitCsv(str)
+	if len(items) == 0 {
+		return nil
+	}
+	provenance := map[string]string{}
+	for _, item := range items {
+		if field, source, found := strings.Cut(item, "="); found {
+			provenance[strings.TrimSpace(field)] = strings.TrimSpace(source)
+		}
+	}
+	return provenance
+}
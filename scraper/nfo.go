@@ -0,0 +1,137 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/natefinch/atomic"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/util"
+)
+
+// Kodi / Jellyfin album nfo file. See https://kodi.wiki/view/NFO_files/Music .
+const KODI_NFO = "album.nfo"
+
+// Folder image of media servers
+const FOLDER_IMAGE = "folder.jpg"
+
+const FORMAT_KODI = "kodi"
+
+// Write metadata of dirname in a format other than metadata.nfo.
+// If force is false, existing files are not overwritten.
+type MetadataWriter func(dirname string, metadata *Metadata, force bool) error
+
+// Additional metadata formats that could be written alongside metadata.nfo.
+var Writers = map[string]MetadataWriter{
+	FORMAT_KODI:           WriteKodiNfo,
+	FORMAT_AUDIOBOOKSHELF: WriteAudiobookshelfMetadata,
+}
+
+type KodiAlbum struct {
+	XMLName     xml.Name `xml:"album"`
+	Title       string   `xml:"title"`
+	Artist      []string `xml:"artist,omitempty"`
+	AlbumArtist string   `xml:"albumartist,omitempty"`
+	Genre       []string `xml:"genre,omitempty"`
+	Plot        string   `xml:"plot,omitempty"`
+	Premiered   string   `xml:"premiered,omitempty"`
+	ReleaseDate string   `xml:"releasedate,omitempty"`
+	Year        string   `xml:"year,omitempty"`
+	Label       string   `xml:"label,omitempty"`
+	Thumb       string   `xml:"thumb,omitempty"`
+}
+
+// Write Kodi / Jellyfin album.nfo, and folder.jpg converted from cover (if exists).
+// Narrators are written as artists, author (circle) as album artist.
+func WriteKodiNfo(dirname string, metadata *Metadata, force bool) error {
+	nfofile := filepath.Join(dirname, KODI_NFO)
+	if !force && util.FileExists(nfofile) {
+		return ErrExists
+	}
+	album := &KodiAlbum{
+		Title:       metadata.Title,
+		Artist:      metadata.Narrator,
+		AlbumArtist: metadata.Author,
+		Genre:       metadata.Tags,
+		Plot:        metadata.Text,
+		Premiered:   metadata.Date,
+		ReleaseDate: metadata.Date,
+		Label:       metadata.Source,
+	}
+	if len(album.Artist) == 0 && metadata.Author != "" {
+		album.Artist = []string{metadata.Author}
+	}
+	if len(metadata.Date) >= 4 {
+		album.Year = metadata.Date[:4]
+	}
+	if thumb, err := writeFolderImage(dirname, force); err != nil {
+		log.Warnf("Failed to write %s of %q: %v", FOLDER_IMAGE, dirname, err)
+	} else {
+		album.Thumb = thumb
+	}
+	contents, err := xml.MarshalIndent(album, "", "  ")
+	if err != nil {
+		return err
+	}
+	contents = append([]byte(xml.Header), contents...)
+	contents = append(contents, '\n')
+	return atomic.WriteFile(nfofile, bytes.NewReader(contents))
+}
+
+// Convert cover image of dirname to folder.jpg. Return the base name of folder image, which is the cover itself
+// if it can't be converted. Return empty string if dir has no cover.
+// Png and gif covers are converted natively, other formats (e.g. webp) require ffmpeg in PATH.
+func writeFolderImage(dirname string, force bool) (string, error) {
+	folderImage := filepath.Join(dirname, FOLDER_IMAGE)
+	if !force && util.FileExists(folderImage) {
+		return FOLDER_IMAGE, nil
+	}
+	cover := util.ExistsFileWithAnySuffix(filepath.Join(dirname, COVER), constants.ImgExts...)
+	if cover == "" {
+		return "", nil
+	}
+	ext := strings.ToLower(filepath.Ext(cover))
+	if slices.Contains([]string{".jpg", ".jpeg"}, ext) {
+		contents, err := os.ReadFile(cover)
+		if err != nil {
+			return "", err
+		}
+		return FOLDER_IMAGE, atomic.WriteFile(folderImage, bytes.NewReader(contents))
+	}
+	file, err := os.Open(cover)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err == nil {
+		buf := &bytes.Buffer{}
+		if err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}); err != nil {
+			return "", err
+		}
+		return FOLDER_IMAGE, atomic.WriteFile(folderImage, buf)
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		log.Debugf("Can not convert %q to jpg (ffmpeg not found), use it as thumb", cover)
+		return filepath.Base(cover), nil
+	}
+	tmpfile := folderImage + ".tmp.jpg"
+	if output, err := exec.Command("ffmpeg", "-y", "-loglevel", "error", "-i", cover, tmpfile).
+		CombinedOutput(); err != nil {
+		os.Remove(tmpfile)
+		return "", fmt.Errorf("ffmpeg failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return FOLDER_IMAGE, atomic.ReplaceFile(tmpfile, folderImage)
+}
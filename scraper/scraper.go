@@ -14,8 +14,11 @@ import (
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 
+	"github.com/sagan/erodownloader/config"
 	"github.com/sagan/erodownloader/constants"
+	"github.com/sagan/erodownloader/httpclient"
 	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/pathtemplate"
 	"github.com/sagan/erodownloader/util/stringutil"
 )
 
@@ -43,6 +46,8 @@ type Metadata struct {
 	Date                   string   `yaml:"date,omitempty" json:"date,omitempty"`
 	Source                 string   `yaml:"source,omitempty" json:"source,omitempty"`
 	GeneratedBy            string   `yaml:"generated by,omitempty" json:"generated_by,omitempty"`
+	YamlProvenance         string   `yaml:"provenance,omitempty" json:"yaml_provenance,omitempty"`
+	ContentType            string   `yaml:"content type,omitempty" json:"content_type,omitempty"` // "audio", "cg" or "game"
 	Narrator               []string `yaml:"-" json:"narrator,omitempty"`
 	Tags                   []string `yaml:"-" json:"tags,omitempty"`
 	OtherEditionNumber     []string `yaml:"-" json:"other_edition_number,omitempty"`
@@ -50,6 +55,8 @@ type Metadata struct {
 	Files                  []string `yaml:"-" json:"files,omitempty"`              // additional meta files saved in tmpdir.
 	CanonicalFilename      string   `yaml:"-" json:"canonical_filename,omitempty"` // If empty, fallback to use metadata.GetCanonicalName()
 	ShouldRename           bool     `yaml:"-" json:"should_rename,omitempty"`      // Indicate the content-dir should be renamed to canonical filename
+	// field => source scraper names ("+" joined). Only set for merged metadata.
+	Provenance map[string]string `yaml:"-" json:"provenance,omitempty"`
 }
 
 type Scraper struct {
@@ -123,23 +130,66 @@ func (m *Metadata) GetCanonicalFilename() (filename string) {
 	if m.CanonicalFilename != "" {
 		return m.CanonicalFilename
 	}
-	number := util.CleanBasenameComponent(m.Number)
-	author := util.CleanBasenameComponent(m.Author)
-	title := util.CleanBasenameComponent(m.Title)
-	if number != "" {
-		filename += fmt.Sprintf("[%s]", number)
+	return pathtemplate.Default.Path(m.TemplateFields(), "/")
+}
+
+// Return ("/" separated) relative path of content rendered by folder name template.
+// Non-sense parts of title are removed.
+func (m *Metadata) GetTemplateFilename(template *pathtemplate.Template) string {
+	metadataClone := *m
+	metadataClone.Title = removeNonSenseFromTitle(metadataClone.Title)
+	return template.Path(metadataClone.TemplateFields(), "/")
+}
+
+// Return name of the scraper which generated the metadata.
+// For merged metadata, it's the scraper of title.
+func (m *Metadata) GetScraperName() string {
+	if m.Provenance["title"] != "" {
+		return m.Provenance["title"]
 	}
-	if author != "" {
-		filename += fmt.Sprintf("[%s]", author)
+	// "erodownloader-dlsite-v1.0.0"
+	name, found := strings.CutPrefix(m.GeneratedBy, constants.NAME+"-")
+	if !found {
+		return ""
+	}
+	if i := strings.LastIndex(name, "-v"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// Return values of folder name template fields.
+func (m *Metadata) TemplateFields() map[string]string {
+	return map[string]string{
+		"number":   m.Number,
+		"title":    m.Title,
+		"author":   m.Author,
+		"series":   m.Series,
+		"date":     m.Date,
+		"narrator": strings.Join(m.Narrator, ", "),
+		"tags":     strings.Join(m.Tags, ", "),
+		"source":   m.Source,
 	}
-	filename += title
-	return util.CleanBasename(filename)
+}
+
+// Return http request options of scraper, e.g. cache ttl configured in scraper config.
+func GetHttpOptions(name string) *httpclient.Options {
+	options := &httpclient.Options{}
+	if scraperConfig := config.GetScraperConfig(name); scraperConfig != nil {
+		options.CacheTtl = httpclient.ParseCacheTtl(scraperConfig.CacheTtl)
+	}
+	return options
 }
 
 func Register(scraper *Scraper) {
 	allScrapers[scraper.Name] = scraper
 }
 
+// Whether a scraper of name has been registered.
+func Exists(name string) bool {
+	return allScrapers[name] != nil
+}
+
 func NewScrapers(names ...string) (Scrapes, error) {
 	var scrapers []*Scraper
 	if len(names) == 0 {
@@ -154,80 +204,175 @@ func NewScrapers(names ...string) (Scrapes, error) {
 	return scrapers, nil
 }
 
-func (s Scrapes) Scrape(dirname string, tmpdir string, force bool) (*Metadata, error) {
+// A successful result of a scraper. The meta files of metadata are saved in tmpdir.
+type scrapeResult struct {
+	scraper  *Scraper
+	metadata *Metadata
+	tmpdir   string
+}
+
+// Scrape metadata of dirname and save it to metadata.nfo.
+// If merge is false, the result of first scraper that succeeds is used;
+// otherwise all applicable scrapers are run and their results are merged, see mergeResults.
+func (s Scrapes) Scrape(dirname string, tmpdir string, force bool, merge bool) (*Metadata, error) {
+	pending, err := s.Fetch(dirname, tmpdir, force, merge)
+	if err != nil {
+		return nil, err
+	}
+	if err = pending.Save(); err != nil {
+		return nil, err
+	}
+	return pending.Metadata, nil
+}
+
+// Scraped metadata of a dir that is not saved yet. It's meta files are kept in tmp dir.
+// Either Save or Discard must be called.
+type Pending struct {
+	Dirname  string
+	Metadata *Metadata
+	tmp      string
+	fileDirs map[string]string // meta file => dir that contains it
+}
+
+// Run scrapers on dirname like Scrape, but do not write anything to dirname.
+func (s Scrapes) Fetch(dirname string, tmpdir string, force bool, merge bool) (pending *Pending, err error) {
 	metafile := filepath.Join(dirname, METAFILE)
 	basename := filepath.Base(dirname)
 	if !force && util.FileExists(metafile) {
 		return nil, ErrExists
 	}
+	// tmpdir may be shared by multiple dirs (e.g. scrape --tmpdir), which may have same basename.
+	absDirname, err := filepath.Abs(dirname)
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(tmpdir, basename+"."+util.Md5(absDirname)[:8])
+	if err := util.MakeCleanTmpDir(tmp); err != nil {
+		return nil, fmt.Errorf("failed to make tmp dir %q: %v", tmp, err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
 	triedScrapers := []string{}
+	var results []*scrapeResult
+	var errs []error // errors of failed scrapers in merge mode
 	for _, scraper := range s {
 		if !scraper.Pre(dirname) {
 			continue
 		}
 		log.Printf("Scrape %s using %s scraper", dirname, scraper.Name)
-		tmp := filepath.Join(tmpdir, basename)
-		if err := util.MakeCleanTmpDir(tmp); err != nil {
-			return nil, fmt.Errorf("failed to make tmp dir %q: %v", tmp, err)
+		scraperTmp := tmp
+		if merge {
+			scraperTmp = filepath.Join(tmp, scraper.Name)
+		}
+		if err := util.MakeCleanTmpDir(scraperTmp); err != nil {
+			return nil, fmt.Errorf("failed to make tmp dir %q: %v", scraperTmp, err)
 		}
 		triedScrapers = append(triedScrapers, scraper.Name)
-		metadata, err := scraper.Do(dirname, tmp)
+		metadata, err := scraper.Do(dirname, scraperTmp)
+		if err == nil {
+			if metadata == nil {
+				err = ErrInvalid
+			} else if metadata.Title = stringutil.CleanTitle(metadata.Title); metadata.Title == "" {
+				err = ErrInvalid
+			}
+		}
 		if err != nil {
 			if errors.Is(err, ErrNotFound) {
 				continue
 			}
-			return nil, err
-		}
-		if metadata == nil {
-			return nil, ErrInvalid
-		}
-		metadata.Title = stringutil.CleanTitle(metadata.Title)
-		if metadata.Title == "" {
-			return nil, ErrInvalid
+			if !merge {
+				return nil, err
+			}
+			// in merge mode, a failed scraper does not prevent the results of others from being merged.
+			log.Warnf("Scraper %s failed on %s: %v", scraper.Name, dirname, err)
+			errs = append(errs, fmt.Errorf("%s: %w", scraper.Name, err))
+			continue
 		}
 		metadata.Author = stringutil.CleanTitle(metadata.Author)
 		metadata.Series = stringutil.CleanTitle(metadata.Series)
 		metadata.Number = stringutil.CleanTitle(metadata.Number)
 		metadata.Date = stringutil.CleanTitle(metadata.Date)
 		metadata.Source = stringutil.CleanTitle(metadata.Source)
-		metadata.GeneratedBy = stringutil.CleanTitle(metadata.GeneratedBy)
 		metadata.Tags = util.UniqueSlice(util.OmitemptySlice(metadata.Tags))
 		metadata.Narrator = util.UniqueSlice(util.OmitemptySlice(metadata.Narrator))
 		metadata.OtherEditionNumber = util.UniqueSlice(util.OmitemptySlice(metadata.OtherEditionNumber))
 		slices.Sort(metadata.Tags)
-
 		metadata.GeneratedBy = constants.NAME + "-" + scraper.Name + "-v" + scraper.Version
+		results = append(results, &scrapeResult{scraper: scraper, metadata: metadata, tmpdir: scraperTmp})
+		if !merge {
+			break
+		}
+	}
+	if len(results) == 0 {
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+		if len(triedScrapers) > 0 {
+			return nil, fmt.Errorf("no metadata found for %q (tried scrapers: %v)", dirname, triedScrapers)
+		}
+		return nil, fmt.Errorf("no suitable scraper found for %q", dirname)
+	}
+
+	metadata := results[0].metadata
+	scraperName := results[0].scraper.Name
+	fileDirs := map[string]string{} // meta file => dir that contains it
+	if merge {
+		metadata, fileDirs = mergeResults(basename, results)
+		scraperName = metadata.Provenance["title"]
+	} else {
 		for _, file := range metadata.Files {
-			srcpath := filepath.Join(tmp, file)
-			targetpath := filepath.Join(dirname, file)
-			if util.FileExists(targetpath) {
-				log.Tracef("meta file %q exists, skip it", targetpath)
-				continue
-			}
-			if err := atomic.ReplaceFile(srcpath, targetpath); err != nil {
-				return nil, fmt.Errorf("failed to write to %q", targetpath)
-			}
+			fileDirs[file] = results[0].tmpdir
 		}
-		tmpMetafile := filepath.Join(tmp, METAFILE)
-		if err := WriteMetadata(tmpMetafile, metadata); err != nil {
-			return nil, fmt.Errorf("failed to write metafile: %w", err)
+	}
+	// CanonicalFilename is set only if the scraper supports renaming
+	if template := config.GetScraperNameTemplate(scraperName); template != pathtemplate.Default &&
+		metadata.CanonicalFilename != "" {
+		if name := metadata.GetTemplateFilename(template); name != "" {
+			metadata.CanonicalFilename = name
+			metadata.ShouldRename = filepath.Join(pathtemplate.Root(dirname, name), filepath.FromSlash(name)) != dirname
 		}
-		if err := atomic.ReplaceFile(tmpMetafile, filepath.Join(dirname, METAFILE)); err != nil {
-			return nil, fmt.Errorf("failed to save metafile: %w", err)
+	}
+	return &Pending{Dirname: dirname, Metadata: metadata, tmp: tmp, fileDirs: fileDirs}, nil
+}
+
+// Write metadata.nfo and meta files to dir. Existing meta files are not overwritten.
+func (p *Pending) Save() error {
+	defer p.Discard()
+	metafile := filepath.Join(p.Dirname, METAFILE)
+	for _, file := range p.Metadata.Files {
+		srcpath := filepath.Join(p.fileDirs[file], file)
+		targetpath := filepath.Join(p.Dirname, file)
+		if util.FileExists(targetpath) {
+			log.Tracef("meta file %q exists, skip it", targetpath)
+			continue
+		}
+		if err := atomic.ReplaceFile(srcpath, targetpath); err != nil {
+			return fmt.Errorf("failed to write to %q", targetpath)
 		}
-		os.RemoveAll(tmp)
-		return metadata, nil
 	}
-	if len(triedScrapers) > 0 {
-		return nil, fmt.Errorf("no metadata found for %q (tried scrapers: %v)", dirname, triedScrapers)
+	tmpMetafile := filepath.Join(p.tmp, METAFILE)
+	if err := WriteMetadata(tmpMetafile, p.Metadata); err != nil {
+		return fmt.Errorf("failed to write metafile: %w", err)
 	}
-	return nil, fmt.Errorf("no suitable scraper found for %q", dirname)
+	if err := atomic.ReplaceFile(tmpMetafile, metafile); err != nil {
+		return fmt.Errorf("failed to save metafile: %w", err)
+	}
+	return nil
+}
+
+// Remove tmp dir of pending meta files.
+func (p *Pending) Discard() {
+	os.RemoveAll(p.tmp)
 }
 
 func WriteMetadata(metafile string, metadata *Metadata) error {
 	metadata.YamlNarrator = strings.Join(metadata.Narrator, ", ")
 	metadata.YamlTags = strings.Join(metadata.Tags, ", ")
 	metadata.YamlOtherEditionNumber = strings.Join(metadata.OtherEditionNumber, ", ")
+	metadata.YamlProvenance = formatProvenance(metadata.Provenance)
 	metaHeader, err := yaml.Marshal(metadata)
 	if err != nil {
 		return err
@@ -264,11 +409,12 @@ func ReadMetadata(metafile string) (metadata *Metadata, err error) {
 		return nil, err
 	}
 	if metadata.Title == "" {
-		return nil, err
+		return nil, ErrInvalid
 	}
 	metadata.Narrator = util.SplitCsv(metadata.YamlNarrator)
 	metadata.Tags = util.SplitCsv(metadata.YamlTags)
 	metadata.OtherEditionNumber = util.SplitCsv(metadata.YamlOtherEditionNumber)
+	metadata.Provenance = parseProvenance(metadata.YamlProvenance)
 	metadata.Text = text
 	return metadata, nil
 }
@@ -282,7 +428,7 @@ func GetNumberFromFilename(regexp *regexp.Regexp, filename string) string {
 	return ""
 }
 
-// Get standard name
+// Get standard name. canonicalName is originalname itself if it's already standard.
 func GetRename(originalname string, metadata *Metadata) (canonicalName string, shouldRename bool) {
 	if substrings := canonicalFilenameRegexp.FindStringSubmatch(originalname); substrings == nil {
 		metadataClone := *metadata
@@ -301,5 +447,5 @@ func GetRename(originalname string, metadata *Metadata) (canonicalName string, s
 			return normalizedName, true
 		}
 	}
-	return "", false
+	return originalname, false
 }
@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/sagan/erodownloader/config"
 	"github.com/sagan/erodownloader/httpclient"
@@ -17,6 +18,7 @@ type AlistSite struct {
 	Config           *config.SiteConfig
 	ResourceProvider site.ResourceProvider
 	rootName         string
+	loginMu          *sync.Mutex
 }
 
 func (a *AlistSite) GetIdentifier(id string) (identifier string) {
@@ -48,7 +50,7 @@ func (a *AlistSite) ReadDir(id string) (site.Files, error) {
 	if values.Get("path") == "" {
 		return nil, fmt.Errorf("empty path")
 	}
-	return a.fsList(values)
+	return a.fsList(values, readOnlyApiOptions)
 }
 
 func (a *AlistSite) SearchResources(qs string) (site.Resources, error) {
@@ -72,11 +74,69 @@ func (a *AlistSite) GetFile(id string) (site.File, error) {
 	return a.fsGet(values.Get("path"), values.Get("password"))
 }
 
+// Alist apis use POST method, but the fs list / search apis are read only and safe to retry (and cache).
+// Alist reports errors in the "code" field of a 200 response, which are not cached.
+var readOnlyApiOptions = &httpclient.Options{RetryNonIdempotent: true, CacheValidate: func(body []byte) bool {
+	res, err := util.UnmarshalJson[*ApiResponse](body)
+	return err == nil && res != nil && res.Code == 200
+}}
+
+// Options of fs apis whose responses must be fresh, e.g. crawling of dirs to refresh resources,
+// or fs get whose response contains signed raw url.
+var noCacheApiOptions = &httpclient.Options{RetryNonIdempotent: true, CacheTtl: -1}
+
+// If site has username & password configured but no token, login to get a token,
+// which will then be sent in "Authorization" header of all requests to site by httpclient.
+// If expiredToken is not empty and it's still the current token, re-login to get a new one.
+func (a *AlistSite) login(expiredToken string) error {
+	a.loginMu.Lock()
+	defer a.loginMu.Unlock()
+	if token := a.Config.GetToken(); a.Config.Username == "" || token != "" && token != expiredToken {
+		return nil
+	}
+	a.Config.SetToken("")
+	var res *ApiResponse
+	err := httpclient.PostAndFetchJson(a.Config.Url+"api/auth/login", &ApiLoginRequest{
+		Username: a.Config.Username,
+		Password: a.Config.Password,
+	}, &res, true, &httpclient.Options{RetryNonIdempotent: true, CacheTtl: -1})
+	if err != nil {
+		return fmt.Errorf("failed to login: %w", err)
+	}
+	if res.Code != 200 {
+		return fmt.Errorf("failed to login: api %d error, msg=%s", res.Code, res.Message)
+	}
+	data, err := util.UnmarshalJson[*ApiLoginData](res.Data)
+	if err != nil || data == nil || data.Token == "" {
+		return fmt.Errorf("failed to login: invalid response (err=%v)", err)
+	}
+	a.Config.SetToken(data.Token)
+	return nil
+}
+
+// Post api request to site, login first if required.
+// If api reports that token is expired or invalid (401), re-login and retry once.
+func (a *AlistSite) post(apiUrl string, req any, options *httpclient.Options) (res *ApiResponse, err error) {
+	expiredToken := ""
+	for {
+		if err = a.login(expiredToken); err != nil {
+			return nil, err
+		}
+		token := a.Config.GetToken()
+		if err = httpclient.PostAndFetchJson(apiUrl, req, &res, true, options); err != nil {
+			return nil, err
+		}
+		if res.Code != 401 || expiredToken != "" || token == "" || a.Config.Username == "" {
+			return res, nil
+		}
+		expiredToken = token
+	}
+}
+
 func (a *AlistSite) fsGet(filepath string, password string) (site.File, error) {
 	urlStr := a.Config.Url + "api/fs/get"
 	req := &ApiRequest{Path: filepath, Password: password}
-	var res *ApiResponse
-	err := httpclient.PostAndFetchJson(urlStr, req, &res, true)
+	res, err := a.post(urlStr, req, noCacheApiOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +155,7 @@ func (a *AlistSite) fsGet(filepath string, password string) (site.File, error) {
 	return file, err
 }
 
-func (a *AlistSite) fsList(params url.Values) (files site.Files, err error) {
+func (a *AlistSite) fsList(params url.Values, options *httpclient.Options) (files site.Files, err error) {
 	if a.rootName == "" {
 		file, err := a.fsGet("/", "")
 		if err != nil {
@@ -120,8 +180,7 @@ func (a *AlistSite) fsList(params url.Values) (files site.Files, err error) {
 	} else {
 		return nil, fmt.Errorf("invalid params")
 	}
-	var res *ApiResponse
-	err = httpclient.PostAndFetchJson(apiUrl, req, &res, true)
+	res, err := a.post(apiUrl, req, options)
 	if err != nil {
 		return nil, err
 	}
@@ -161,7 +220,7 @@ func (a *AlistSite) Search(qs string) (site.Files, error) {
 			return site.Files{file}, nil
 		}
 	}
-	return a.fsList(query)
+	return a.fsList(query, readOnlyApiOptions)
 }
 
 func New(name string, sc *config.SiteConfig, resourceProvider site.ResourceProvider) (*AlistSite, error) {
@@ -172,11 +231,21 @@ func New(name string, sc *config.SiteConfig, resourceProvider site.ResourceProvi
 		Name:             sc.Name,
 		Config:           sc,
 		ResourceProvider: resourceProvider,
+		loginMu:          &sync.Mutex{},
 	}, nil
 }
 
 func Creator(name string, sc *config.SiteConfig, c *config.Config) (site.Site, error) {
-	return New(sc.Name, sc, nil)
+	a, err := New(sc.Name, sc, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(sc.ResourceRoots) > 0 {
+		if a.ResourceProvider, err = NewDirResourceProvider(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
 }
 
 func init() {
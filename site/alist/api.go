@@ -21,6 +21,16 @@ type ApiRequest struct {
 	Scope    int    `json:"scope,omitempty"`    // fs/search: 0
 }
 
+// api/auth/login
+type ApiLoginRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type ApiLoginData struct {
+	Token string `json:"token,omitempty"`
+}
+
 type ApiResponse struct {
 	Code    int             `json:"code,omitempty"`
 	Message string          `json:"message,omitempty"`
@@ -0,0 +1,391 @@
+package alist
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/natefinch/atomic"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/schema"
+	"github.com/sagan/erodownloader/site"
+	"github.com/sagan/erodownloader/util"
+)
+
+const DEFAULT_RESOURCE_MAX_DEPTH = 3
+const DEFAULT_RESOURCE_REFRESH_INTERVAL = time.Hour
+const LIST_PER_PAGE = 500
+
+// File in site meta data dir that stores the unix timestamp of last successful refresh of resources.
+const RESOURCES_REFRESHED_FILE = "resources_refreshed"
+
+var ErrPartialRefresh = errors.New("resources are partially refreshed")
+
+// \b 不匹配 "_"
+var DefaultResourceNumberRegexp = regexp.MustCompile(`\b(?P<number>[BRV]J\d{5,12}|d_\d{5,12})(\b|_)`)
+
+// Capture "[number][author]title" subgroups
+var canonicalDirnameRegexp = regexp.MustCompile(`^\[(?P<number>.+?)\]\[(?P<author>.+?)\](?P<title>.+)$`)
+
+// A generic resource provider of alist site.
+// It crawls the configured root dirs and exposes each dir whose name contains a number as a resource.
+// The crawled dirs are cached in data.db and refreshed incrementally, at most once per refresh interval:
+// size of a dir is re-calculated only if it's modified time changed. Modified time of a dir does not change
+// when files of it's subdirs change, use "refresh" qs to re-calculate sizes of all dirs.
+type DirResourceProvider struct {
+	site            *AlistSite
+	roots           []string
+	numberRegexp    *regexp.Regexp
+	maxDepth        int
+	refreshInterval time.Duration
+}
+
+type DirResource struct {
+	record *schema.DirResource
+}
+
+// Author implements site.Resource.
+func (d *DirResource) Author() string {
+	return d.record.Author
+}
+
+// Id implements site.Resource.
+func (d *DirResource) Id() string {
+	values := url.Values{}
+	values.Set("path", d.record.Path)
+	values.Set("number", d.record.Number)
+	values.Set("type", "resource")
+	if d.record.Site != "" {
+		values.Set("site", d.record.Site)
+	}
+	return values.Encode()
+}
+
+// Number implements site.Resource.
+func (d *DirResource) Number() string {
+	return d.record.Number
+}
+
+// Site implements site.Resource.
+func (d *DirResource) Site() string {
+	return d.record.Site
+}
+
+// Size implements site.Resource.
+func (d *DirResource) Size() int64 {
+	return d.record.Size
+}
+
+// Tags implements site.Resource.
+func (d *DirResource) Tags() schema.Tags {
+	return nil
+}
+
+// Time implements site.Resource.
+func (d *DirResource) Time() int64 {
+	return d.record.Modified
+}
+
+// Title implements site.Resource.
+func (d *DirResource) Title() string {
+	return d.record.Title
+}
+
+// A file of resource. Name is the relative path of file to resource dir, e.g. "mp3/01.mp3".
+type resourceFile struct {
+	site.File
+	name string
+}
+
+func (f *resourceFile) Name() string {
+	return f.name
+}
+
+func NewDirResourceProvider(a *AlistSite) (*DirResourceProvider, error) {
+	sc := a.Config
+	numberRegexp := DefaultResourceNumberRegexp
+	if sc.ResourceNumberPattern != "" {
+		var err error
+		if numberRegexp, err = regexp.Compile(sc.ResourceNumberPattern); err != nil {
+			return nil, fmt.Errorf("invalid resource number pattern: %w", err)
+		}
+		if numberRegexp.SubexpIndex("number") == -1 {
+			return nil, fmt.Errorf("invalid resource number pattern: no number sub group")
+		}
+	}
+	maxDepth := sc.ResourceMaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DEFAULT_RESOURCE_MAX_DEPTH
+	}
+	refreshInterval := DEFAULT_RESOURCE_REFRESH_INTERVAL
+	if sc.ResourceRefreshInterval != "" {
+		var err error
+		if refreshInterval, err = time.ParseDuration(sc.ResourceRefreshInterval); err != nil {
+			return nil, fmt.Errorf("invalid resource refresh interval: %w", err)
+		}
+	}
+	var roots []string
+	for _, root := range sc.ResourceRoots {
+		roots = append(roots, path.Clean("/"+root))
+	}
+	return &DirResourceProvider{
+		site:            a,
+		roots:           roots,
+		numberRegexp:    numberRegexp,
+		maxDepth:        maxDepth,
+		refreshInterval: refreshInterval,
+	}, nil
+}
+
+func (p *DirResourceProvider) FindResourceFiles(id string) (files site.Files, err error) {
+	values, err := url.ParseQuery(id)
+	if err != nil {
+		return nil, fmt.Errorf("malformed id: %w", err)
+	}
+	dir := values.Get("path")
+	if dir == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+	err = p.walk(dir, func(file site.File, relpath string) {
+		if !file.IsDir() {
+			files = append(files, &resourceFile{File: file, name: relpath})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (p *DirResourceProvider) FindResources(qs string) (resources site.Resources, err error) {
+	query, err := url.ParseQuery(qs)
+	if err != nil {
+		return nil, fmt.Errorf("malformed qs: %w", err)
+	}
+	if full := query.Has("refresh"); full || !query.Has("cache") && p.refreshDue() {
+		if err := p.refresh(full); errors.Is(err, ErrPartialRefresh) {
+			log.Warnf("site %s: %v, results may be stale", p.site.Name, err)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to refresh resources: %w", err)
+		}
+	}
+	db := config.Db.Where("site = ?", p.site.Name)
+	if number := query.Get("number"); number != "" {
+		db = db.Where("number = ?", number)
+	}
+	if author := query.Get("author"); author != "" {
+		db = db.Where("author = ?", author)
+	}
+	for _, q := range query["q"] {
+		db = db.Where("title like ?", "%"+q+"%")
+	}
+	for _, order := range query["order"] {
+		field, desc := strings.CutPrefix(order, "-")
+		if !slices.Contains([]string{"number", "title", "author", "size", "modified", "path"}, field) {
+			return nil, fmt.Errorf("invalid order qs %q", order)
+		}
+		if desc {
+			field += " desc"
+		}
+		db = db.Order(field)
+	}
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit qs: not a valid int (err=%w)", err)
+		}
+		db = db.Limit(limit)
+	}
+	var records []*schema.DirResource
+	if result := db.Find(&records); result.Error != nil {
+		return nil, result.Error
+	}
+	for _, record := range records {
+		resources = append(resources, &DirResource{record: record})
+	}
+	return resources, nil
+}
+
+// Whether last successful refresh is older than refresh interval.
+func (p *DirResourceProvider) refreshDue() bool {
+	contents, err := os.ReadFile(p.refreshedFile())
+	if err != nil {
+		return true
+	}
+	refreshed := util.ParseInt(strings.TrimSpace(string(contents)), 0)
+	return time.Since(time.Unix(int64(refreshed), 0)) >= p.refreshInterval
+}
+
+func (p *DirResourceProvider) refreshedFile() string {
+	return filepath.Join(config.ConfigDir, p.site.Name, RESOURCES_REFRESHED_FILE)
+}
+
+// Crawl root dirs and update cached resources in db. If full is true, sizes of all dirs are re-calculated.
+// Cached resources that no longer exist in site are removed only if all roots are crawled successfully;
+// otherwise an ErrPartialRefresh error is returned.
+func (p *DirResourceProvider) refresh(full bool) (err error) {
+	var records []*schema.DirResource
+	if result := config.Db.Find(&records, "site = ?", p.site.Name); result.Error != nil {
+		return result.Error
+	}
+	cached := map[string]*schema.DirResource{}
+	for _, record := range records {
+		cached[record.Path] = record
+	}
+	seen := map[string]struct{}{}
+	updated := 0
+	errorCnt := 0
+	var crawl func(dir string, depth int)
+	crawl = func(dir string, depth int) {
+		files, err := p.site.listDir(dir)
+		if err != nil {
+			log.Warnf("Failed to list dir %q: %v", dir, err)
+			errorCnt++
+			return
+		}
+		for _, file := range files {
+			if !file.IsDir() {
+				continue
+			}
+			dirpath := path.Join(dir, file.Name())
+			number := p.numberRegexp.FindStringSubmatch(file.Name())
+			if number == nil {
+				if depth < p.maxDepth {
+					crawl(dirpath, depth+1)
+				}
+				continue
+			}
+			seen[dirpath] = struct{}{}
+			record := cached[dirpath]
+			if !full && record != nil && record.Modified == file.Time() {
+				continue
+			}
+			size, err := p.dirSize(dirpath)
+			if err != nil {
+				log.Warnf("Failed to get size of dir %q: %v", dirpath, err)
+				errorCnt++
+				continue
+			}
+			if record == nil {
+				record = &schema.DirResource{Site: p.site.Name, Path: dirpath}
+			}
+			record.Number = number[p.numberRegexp.SubexpIndex("number")]
+			record.Title, record.Author = parseDirname(file.Name(), record.Number)
+			record.Size = size
+			record.Modified = file.Time()
+			if result := config.Db.Save(record); result.Error != nil {
+				log.Warnf("Failed to save resource %q: %v", dirpath, result.Error)
+				errorCnt++
+				continue
+			}
+			updated++
+		}
+	}
+	for _, root := range p.roots {
+		crawl(root, 0)
+	}
+	log.Tracef("site %s resources refreshed: %d updated, %d errors", p.site.Name, updated, errorCnt)
+	if errorCnt > 0 {
+		return fmt.Errorf("%w: %d errors", ErrPartialRefresh, errorCnt)
+	}
+	var staleIds []uint
+	for _, record := range records {
+		if _, ok := seen[record.Path]; !ok {
+			staleIds = append(staleIds, record.ID)
+		}
+	}
+	if len(staleIds) > 0 {
+		if result := config.Db.Delete(&schema.DirResource{}, staleIds); result.Error != nil {
+			return result.Error
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p.refreshedFile()), 0700); err != nil {
+		return err
+	}
+	return atomic.WriteFile(p.refreshedFile(), strings.NewReader(fmt.Sprint(time.Now().Unix())))
+}
+
+// Return sum size of all files inside dir.
+func (p *DirResourceProvider) dirSize(dir string) (size int64, err error) {
+	err = p.walk(dir, func(file site.File, relpath string) {
+		if !file.IsDir() {
+			size += file.Size()
+		}
+	})
+	return
+}
+
+// Recursively walk all files inside dir. relpath is the "/" separated path of file relative to dir.
+func (p *DirResourceProvider) walk(dir string, fn func(file site.File, relpath string)) error {
+	var walk func(dir, reldir string) error
+	walk = func(dir, reldir string) error {
+		files, err := p.site.listDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			relpath := path.Join(reldir, file.Name())
+			fn(file, relpath)
+			if file.IsDir() {
+				if err := walk(path.Join(dir, file.Name()), relpath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(dir, "")
+}
+
+// Parse title and author from a resource dir name.
+// "[RJ123456][author]title" => (title, author); "RJ123456 title" => (title, "").
+func parseDirname(name string, number string) (title string, author string) {
+	if m := canonicalDirnameRegexp.FindStringSubmatch(name); m != nil &&
+		m[canonicalDirnameRegexp.SubexpIndex("number")] == number {
+		return strings.TrimSpace(m[canonicalDirnameRegexp.SubexpIndex("title")]),
+			strings.TrimSpace(m[canonicalDirnameRegexp.SubexpIndex("author")])
+	}
+	for _, str := range []string{"[" + number + "]", "【" + number + "】", "(" + number + ")", number} {
+		if strings.Contains(name, str) {
+			name = strings.Replace(name, str, " ", 1)
+			break
+		}
+	}
+	title = strings.Trim(name, " _-　")
+	if title == "" {
+		title = number
+	}
+	return util.CleanBasenameComponent(title), ""
+}
+
+// List all files of a dir, fetch all pages. Cached responses are not used.
+func (a *AlistSite) listDir(dir string) (files site.Files, err error) {
+	for page := 1; ; page++ {
+		params := url.Values{}
+		params.Set("path", dir)
+		params.Set("page", fmt.Sprint(page))
+		params.Set("per_page", fmt.Sprint(LIST_PER_PAGE))
+		pageFiles, err := a.fsList(params, noCacheApiOptions)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, pageFiles...)
+		if len(pageFiles) < LIST_PER_PAGE {
+			break
+		}
+	}
+	return files, nil
+}
+
+var _ site.ResourceProvider = (*DirResourceProvider)(nil)
+var _ site.Resource = (*DirResource)(nil)
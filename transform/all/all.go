@@ -2,6 +2,7 @@ package all
 
 import (
 	_ "github.com/sagan/erodownloader/transform"
+	_ "github.com/sagan/erodownloader/transform/audiotag"
 	_ "github.com/sagan/erodownloader/transform/clean"
 	_ "github.com/sagan/erodownloader/transform/correctext"
 	_ "github.com/sagan/erodownloader/transform/decensorship"
@@ -0,0 +1,103 @@
+package audiotag
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sagan/erodownloader/scraper"
+	"github.com/sagan/erodownloader/transform"
+	"github.com/sagan/erodownloader/transform/executor"
+	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/stringutil"
+	"github.com/sagan/erodownloader/util/tagutil"
+)
+
+var Exts = []string{".flac", ".mp3"}
+
+// Cover images that could be embedded, in order of preference. Webp is not supported by most players.
+var coverFiles = []string{scraper.COVER + ".jpg", scraper.COVER + ".jpeg", scraper.COVER + ".png", scraper.FOLDER_IMAGE}
+
+// 将 metadata.nfo 中的元数据写入 flac / mp3 文件的标签。
+// album: title; album artist: author; artist: narrators (fallback to author); genre: tags.
+// Track number is the index of file among the same type audio files of it's dir (in natural order).
+// Original files are always backed up. Files of unsupported tag formats are skipped.
+func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
+	metafile := filepath.Join(tc.Dir, scraper.METAFILE)
+	if !util.FileExists(metafile) {
+		tc.Log("%s not found, skip", scraper.METAFILE)
+		return false, nil
+	}
+	metadata, err := scraper.ReadMetadata(metafile)
+	if err != nil {
+		return false, err
+	}
+	tags := &tagutil.Tags{
+		Album:       metadata.Title,
+		AlbumArtist: metadata.Author,
+		Artists:     metadata.Narrator,
+		Genres:      metadata.Tags,
+		Date:        metadata.Date,
+	}
+	if len(tags.Artists) == 0 && metadata.Author != "" {
+		tags.Artists = []string{metadata.Author}
+	}
+	for _, cover := range coverFiles {
+		if cover = filepath.Join(tc.Dir, cover); util.FileExists(cover) {
+			if tags.Cover, err = tagutil.ReadPicture(cover); err != nil {
+				tc.Log("Failed to read cover %q: %v", cover, err)
+				tags.Cover = nil
+				continue
+			}
+			break
+		}
+	}
+	executorOptions := &executor.ExecutorOptions{
+		Func: func(inputFile, outputFile string, options url.Values, logger transform.Logger) (bool, error) {
+			fileTags := *tags
+			fileTags.Title = strings.TrimSuffix(filepath.Base(inputFile), filepath.Ext(inputFile))
+			fileTags.TrackNumber, fileTags.TrackTotal = getTrack(inputFile)
+			changed, err := tagutil.Write(inputFile, outputFile, &fileTags)
+			// files with tags that can not be written (e.g. ID3v2.2, unsynchronisation) are left as is.
+			if errors.Is(err, tagutil.ErrUnsupported) {
+				logger("Skip %q: %v", inputFile, err)
+				return false, nil
+			}
+			return changed, err
+		},
+		Test: func(path string) bool {
+			return slices.Contains(Exts, strings.ToLower(filepath.Ext(path)))
+		},
+		Backup: true,
+	}
+	return executorOptions.Transformer(tc)
+}
+
+// Return the 1-based index of file among files of the same ext in it's dir, and the count of these files.
+func getTrack(filename string) (number int, total int) {
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return 0, 0
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") &&
+			strings.ToLower(filepath.Ext(entry.Name())) == ext {
+			files = append(files, entry.Name())
+		}
+	}
+	slices.SortFunc(files, stringutil.NaturalCompare)
+	return slices.Index(files, filepath.Base(filename)) + 1, len(files)
+}
+
+func init() {
+	transform.Register(&transform.Transformer{
+		Name:    "audiotag",
+		Action:  Transformer,
+		Options: executor.CommonOptions,
+	})
+}
@@ -0,0 +1,186 @@
+// Classify content dir into a content type ("audio", "cg" or "game"),
+// which selects the normalize pipeline profile of the same name.
+package classify
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/scraper"
+	"github.com/sagan/erodownloader/transform"
+	"github.com/sagan/erodownloader/transform/decompress"
+	"github.com/sagan/erodownloader/util"
+)
+
+const (
+	TYPE_AUDIO = "audio"
+	TYPE_CG    = "cg"
+	TYPE_GAME  = "game"
+)
+
+var Types = []string{TYPE_AUDIO, TYPE_CG, TYPE_GAME}
+
+var AudioExts = []string{".wav", ".flac", ".mp3", ".m4a", ".aac", ".ogg", ".opus", ".ape", ".wma", ".tta", ".dsf"}
+
+var ImageExts = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".avif", ".jxl"}
+
+// Files of game engines (RPG Maker, Wolf RPG, KiriKiri, Unity...). Lowercase.
+var GameExts = []string{".rgss3a", ".rgss2a", ".rgssad", ".wolf", ".xp3", ".ypf"}
+
+// Disc images, which are usually games, but could also be CDs of audio or images. Lowercase.
+var DiscImageExts = []string{".iso", ".mdf", ".mds"}
+var GameFilenames = []string{"game.exe", "game.ini", "data.wolf", "package.nw", "unityplayer.dll", "nw.dll"}
+
+// Metadata tags of each type, checked in order. Tags of the work type (e.g. dlsite "ボイス・ASMR") go first.
+var TypeTags = []struct {
+	Type string
+	Tags []string
+}{
+	{TYPE_AUDIO, []string{scraper.TAG_VOICEASMR, "音楽", "音声作品"}},
+	{TYPE_GAME, []string{"ゲーム", "アドベンチャー", "ロールプレイング", "アクション", "パズル", "テーブルゲーム", "Game"}},
+	{TYPE_CG, []string{"CG・イラスト", "マンガ", "劇画", "画像", "CG集"}},
+}
+
+// Keywords of dir or archive names, checked in order. See also decompress.NoDecompressFilenamePatterns.
+// \b is ASCII only in Go regexp, so it's only used around latin keywords; CJK keywords match anywhere.
+var TypeNamePatterns = []struct {
+	Type    string
+	Pattern *regexp.Regexp
+}{
+	{TYPE_CG, regexp.MustCompile(`(?i)\b(Game CG|CG|Comic|Scan)\b|` +
+		`(同人CG集|ゲームCG|CG集|成年コミック|コミック|同人誌|漫画|マンガ|まんが)`)},
+	{TYPE_GAME, regexp.MustCompile(`(?i)\b(Game|iso|mdf)\b|(ゲーム|パッケージ版)`)},
+	{TYPE_AUDIO, regexp.MustCompile(`(?i)\b(ASMR|Voice|Binaural|OST)\b|(音声|ボイス|バイノーラル|ドラマCD|サウンドトラック)`)},
+}
+
+type Result struct {
+	Type   string // empty if unknown
+	Reason string
+}
+
+func (r *Result) String() string {
+	if r.Type == "" {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s (%s)", r.Type, r.Reason)
+}
+
+// Classify dir. metadata is the scraped metadata of dir; if it's nil, it's read from metadata.nfo of dir (if exists).
+// In order, it checks: content type and tags of metadata; game files, disc images (unless audio and image files
+// are larger), audio and image files (by total size) in dir and archives at the root of dir;
+// keywords of dir and archive names.
+// options are transformer options, where "sevenzip_binary" is used to list non-zip archives.
+func Classify(dir string, metadata *scraper.Metadata, options url.Values) *Result {
+	if metadata == nil {
+		metadata, _ = scraper.ReadMetadata(filepath.Join(dir, scraper.METAFILE))
+	}
+	if metadata != nil {
+		if slices.Contains(Types, metadata.ContentType) {
+			return &Result{metadata.ContentType, "metadata content type"}
+		}
+		for _, typeTags := range TypeTags {
+			for _, tag := range metadata.Tags {
+				if slices.Contains(typeTags.Tags, tag) {
+					return &Result{typeTags.Type, fmt.Sprintf("metadata tag %q", tag)}
+				}
+			}
+		}
+	}
+
+	names := []string{filepath.Base(dir)}
+	var audioSize, imageSize, discSize int64
+	audioCnt, imageCnt := 0, 0
+	gameFile, discFile := "", ""
+	add := func(name string, size int64) {
+		ext := strings.ToLower(filepath.Ext(name))
+		switch {
+		case slices.Contains(GameExts, ext) || slices.Contains(GameFilenames, strings.ToLower(filepath.Base(name))):
+			if gameFile == "" {
+				gameFile = name
+			}
+		case slices.Contains(DiscImageExts, ext):
+			if discFile == "" {
+				discFile = name
+			}
+			discSize += size
+		case slices.Contains(AudioExts, ext):
+			audioCnt++
+			audioSize += size
+		case slices.Contains(ImageExts, ext):
+			imageCnt++
+			imageSize += size
+		}
+	}
+	tc := &transform.TransformerContext{Dir: dir, Options: options}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if filepath.Dir(path) == dir && decompress.IsArchive(d.Name()) {
+			names = append(names, d.Name())
+			for _, entry := range listArchive(tc, path) {
+				add(entry.Name, entry.Size)
+			}
+		}
+		add(path, info.Size())
+		return nil
+	})
+	relpath := func(name string) string {
+		if rel, err := filepath.Rel(dir, name); err == nil {
+			return filepath.ToSlash(rel)
+		}
+		return name
+	}
+	if gameFile != "" {
+		return &Result{TYPE_GAME, fmt.Sprintf("game file %q", relpath(gameFile))}
+	}
+	if discFile != "" && discSize >= audioSize+imageSize {
+		return &Result{TYPE_GAME, fmt.Sprintf("disc image %q", relpath(discFile))}
+	}
+	if audioSize > 0 && audioSize >= imageSize {
+		return &Result{TYPE_AUDIO, fmt.Sprintf("%d audio files (%s)", audioCnt, util.BytesSize(float64(audioSize)))}
+	}
+	if imageSize > 0 {
+		return &Result{TYPE_CG, fmt.Sprintf("%d image files (%s)", imageCnt, util.BytesSize(float64(imageSize)))}
+	}
+
+	for _, typePattern := range TypeNamePatterns {
+		for _, name := range names {
+			if m := typePattern.Pattern.FindString(name); m != "" {
+				return &Result{typePattern.Type, fmt.Sprintf("name keyword %q", m)}
+			}
+		}
+	}
+	return &Result{}
+}
+
+// Return entries of archive file. Errors (e.g. encrypted archive) are ignored.
+func listArchive(tc *transform.TransformerContext, path string) []*decompress.ArchiveEntry {
+	var entries []*decompress.ArchiveEntry
+	if filepath.Ext(path) == decompress.EXT_ZIP {
+		mode := util.ParseInt(tc.Options.Get("zipmode"), config.DEFAULT_ZIPMODE)
+		entries, _ = decompress.ListZip(path, mode, tc.Log)
+	} else if tc.Options.Has("sevenzip_binary") {
+		entries, _ = decompress.List7z(tc, tc.Options.Get("sevenzip_binary"), path, tc.Options["password"])
+	}
+	return entries
+}
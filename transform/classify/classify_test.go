@@ -0,0 +1,33 @@
+package classify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassifyName(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"【同人ゲーム】bar", TYPE_GAME},
+		{"RJ123 音声作品", TYPE_AUDIO},
+		{"ボイス", TYPE_AUDIO},
+		{"[ゲームCG] foo", TYPE_CG},
+		{"foo (ASMR)", TYPE_AUDIO},
+		{"foo Game", TYPE_GAME},
+		{"Gamers", ""},
+		{"bar", ""},
+	}
+	root := t.TempDir()
+	for _, c := range cases {
+		dir := filepath.Join(root, c.name)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if got := Classify(dir, nil, nil); got.Type != c.want {
+			t.Errorf("Classify(%q) = %s, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -2,13 +2,11 @@ package clean
 
 import (
 	"io/fs"
-	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 
 	"github.com/sagan/erodownloader/transform"
-	"github.com/sagan/erodownloader/util"
 )
 
 var tmpfiles = []string{
@@ -19,7 +17,7 @@ var tmpfiles = []string{
 
 // 删除临时文件。例如: Desktop.ini 等。
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
-	err = filepath.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
+	err = tc.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -42,12 +40,12 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		if slices.Contains(tmpfiles, basename) {
 			changed = true
 			tc.Log("Remove %s", path)
-			return os.Remove(path)
+			return tc.Remove(path)
 		}
-		if ext == ".aria2" && !util.FileExists(path[:len(path)-len(ext)]) {
+		if ext == ".aria2" && !tc.Exists(path[:len(path)-len(ext)]) {
 			changed = true
 			tc.Log("Remove alone %s", path)
-			return os.Remove(path)
+			return tc.Remove(path)
 		}
 		return nil
 	})
@@ -0,0 +1,116 @@
+package transform
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/sagan/erodownloader/util"
+)
+
+// Resource limits of external binaries executed by transformers.
+// Each of them is read from "<name>_<key>" option, falling back to "binary_<key>" option,
+// where name is the binary name (e.g. "flac", "sevenzip") and key is "timeout", "nice", "ionice" or "memory".
+// E.g. "flac_timeout=30m", "binary_nice=10", "binary_ionice=idle", "binary_memory=2GiB".
+type CommandLimits struct {
+	Timeout time.Duration // 0: unlimited
+	Nice    int           // niceness (-20 - 19). 0: unchanged
+	Ionice  int           // io scheduling class (IOPRIO_CLASS_*): 1 realtime, 2 best-effort, 3 idle. 0: unchanged
+	Memory  int64         // max virtual memory (RLIMIT_AS) in bytes. 0: unlimited
+}
+
+// Io scheduling classes of "ionice" option.
+var IoniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+var (
+	ErrTimeout  = fmt.Errorf("binary execution timeout")
+	ErrCanceled = fmt.Errorf("transforms canceled")
+)
+
+// Return limits of binary name, parsed from options.
+func (tc *TransformerContext) Limits(name string) (limits *CommandLimits, err error) {
+	get := func(key string) string {
+		if value := tc.Options.Get(name + "_" + key); value != "" {
+			return value
+		}
+		return tc.Options.Get("binary_" + key)
+	}
+	limits = &CommandLimits{}
+	if value := get("timeout"); value != "" && value != "0" {
+		if limits.Timeout, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid %s timeout %q: %w", name, value, err)
+		}
+	}
+	if value := get("nice"); value != "" {
+		limits.Nice = util.ParseInt(value, 0)
+		if limits.Nice < -20 || limits.Nice > 19 {
+			return nil, fmt.Errorf("invalid %s nice %q", name, value)
+		}
+	}
+	if value := get("ionice"); value != "" {
+		if limits.Ionice = IoniceClasses[value]; limits.Ionice == 0 {
+			return nil, fmt.Errorf("invalid %s ionice %q", name, value)
+		}
+	}
+	if value := get("memory"); value != "" && value != "0" {
+		if limits.Memory, err = util.RAMInBytes(value); err != nil {
+			return nil, fmt.Errorf("invalid %s memory %q: %w", name, value, err)
+		}
+	}
+	return limits, nil
+}
+
+// Execute external binary with limits of name (see CommandLimits) and return its combined output.
+// The stdin of binary is closed (reads from null device), so it fails instead of hanging on a prompt.
+// If timeout or transforms are canceled, the binary (with all it's child processes) is killed
+// and ErrTimeout / ErrCanceled is returned.
+func (tc *TransformerContext) Exec(name string, binary string, args ...string) (output []byte, err error) {
+	limits, err := tc.Limits(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx := tc.Context()
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	buf := &bytes.Buffer{}
+	binary, args, remaining := wrapCommand(binary, args, limits)
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdin = nil
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+	cmd.WaitDelay = 10 * time.Second
+	setupCmd(cmd)
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	if err := applyLimits(cmd.Process.Pid, remaining); err != nil {
+		tc.Log("! failed to apply limits to %s: %v", name, err)
+	}
+	err = cmd.Wait()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if errors.Is(ctxErr, context.DeadlineExceeded) && tc.Context().Err() == nil {
+			err = fmt.Errorf("%w: %s killed after %s", ErrTimeout, name, limits.Timeout)
+		} else {
+			err = fmt.Errorf("%w: %s killed", ErrCanceled, name)
+		}
+	}
+	return buf.Bytes(), err
+}
+
+// Return the context of transforms, which is done when transforms are canceled.
+func (tc *TransformerContext) Context() context.Context {
+	if tc.ctx == nil {
+		return context.Background()
+	}
+	return tc.ctx
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package transform
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const IOPRIO_CLASS_SHIFT = 13
+
+// Run binary in a new process group, so that all it's child processes are killed on cancel.
+func setupCmd(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// Wrap binary with "prlimit", "ionice" and "nice" commands of util-linux & coreutils,
+// so that limits are applied before binary is executed. Return the wrapped command and the limits
+// that can not be applied this way because the wrapper is not found, which should be applied by applyLimits.
+func wrapCommand(binary string, args []string, limits *CommandLimits) (string, []string, *CommandLimits) {
+	remaining := *limits
+	cmdline := append([]string{binary}, args...)
+	if limits.Nice != 0 {
+		if nice, err := exec.LookPath("nice"); err == nil {
+			cmdline = append([]string{nice, "-n", strconv.Itoa(limits.Nice), "--"}, cmdline...)
+			remaining.Nice = 0
+		}
+	}
+	if limits.Ionice != 0 {
+		if ionice, err := exec.LookPath("ionice"); err == nil {
+			cmdline = append([]string{ionice, "-c", strconv.Itoa(limits.Ionice), "--"}, cmdline...)
+			remaining.Ionice = 0
+		}
+	}
+	if limits.Memory > 0 {
+		if prlimit, err := exec.LookPath("prlimit"); err == nil {
+			cmdline = append([]string{prlimit, "--as=" + strconv.FormatInt(limits.Memory, 10), "--"}, cmdline...)
+			remaining.Memory = 0
+		}
+	}
+	return cmdline[0], cmdline[1:], &remaining
+}
+
+// Apply limits to a just started process, if the wrappers (see wrapCommand) are not available.
+// Child processes created later inherit them.
+func applyLimits(pid int, limits *CommandLimits) (err error) {
+	if limits.Nice != 0 {
+		if e := unix.Setpriority(unix.PRIO_PROCESS, pid, limits.Nice); e != nil {
+			err = errors.Join(err, e)
+		}
+	}
+	if limits.Ionice != 0 {
+		// ioprio_set(IOPRIO_WHO_PROCESS, pid, class << 13 | level). level 4 is the default one, ignored by idle class
+		prio := limits.Ionice<<IOPRIO_CLASS_SHIFT | 4
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, 1, uintptr(pid), uintptr(prio)); errno != 0 {
+			err = errors.Join(err, errno)
+		}
+	}
+	if limits.Memory > 0 {
+		rlimit := &unix.Rlimit{Cur: uint64(limits.Memory), Max: uint64(limits.Memory)}
+		if e := unix.Prlimit(pid, unix.RLIMIT_AS, rlimit, nil); e != nil {
+			err = errors.Join(err, e)
+		}
+	}
+	return err
+}
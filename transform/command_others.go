@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package transform
+
+import (
+	"os/exec"
+)
+
+func setupCmd(cmd *exec.Cmd) {
+}
+
+func wrapCommand(binary string, args []string, limits *CommandLimits) (string, []string, *CommandLimits) {
+	return binary, args, limits
+}
+
+// Priority and memory limits are only supported on Linux.
+func applyLimits(pid int, limits *CommandLimits) error {
+	return nil
+}
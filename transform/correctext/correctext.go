@@ -2,18 +2,14 @@ package correctext
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 
 	"github.com/h2non/filetype"
-	"github.com/natefinch/atomic"
 
 	"github.com/sagan/erodownloader/constants"
 	"github.com/sagan/erodownloader/transform"
-	"github.com/sagan/erodownloader/util"
-	"github.com/sagan/erodownloader/util/helper"
 	"github.com/sagan/erodownloader/util/stringutil"
 )
 
@@ -21,7 +17,7 @@ const HEADER_SIZE = 512 * 1024 // 512KiB
 
 // 根据 magic number 检测文件类型，将部分文件扩展名纠正为正确的。
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
-	entries, err := os.ReadDir(tc.Dir)
+	entries, err := tc.ReadDir(tc.Dir)
 	if err != nil {
 		return
 	}
@@ -37,7 +33,7 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		if stringutil.HasAnySuffix(entry.Name(), exts...) {
 			var header []byte
 			fullpath := filepath.Join(tc.Dir, entry.Name())
-			header, err = helper.ReadFileHeader(fullpath, HEADER_SIZE)
+			header, err = tc.ReadFileHeader(fullpath, HEADER_SIZE)
 			if err != nil {
 				return
 			}
@@ -53,12 +49,12 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 				continue
 			}
 			newpath := filepath.Join(tc.Dir, base+newext)
-			if util.FileExists(newpath) {
+			if tc.Exists(newpath) {
 				err = fmt.Errorf("failed to rename %q => %q: target already exists", fullpath, newpath)
 				return
 			}
 			changed = true
-			if err = atomic.ReplaceFile(fullpath, newpath); err != nil {
+			if err = tc.Rename(fullpath, newpath); err != nil {
 				err = fmt.Errorf("failed to rename %q => %q: %w", fullpath, newpath, err)
 				return
 			}
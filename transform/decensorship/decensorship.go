@@ -7,10 +7,7 @@ import (
 	"runtime"
 	"strings"
 
-	"github.com/natefinch/atomic"
-
 	"github.com/sagan/erodownloader/transform"
-	"github.com/sagan/erodownloader/util"
 )
 
 var extMapper = map[string]string{
@@ -23,7 +20,7 @@ var extMapper = map[string]string{
 // 例如将后缀由 .rar 改为 .r_a_r 之类以防止在线解压。或将 .mp4 改为 .mp42 以防止在线播放。
 // 同时会将文件名的扩展名改为全小写。
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
-	err = filepath.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
+	err = tc.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -52,11 +49,11 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		newpath := path[:len(path)-len(ext)] + newext
 		tc.Log("rename %s to %s", path, newpath)
 		// Windows fs 读取文件名不区分大小写，但写入时区分。
-		if (runtime.GOOS != "windows" || !strings.EqualFold(path, newpath)) && util.FileExists(newpath) {
+		if (runtime.GOOS != "windows" || !strings.EqualFold(path, newpath)) && tc.Exists(newpath) {
 			return fmt.Errorf("target file already exists")
 		}
 		changed = true
-		return atomic.ReplaceFile(path, newpath)
+		return tc.Rename(path, newpath)
 	})
 	return
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -74,19 +73,90 @@ var NoDecompressFilenamePatterns = []*regexp.Regexp{
 		`)\b`),
 }
 
+// An archive file set in a dir: a single archive file, or all volumes of a multi-volume archive.
+type archiveSet struct {
+	inputFile string   // "foo.rar" or "foo.part1.rar".
+	format    string   // ".rar" or ".zip". Empty for single exe file, which may be a self-extracting rar.
+	prefix    string   // 分卷压缩包的共同前缀。"foo.part1.rar" => "foo"
+	files     []string // all files of set, inputFile first.
+}
+
+// Return the set of which inputFile is the major archive file.
+func newArchiveSet(inputFile string) *archiveSet {
+	set := &archiveSet{inputFile: inputFile, files: []string{inputFile}}
+	ext := path.Ext(inputFile)
+	if ext == EXT_RAR || ext == EXT_EXE {
+		if m := rarPartedRegex.FindStringSubmatch(inputFile); m != nil {
+			set.prefix = m[rarPartedRegex.SubexpIndex("prefix")]
+			set.format = EXT_RAR
+		} else {
+			set.prefix = inputFile[:len(inputFile)-len(ext)]
+		}
+	} else if strings.HasSuffix(inputFile, EXT_7Z_001) {
+		set.prefix = strings.TrimSuffix(inputFile, EXT_7Z_001)
+	} else {
+		set.prefix = inputFile[:len(inputFile)-len(ext)]
+	}
+	if ext == EXT_R00 {
+		set.format = EXT_RAR
+	} else if strings.HasSuffix(inputFile, EXT_7Z_001) {
+		set.format = EXT_7Z
+	} else if ext != EXT_EXE {
+		// for exe (self-extracting, e.g. "foo.part1.exe" + "foo.part2.rar"), scan additional file for format.
+		set.format = ext
+	}
+	return set
+}
+
+// Whether filename is another volume of set.
+func (set *archiveSet) isVolume(filename string) bool {
+	if set.prefix == "" || !strings.HasPrefix(filename, set.prefix+".") {
+		return false
+	}
+	suffix := filename[len(set.prefix):]
+	if set.format == EXT_RAR {
+		return rarMultiVolumeLegacyExtRegex.MatchString(suffix) || rarPartedExtRegex.MatchString(suffix)
+	} else if set.format == EXT_ZIP {
+		return zipMultiVolumeExtRegex.MatchString(suffix)
+	} else if strings.HasSuffix(set.inputFile, EXT_7Z_001) {
+		return sevenzipMultiVolumeExtRegex.MatchString(suffix)
+	}
+	return false
+}
+
+// Whether archive filename should not be decompressed, see NoDecompressFilenames.
+func noDecompress(filename string) bool {
+	return slices.ContainsFunc(NoDecompressFilenames, func(name string) bool {
+		return strings.Contains(strings.ToLower(filename), name)
+	}) || slices.ContainsFunc(NoDecompressFilenamePatterns, func(pattern *regexp.Regexp) bool {
+		return pattern.MatchString(filename)
+	})
+}
+
 // decompress rar / zip / 7z files
 // All files in input dir must belongs to the same compress file.
 // E.g. "foo.zip", or "foo.part1.rar" + "foo.part2.rar".
 // 根目录下的压缩文件必须被解压缩（除非压缩文件文件名含有特定字符串），否则会返回错误。
+// If "recursive" option is "1" and dir is not comprised of single archive,
+// archives anywhere in the tree are extracted instead, see decompressTree.
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
-	entries, err := os.ReadDir(tc.Dir)
+	changed, err = decompressDir(tc)
+	if changed || tc.Options.Get("recursive") != "1" || err != nil && err != transform.ErrInvalid {
+		return
+	}
+	return decompressTree(tc)
+}
+
+// Decompress dir that is comprised of single archive (set) into dir.
+func decompressDir(tc *transform.TransformerContext) (changed bool, err error) {
+	entries, err := tc.ReadDir(tc.Dir)
 	if err != nil {
 		return
 	}
 	// archive files first
 	slices.SortStableFunc(entries, func(a, b fs.DirEntry) int {
-		aIsArchive := isArchive(a.Name())
-		bIsArchive := isArchive(b.Name())
+		aIsArchive := IsArchive(a.Name())
+		bIsArchive := IsArchive(b.Name())
 		if aIsArchive && !bIsArchive {
 			return -1
 		} else if !aIsArchive && bIsArchive {
@@ -94,10 +164,7 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		}
 		return 0
 	})
-	inputFile := "" // "foo.rar" or "foo.part1.rar".
-	format := ""    // ".rar" or ".zip"
-	prefix := ""    // 分卷压缩包的共同前缀。"foo.part1.rar" => "foo"
-	var originalFiles []string
+	var set *archiveSet
 	for _, entry := range entries {
 		if util.First(pathspec.GitIgnore(transform.IgnoredFilePatterns, entry.Name())) {
 			continue
@@ -106,80 +173,35 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 			tc.Log(STR_STOP_NOT_EMPTY)
 			return
 		}
-		if inputFile == "" {
-			inputFile = entry.Name()
-			ext := path.Ext(inputFile)
-			if !isArchive(inputFile) {
+		if set == nil {
+			if !IsArchive(entry.Name()) {
 				tc.Log(STR_STOP_NOT_EMPTY)
 				return
 			}
-			if slices.ContainsFunc(NoDecompressFilenames, func(name string) bool {
-				return strings.Contains(strings.ToLower(inputFile), name)
-			}) || slices.ContainsFunc(NoDecompressFilenamePatterns, func(pattern *regexp.Regexp) bool {
-				return pattern.MatchString(inputFile)
-			}) {
+			if noDecompress(entry.Name()) {
 				tc.Log(STR_FILES_ARCHIVE)
 				return
 			}
-			if ext == EXT_RAR || ext == EXT_EXE {
-				if m := rarPartedRegex.FindStringSubmatch(inputFile); m != nil {
-					prefix = m[rarPartedRegex.SubexpIndex("prefix")]
-					format = EXT_RAR
-				} else {
-					prefix = inputFile[:len(inputFile)-len(ext)]
-				}
-			} else if strings.HasSuffix(inputFile, EXT_7Z_001) {
-				prefix = strings.TrimSuffix(inputFile, EXT_7Z_001)
-			} else {
-				prefix = inputFile[:len(inputFile)-len(ext)]
-			}
-			if ext == EXT_R00 {
-				format = EXT_RAR
-			} else if strings.HasSuffix(inputFile, EXT_7Z_001) {
-				format = EXT_7Z
-			} else if ext != EXT_EXE {
-				// for exe (self-extracting, e.g. "foo.part1.exe" + "foo.part2.rar"), scan additional file for format.
-				format = ext
-			}
-			originalFiles = append(originalFiles, inputFile)
-		} else if prefix == "" || !strings.HasPrefix(entry.Name(), prefix+".") {
+			set = newArchiveSet(entry.Name())
+		} else if !set.isVolume(entry.Name()) {
 			err = transform.ErrInvalid
 			return
 		} else {
-			suffix := entry.Name()[len(prefix):]
-			if format == EXT_RAR {
-				if !rarMultiVolumeLegacyExtRegex.MatchString(suffix) && !rarPartedExtRegex.MatchString(suffix) {
-					err = transform.ErrInvalid
-					return
-				}
-			} else if format == EXT_ZIP {
-				if !zipMultiVolumeExtRegex.MatchString(suffix) {
-					err = transform.ErrInvalid
-					return
-				}
-			} else if strings.HasSuffix(inputFile, EXT_7Z_001) {
-				if !sevenzipMultiVolumeExtRegex.MatchString(suffix) {
-					err = transform.ErrInvalid
-					return
-				}
-			} else {
-				err = transform.ErrInvalid
-				return
-			}
-			originalFiles = append(originalFiles, entry.Name())
+			set.files = append(set.files, entry.Name())
 		}
 	}
-	// try treating single exe file as self-extracting rar.
-	if inputFile != "" && strings.HasSuffix(inputFile, EXT_EXE) && format == "" {
-		format = EXT_RAR
-	}
-	if inputFile == "" || format == "" {
+	if set == nil {
 		tc.Log("no files to process")
 		return
 	}
+	// try treating single exe file as self-extracting rar.
+	if strings.HasSuffix(set.inputFile, EXT_EXE) && set.format == "" {
+		set.format = EXT_RAR
+	}
+	inputFile, format, originalFiles := set.inputFile, set.format, set.files
 
 	origdir := filepath.Join(tc.Dir, constants.ORIG_DIR)
-	if util.FileExists(origdir) {
+	if !tc.DryRun() && util.FileExists(origdir) {
 		entries, err = os.ReadDir(origdir)
 		if err != nil || len(entries) > 0 {
 			tc.Log("Folder is in inconsistent state: the .orig folder exists and can not be safely cleaned (%v)", err)
@@ -193,8 +215,8 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		newFile := inputFile[:len(inputFile)-len(EXT_EXE)] + EXT_RAR
 		tc.Log("Rename %q to %q", inputFile, newFile)
 		changed = true
-		if util.FileExists(newFile) ||
-			atomic.ReplaceFile(filepath.Join(tc.Dir, inputFile), filepath.Join(tc.Dir, newFile)) != nil {
+		if tc.Exists(filepath.Join(tc.Dir, newFile)) ||
+			tc.Rename(filepath.Join(tc.Dir, inputFile), filepath.Join(tc.Dir, newFile)) != nil {
 			tc.Log("unable to rename .exe to .rar, abort")
 			return
 		}
@@ -203,6 +225,12 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		}
 		inputFile = newFile
 	}
+	if tc.DryRun() {
+		if err = planExtract(tc, tc.Dir, inputFile, format, originalFiles, ""); err != nil {
+			return
+		}
+		return true, nil
+	}
 
 	tmpdir := filepath.Join(tc.Dir, transform.TMP_DIR)
 	if err = util.MakeCleanTmpDir(tmpdir); err != nil {
@@ -210,7 +238,47 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		return
 	}
 	defer os.RemoveAll(tmpdir)
-	inputFilePath := filepath.Join(tc.Dir, inputFile)
+	if err = extract(tc, filepath.Join(tc.Dir, inputFile), format, tmpdir); err != nil {
+		return
+	}
+	changed = true
+	if err = util.MakeCleanTmpDir(origdir); err != nil {
+		return
+	}
+	for _, file := range originalFiles {
+		tc.Log("move original %s => %s", filepath.Join(tc.Dir, file), filepath.Join(origdir, file))
+		if err = atomic.ReplaceFile(filepath.Join(tc.Dir, file), filepath.Join(origdir, file)); err != nil {
+			return
+		}
+	}
+	contentDir, contentFiles, err := extractedContents(tc, tmpdir)
+	if err != nil {
+		return
+	}
+	for _, file := range contentFiles {
+		if err = atomic.ReplaceFile(filepath.Join(contentDir, file.Name()),
+			filepath.Join(tc.Dir, file.Name())); err != nil {
+			return
+		}
+		if err = tc.Created(filepath.Join(tc.Dir, file.Name())); err != nil {
+			return
+		}
+	}
+	for _, file := range originalFiles {
+		backup := helper.GetNewFilePath(tc.BackupDir, file)
+		if err = atomic.ReplaceFile(filepath.Join(origdir, file), backup); err != nil {
+			return
+		}
+		if err = tc.Journal(transform.OP_BACKUP, filepath.Join(tc.Dir, file), "", backup); err != nil {
+			return
+		}
+	}
+	os.RemoveAll(origdir)
+	return
+}
+
+// Extract archive inputFilePath to tmpdir, which must be an empty dir.
+func extract(tc *transform.TransformerContext, inputFilePath string, format string, tmpdir string) (err error) {
 	tc.Log("Extracting %q to %s", inputFilePath, tmpdir)
 	switch format {
 	case EXT_ZIP:
@@ -241,9 +309,8 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 					args = append(args, "-p"+password)
 				}
 				args = append(args, inputFilePath)
-				cmd := exec.Command(tc.Options.Get("sevenzip_binary"), args...)
 				var output []byte
-				output, err = cmd.CombinedOutput()
+				output, err = tc.Exec("sevenzip", tc.Options.Get("sevenzip_binary"), args...)
 				if err != nil {
 					tc.Log("7z %v failed: %v. output=%s", args, err, string(output))
 					if !strings.Contains(string(output), "Wrong password?") {
@@ -260,18 +327,13 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		return
 	}
 	tc.Log("Extract done")
-	changed = true
-	if err = util.MakeCleanTmpDir(origdir); err != nil {
-		return
-	}
-	for _, file := range originalFiles {
-		tc.Log("move original %s => %s", filepath.Join(tc.Dir, file), filepath.Join(origdir, file))
-		if err = atomic.ReplaceFile(filepath.Join(tc.Dir, file), filepath.Join(origdir, file)); err != nil {
-			return
-		}
-	}
-	contentDir := tmpdir
-	var contentFiles []fs.DirEntry
+	return nil
+}
+
+// Return the (denested) dir of extracted contents in tmpdir and it's entries.
+func extractedContents(tc *transform.TransformerContext, tmpdir string) (
+	contentDir string, contentFiles []fs.DirEntry, err error) {
+	contentDir = tmpdir
 	for {
 		contentFiles, err = os.ReadDir(contentDir)
 		if err != nil {
@@ -284,31 +346,29 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		}
 		break
 	}
-	for _, file := range contentFiles {
-		if err = atomic.ReplaceFile(filepath.Join(contentDir, file.Name()),
-			filepath.Join(tc.Dir, file.Name())); err != nil {
-			return
-		}
-	}
-	for _, file := range originalFiles {
-		if err = atomic.ReplaceFile(filepath.Join(origdir, file), helper.GetNewFilePath(tc.BackupDir, file)); err != nil {
-			return
-		}
-	}
-	os.RemoveAll(origdir)
 	return
 }
 
 // Extract inputFile to outputDir.
 func ExtractZip(inputFile, outputDir string, passwords []string, mode int, logger transform.Logger) (err error) {
-	zipFile, err := zip.OpenReader(inputFile)
+	zipFile, encoding, err := openZip(inputFile, mode, logger)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+	return ExtractZipFile(zipFile, outputDir, encoding, passwords)
+}
+
+// Open zip file and detect the encoding of it's non UTF-8 filenames.
+// The returned encoding is empty if all filenames are UTF-8.
+func openZip(inputFile string, mode int, logger transform.Logger) (zipFile *zip.ReadCloser, encoding string, err error) {
+	zipFile, err = zip.OpenReader(inputFile)
 	if err != nil {
 		if err == zip.ErrInsecurePath {
 			zipFile.Close()
 		}
-		return err
+		return nil, "", err
 	}
-	defer zipFile.Close()
 	var rawFilenames []string
 	for _, file := range zipFile.File {
 		// zip filenames may contains UTF-8 and one another local charset.
@@ -316,17 +376,17 @@ func ExtractZip(inputFile, outputDir string, passwords []string, mode int, logge
 			rawFilenames = append(rawFilenames, file.Name)
 		}
 	}
-	encoding := ""
 	if len(rawFilenames) > 0 {
 		if encoding, _, err = DetectFilenamesEncoding(rawFilenames, mode); err != nil {
-			return fmt.Errorf("failed to detect filename encoding: %v", err)
+			zipFile.Close()
+			return nil, "", fmt.Errorf("failed to detect filename encoding: %v", err)
 		}
 	}
 	logger("detected zip filename encoding: %s", encoding)
 	if encoding == "UTF-8" {
 		encoding = ""
 	}
-	return ExtractZipFile(zipFile, outputDir, encoding, passwords)
+	return zipFile, encoding, nil
 }
 
 // Return detected zip filenames charset.
@@ -417,11 +477,19 @@ func init() {
 	transform.Register(&transform.Transformer{
 		Name:   "decompress",
 		Action: Transformer,
+		Options: append([]*transform.Option{
+			{Name: "password", Description: "Password of archive (could be set multiple times)"},
+			{Name: "zipmode", Description: "Zip filename encoding detection mode. 0: strict; 1: guess the best (default)"},
+			{Name: "recursive", Description: `"1": extract archives anywhere in the tree (including nested ones) ` +
+				`if dir is not comprised of single archive`},
+			{Name: "recursive_depth", Description: fmt.Sprintf("Max dir depth of extracted archives in recursive mode. "+
+				"Default is %d", DEFAULT_RECURSIVE_DEPTH)},
+		}, transform.BinaryOptions("sevenzip")...),
 	})
 }
 
-// whether filename is a major archive file.
+// Whether filename is a major archive file.
 // The "major" means it's the first / primary volume archive file if this is a multi-volume archive file.
-func isArchive(filename string) bool {
+func IsArchive(filename string) bool {
 	return slices.Contains(SupportedFormats, filepath.Ext(filename)) || strings.HasSuffix(filename, EXT_7Z_001)
 }
@@ -0,0 +1,175 @@
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sagan/erodownloader/config"
+	"github.com/sagan/erodownloader/transform"
+	"github.com/sagan/erodownloader/util"
+)
+
+// A file or dir in archive. Name is "/" separated.
+type ArchiveEntry struct {
+	Name string
+	Dir  bool
+	Size int64
+}
+
+// List contents of zip file. Filenames are converted in the same way as ExtractZip.
+func ListZip(inputFile string, mode int, logger transform.Logger) (entries []*ArchiveEntry, err error) {
+	zipFile, encoding, err := openZip(inputFile, mode, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Close()
+	for _, f := range zipFile.File {
+		name, err := zipEntryName(f, encoding)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		entries = append(entries, &ArchiveEntry{
+			Name: name,
+			Dir:  f.FileInfo().IsDir(),
+			Size: int64(f.UncompressedSize64),
+		})
+	}
+	return entries, nil
+}
+
+// List contents of archive using 7z ("7z l -slt"), which is executed with "sevenzip" limits of tc.
+func List7z(tc *transform.TransformerContext, binary string, inputFile string,
+	passwords []string) (entries []*ArchiveEntry, err error) {
+	if len(passwords) == 0 {
+		passwords = append(passwords, "")
+	}
+	var output []byte
+	for _, password := range passwords {
+		args := []string{"l", "-slt"}
+		if password != "" {
+			args = append(args, "-p"+password)
+		}
+		args = append(args, inputFile)
+		if output, err = tc.Exec("sevenzip", binary, args...); err == nil ||
+			!strings.Contains(string(output), "Wrong password?") {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("7z failed: %w", err)
+	}
+	// Technical info of each file is a block of "Key = Value" lines, following the "----------" line.
+	_, list, found := bytes.Cut(output, []byte("\n----------"))
+	if !found {
+		return nil, fmt.Errorf("unrecognized 7z output")
+	}
+	var entry *ArchiveEntry
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), " = ")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Path":
+			entry = &ArchiveEntry{Name: filepath.ToSlash(value)}
+			entries = append(entries, entry)
+		case "Folder":
+			if entry != nil && value == "+" {
+				entry.Dir = true
+			}
+		case "Attributes":
+			if entry != nil && strings.HasPrefix(value, "D") {
+				entry.Dir = true
+			}
+		case "Size":
+			if entry != nil {
+				entry.Size = util.ParseInt(value, int64(0))
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Remove duplicate folder structure of archive entries, in the same way as extraction does.
+func denestEntries(entries []*ArchiveEntry) []*ArchiveEntry {
+	for {
+		top := map[string]bool{} // first path component => is dir
+		for _, entry := range entries {
+			first, _, nested := strings.Cut(entry.Name, "/")
+			top[first] = top[first] || nested || entry.Dir
+		}
+		if len(top) != 1 {
+			return entries
+		}
+		var stripped []*ArchiveEntry
+		for first, dir := range top {
+			if !dir {
+				return entries
+			}
+			for _, entry := range entries {
+				if name, ok := strings.CutPrefix(entry.Name, first+"/"); ok {
+					stripped = append(stripped, &ArchiveEntry{Name: name, Dir: entry.Dir, Size: entry.Size})
+				}
+			}
+		}
+		entries = stripped
+	}
+}
+
+// Plan mode. List contents of archive inputFile in dir and add them to virtual tree as if it were extracted.
+// The original files are moved to backup dir. If subdir is not empty, contents are placed in a new folder
+// of that name (see extractTarget) instead of dir.
+func planExtract(tc *transform.TransformerContext, dir string, inputFile string, format string,
+	originalFiles []string, subdir string) (err error) {
+	file, err := tc.Open(filepath.Join(dir, inputFile))
+	if err != nil {
+		return err
+	}
+	source := file.Name()
+	file.Close()
+	var entries []*ArchiveEntry
+	switch {
+	case format == EXT_ZIP:
+		mode := util.ParseInt(tc.Options.Get("zipmode"), config.DEFAULT_ZIPMODE)
+		entries, err = ListZip(source, mode, tc.Log)
+	case tc.Options.Has("sevenzip_binary"):
+		entries, err = List7z(tc, tc.Options.Get("sevenzip_binary"), source, tc.Options["password"])
+	default:
+		err = fmt.Errorf("listing %s archive requires 7z binary", format)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: failed to list %q: %v", transform.ErrUnknownContents, inputFile, err)
+	}
+	entries = denestEntries(entries)
+	fileCnt := 0
+	for _, entry := range entries {
+		if !entry.Dir {
+			fileCnt++
+		}
+	}
+	target, recordTarget := dir, ""
+	if subdir != "" {
+		target = extractTarget(tc, dir, subdir)
+		recordTarget = target
+	}
+	tc.Record(transform.OP_EXTRACT, filepath.Join(dir, inputFile), recordTarget, fmt.Sprintf("%d files", fileCnt))
+	for _, file := range originalFiles {
+		if err = tc.Backup(filepath.Join(dir, file)); err != nil {
+			return err
+		}
+	}
+	if target != dir {
+		tc.AddVirtualFile(target, true, 0)
+	}
+	for _, entry := range entries {
+		tc.AddVirtualFile(filepath.Join(target, filepath.FromSlash(entry.Name)), entry.Dir, entry.Size)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package decompress
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/natefinch/atomic"
+	"github.com/shibumi/go-pathspec"
+
+	"github.com/sagan/erodownloader/transform"
+	"github.com/sagan/erodownloader/util"
+)
+
+// Default max depth of dirs (relative to content dir, which is 0) whose archives are extracted in recursive mode.
+const DEFAULT_RECURSIVE_DEPTH = 3
+
+// Recursive mode. Find archive sets in all dirs of tree (up to "recursive_depth") and extract each of them
+// in place, into a new folder named after the archive (see extractTarget), e.g. "foo/bar.zip" => "foo/bar/".
+// The archive files are moved to backup dir. It repeats until no more archives are extracted;
+// as the contents are extracted one level deeper, nested archives are extracted until depth limit is reached.
+// Archives that match NoDecompressFilenamePatterns or fail to extract (e.g. wrong password) are left as is.
+func decompressTree(tc *transform.TransformerContext) (changed bool, err error) {
+	maxDepth := util.ParseInt(tc.Options.Get("recursive_depth"), DEFAULT_RECURSIVE_DEPTH)
+	skipped := map[string]bool{}
+	for {
+		var dirs []string
+		dirFiles := map[string][]string{}
+		err = tc.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == tc.Dir {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") || path == tc.BackupDir {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				if rel, err := filepath.Rel(tc.Dir, path); err == nil &&
+					strings.Count(rel, string(filepath.Separator)) >= maxDepth {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if util.First(pathspec.GitIgnore(transform.IgnoredFilePatterns, d.Name())) {
+				return nil
+			}
+			dir := filepath.Dir(path)
+			if _, ok := dirFiles[dir]; !ok {
+				dirs = append(dirs, dir)
+			}
+			dirFiles[dir] = append(dirFiles[dir], d.Name())
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		extracted := false
+		for _, dir := range dirs {
+			for _, set := range findArchiveSets(dirFiles[dir]) {
+				inputFile := filepath.Join(dir, set.inputFile)
+				if skipped[inputFile] {
+					continue
+				}
+				if noDecompress(set.inputFile) {
+					tc.Log("Skip archive %q that should not be decompressed", inputFile)
+					skipped[inputFile] = true
+					continue
+				}
+				if filepath.Ext(set.inputFile) == EXT_EXE {
+					tc.Log("Skip possible self-extracting archive %q", inputFile)
+					skipped[inputFile] = true
+					continue
+				}
+				tc.Log("Found archive %s (%v) in %q", set.inputFile, set.files, dir)
+				if tc.DryRun() {
+					if err = planExtract(tc, dir, set.inputFile, set.format, set.files, set.prefix); err != nil {
+						return
+					}
+					changed, extracted = true, true
+					continue
+				}
+				var ok bool
+				if ok, err = extractSet(tc, dir, set); ok {
+					changed, extracted = true, true
+				} else if err == nil {
+					skipped[inputFile] = true
+				}
+				if err != nil {
+					return
+				}
+			}
+		}
+		if !extracted {
+			return
+		}
+	}
+}
+
+// Group files of a dir into archive sets. Files that are not archives are ignored.
+// Single exe files are also returned, with empty format.
+func findArchiveSets(files []string) (sets []*archiveSet) {
+	files = slices.Clone(files)
+	slices.Sort(files)
+	// legacy rar volumes (".r00") go last, so that they are grouped into the set of ".rar" file.
+	majors := util.FilterSlice(files, IsArchive)
+	slices.SortStableFunc(majors, func(a, b string) int {
+		if aIsR00, bIsR00 := filepath.Ext(a) == EXT_R00, filepath.Ext(b) == EXT_R00; aIsR00 && !bIsR00 {
+			return 1
+		} else if !aIsR00 && bIsR00 {
+			return -1
+		}
+		return 0
+	})
+	claimed := map[string]bool{}
+	for _, major := range majors {
+		if claimed[major] {
+			continue
+		}
+		claimed[major] = true
+		set := newArchiveSet(major)
+		for _, file := range files {
+			if !claimed[file] && set.isVolume(file) {
+				claimed[file] = true
+				set.files = append(set.files, file)
+			}
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// Return a new folder path in dir, where contents of archive set with prefix are extracted to.
+func extractTarget(tc *transform.TransformerContext, dir string, prefix string) string {
+	target := filepath.Join(dir, prefix)
+	for i := 1; tc.Exists(target); i++ {
+		target = filepath.Join(dir, fmt.Sprintf("%s.%d", prefix, i))
+	}
+	return target
+}
+
+// Extract archive set in dir to extractTarget and move the archive files to backup dir.
+// If the extraction fails, it's logged and the dir is left unchanged.
+func extractSet(tc *transform.TransformerContext, dir string, set *archiveSet) (changed bool, err error) {
+	tmpdir := filepath.Join(tc.Dir, transform.TMP_DIR)
+	if err = util.MakeCleanTmpDir(tmpdir); err != nil {
+		return false, fmt.Errorf("failed to make tmpdir: %w", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err = extract(tc, filepath.Join(dir, set.inputFile), set.format, tmpdir); err != nil {
+		if errors.Is(err, transform.ErrCanceled) {
+			return false, err
+		}
+		tc.Log("! failed to extract %q: %v", filepath.Join(dir, set.inputFile), err)
+		return false, nil
+	}
+	contentDir, contentFiles, err := extractedContents(tc, tmpdir)
+	if err != nil {
+		return false, err
+	}
+	target := extractTarget(tc, dir, set.prefix)
+	if err = os.Mkdir(target, 0700); err != nil {
+		return
+	}
+	changed = true
+	for _, file := range contentFiles {
+		if err = atomic.ReplaceFile(filepath.Join(contentDir, file.Name()), filepath.Join(target, file.Name())); err != nil {
+			return
+		}
+	}
+	// the archive files are backed up only after the contents are in place, so that a failure does not lose them
+	if err = tc.Created(target); err != nil {
+		return
+	}
+	for _, file := range set.files {
+		if err = tc.Backup(filepath.Join(dir, file)); err != nil {
+			return
+		}
+	}
+	tc.Log("Extracted %q to %q", filepath.Join(dir, set.inputFile), target)
+	return
+}
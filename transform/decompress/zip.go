@@ -29,21 +29,12 @@ func ExtractZipFile(zipFile *zip.ReadCloser, outputDir string, encoding string,
 				if f.IsEncrypted() {
 					f.SetPassword(password)
 				}
-				name := f.Name
-				if f.NonUTF8 && encoding != "" {
-					newname, err := stringutil.DecodeText([]byte(name), encoding, false)
-					if err != nil {
-						return fmt.Errorf("failed to convert zip filename %q to %s", f.Name, encoding), false
-					}
-					name = string(newname)
-				}
-				if f.FileInfo().IsDir() {
-					name = util.CleanPath(name)
-				} else {
-					name = util.CleanFilePath(name)
+				name, err := zipEntryName(f, encoding)
+				if err != nil {
+					return err, false
 				}
 				// Ignore MacOS created rubbish in zip file.
-				if name == MACOS_RUGGISH_FOLDER || strings.HasPrefix(name, MACOS_RUGGISH_FOLDER+"/") {
+				if name == "" {
 					continue
 				}
 				if _, ok := extractedNames[name]; ok && !f.FileInfo().IsDir() {
@@ -74,6 +65,28 @@ func ExtractZipFile(zipFile *zip.ReadCloser, outputDir string, encoding string,
 	return err
 }
 
+// Return the cleaned name of zip file entry, with filename converted from encoding if it's not UTF-8.
+// Return empty name if the entry should be ignored.
+func zipEntryName(f *zip.File, encoding string) (name string, err error) {
+	name = f.Name
+	if f.NonUTF8 && encoding != "" {
+		newname, err := stringutil.DecodeText([]byte(name), encoding, false)
+		if err != nil {
+			return "", fmt.Errorf("failed to convert zip filename %q to %s", f.Name, encoding)
+		}
+		name = string(newname)
+	}
+	if f.FileInfo().IsDir() {
+		name = util.CleanPath(name)
+	} else {
+		name = util.CleanFilePath(name)
+	}
+	if name == MACOS_RUGGISH_FOLDER || strings.HasPrefix(name, MACOS_RUGGISH_FOLDER+"/") {
+		return "", nil
+	}
+	return name, nil
+}
+
 func writeZipFile(f *zip.File, outoutPath string) error {
 	zFile, err := f.Open()
 	if err != nil {
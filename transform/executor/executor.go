@@ -1,14 +1,17 @@
 package executor
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/shlex"
 	"github.com/natefinch/atomic"
@@ -47,12 +50,23 @@ type ExecutorOptions struct {
 	// If return (nil,nil), will ignore current ierr and skip current input file.
 	OnError func(combinedOutput []byte, ierr error, logger transform.Logger) (newArgs []string, err error)
 	Test    func(path string) bool
+	// Always backup original files to BackupDir, even if "backup=0" option is set.
+	Backup bool
+	// Max number of files processed concurrently. Default is 1. It can be overrided by "executor_jobs" option.
+	Jobs int
 }
 
 var (
 	ErrNoOutputFile = fmt.Errorf("no target output file exists")
 )
 
+// Options supported by all executor based transformers.
+var CommonOptions = []*transform.Option{
+	{Name: "backup", Description: `"0": do not backup original (converted) files to backup dir, ` +
+		`the conversion can NOT be undone. By default they are backed up`},
+	{Name: "executor_jobs", Description: "Number of files converted concurrently"},
+}
+
 // 对每个文件执行外部命令以替换文件内容
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 	binary := tc.Options.Get("binary")
@@ -88,13 +102,20 @@ func (options *ExecutorOptions) Transformer(tc *transform.TransformerContext) (c
 		}
 		binary = binaryPath
 	}
-	doBackup := tc.Options.Get("backup") == "1"
+	doBackup := options.Backup || tc.Options.Get("backup") != "0"
+	jobs := max(util.ParseInt(tc.Options.Get("executor_jobs"), options.Jobs), 1)
+	if tc.DryRun() {
+		jobs = 1
+	}
 	tmpdir := filepath.Join(tc.Dir, transform.TMP_DIR)
-	if err = util.MakeCleanTmpDir(tmpdir); err != nil {
-		return
+	if !tc.DryRun() {
+		if err = util.MakeCleanTmpDir(tmpdir); err != nil {
+			return
+		}
+		defer os.RemoveAll(tmpdir)
 	}
-	defer os.RemoveAll(tmpdir)
-	err = filepath.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
+	var files []string
+	err = tc.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
 		if path == tc.Dir {
 			return err
 		}
@@ -110,11 +131,7 @@ func (options *ExecutorOptions) Transformer(tc *transform.TransformerContext) (c
 		if d.IsDir() {
 			return nil
 		}
-		ext := filepath.Ext(path)
-		dirname := filepath.Dir(path)
-		basename := filepath.Base(path)
-		base := basename[:len(basename)-len(ext)]
-		if len(options.Ext) > 0 && !slices.Contains(options.Ext, ext) {
+		if len(options.Ext) > 0 && !slices.Contains(options.Ext, filepath.Ext(path)) {
 			return nil
 		}
 		if options.MinSize > 0 || options.MaxSize > 0 {
@@ -131,133 +148,256 @@ func (options *ExecutorOptions) Transformer(tc *transform.TransformerContext) (c
 		if options.Test != nil && !options.Test(path) {
 			return nil
 		}
-		targetFilename := basename
-		if options.Output != "" {
-			targetFilename = options.Output
-			targetFilename = strings.ReplaceAll(targetFilename, BASE_PLACEHOLDER, base)
-			targetFilename = strings.ReplaceAll(targetFilename, EXT_PLACEHOLDER, ext)
-		} else if options.NewExt != "" {
-			targetFilename = base + options.NewExt
-		}
-		targetFilePath := filepath.Join(dirname, targetFilename)
-		tempFilePath := filepath.Join(tmpdir, targetFilename)
-		if targetFilename != basename && util.FileExists(targetFilePath) {
-			tc.Log("Skip %q due to target file %q already exists", path, targetFilePath)
-			return nil
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Files are processed by a pool of jobs workers. After the first error, remaining files are skipped.
+	var mu sync.Mutex
+	claimed := map[string]bool{}
+	claim := func(target string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if claimed[target] {
+			return false
 		}
-		if util.FileExists(tempFilePath) {
-			if err = os.Remove(tempFilePath); err != nil {
-				return err
+		claimed[target] = true
+		return true
+	}
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for range min(jobs, len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				mu.Lock()
+				stop := err != nil
+				mu.Unlock()
+				if stop {
+					continue
+				}
+				release := tc.AcquireHeavy()
+				fileChanged, fileErr := options.process(tc, binary, files[i],
+					filepath.Join(tmpdir, strconv.Itoa(i)), doBackup, claim)
+				release()
+				mu.Lock()
+				changed = changed || fileChanged
+				if fileErr != nil && err == nil {
+					err = fileErr
+				}
+				mu.Unlock()
 			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return
+}
+
+// Process a single file. tmpdir is the temp dir dedicated to this file.
+// claim reserves the target file path, so that files being processed concurrently will not convert to the same target.
+func (options *ExecutorOptions) process(tc *transform.TransformerContext, binary string, path string,
+	tmpdir string, doBackup bool, claim func(string) bool) (changed bool, err error) {
+	ext := filepath.Ext(path)
+	dirname := filepath.Dir(path)
+	basename := filepath.Base(path)
+	base := basename[:len(basename)-len(ext)]
+	targetFilename := basename
+	if options.Output != "" {
+		targetFilename = options.Output
+		targetFilename = strings.ReplaceAll(targetFilename, BASE_PLACEHOLDER, base)
+		targetFilename = strings.ReplaceAll(targetFilename, EXT_PLACEHOLDER, ext)
+	} else if options.NewExt != "" {
+		targetFilename = base + options.NewExt
+	}
+	targetFilePath := filepath.Join(dirname, targetFilename)
+	tempFilePath := filepath.Join(tmpdir, targetFilename)
+	if targetFilename != basename && (tc.Exists(targetFilePath) || !claim(targetFilePath)) {
+		tc.Log("Skip %q due to target file %q already exists", path, targetFilePath)
+		return false, nil
+	}
+	if tc.DryRun() {
+		return options.plan(tc, binary, path, targetFilePath, doBackup)
+	}
+	if err = util.MakeCleanTmpDir(tmpdir); err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmpdir)
+	if options.Func != nil {
+		tc.Log("Execute func %s on %q", util.GetFunctionName(options.Func), path)
+		if changed, err := options.Func(path, tempFilePath, tc.Options, tc.Log); err != nil {
+			return false, err
+		} else if !changed {
+			return false, nil
 		}
-		if options.Func != nil {
-			tc.Log("Execute func %s on %q", util.GetFunctionName(options.Func), path)
-			if changed, err := options.Func(path, tempFilePath, tc.Options, tc.Log); err != nil {
-				return err
-			} else if !changed {
-				return nil
-			}
-		} else if options.ContentsFunc != nil {
-			tc.Log("Execute contents func %s on %q", util.GetFunctionName(options.ContentsFunc), path)
-			tc.Options.Set("input", path)
-			if contents, err := os.ReadFile(path); err != nil {
-				return err
-			} else if newContents, contentsChanged, err := options.ContentsFunc(contents, tc.Options, tc.Log); err != nil {
-				return err
-			} else if !contentsChanged {
-				return nil
-			} else if err = os.WriteFile(tempFilePath, newContents, 0600); err != nil {
-				return err
+	} else if options.ContentsFunc != nil {
+		tc.Log("Execute contents func %s on %q", util.GetFunctionName(options.ContentsFunc), path)
+		fileOptions := maps.Clone(tc.Options)
+		fileOptions.Set("input", path)
+		if contents, err := os.ReadFile(path); err != nil {
+			return false, err
+		} else if newContents, contentsChanged, err := options.ContentsFunc(contents, fileOptions, tc.Log); err != nil {
+			return false, err
+		} else if !contentsChanged {
+			return false, nil
+		} else if err = os.WriteFile(tempFilePath, newContents, 0600); err != nil {
+			return false, err
+		}
+	} else {
+		inputFile := path
+		if options.Hardlink {
+			hardlinkFile := helper.GetNewFilePath(tmpdir, util.Md5(base)+ext)
+			if err = os.Link(inputFile, hardlinkFile); err != nil {
+				return false, err
 			}
-		} else {
-			inputFile := path
-			if options.Hardlink {
-				hardlinkFile := helper.GetNewFilePath(tmpdir, util.Md5(base)+ext)
-				if err = os.Link(inputFile, hardlinkFile); err != nil {
-					return err
-				}
-				inputFile = hardlinkFile
+			inputFile = hardlinkFile
+		}
+		binaryArgs := options.BinaryArgs
+		var output []byte
+		i := 0
+		for {
+			i++
+			if i > 3 {
+				err = fmt.Errorf("too many fails")
+				break
 			}
-			binaryArgs := options.BinaryArgs
-			var output []byte
-			i := 0
-			for {
-				i++
-				if i > 3 {
-					err = fmt.Errorf("too many fails")
+			if util.FileExists(tempFilePath) {
+				if err = os.Remove(tempFilePath); err != nil {
 					break
 				}
-				if util.FileExists(tempFilePath) {
-					if err = os.Remove(tempFilePath); err != nil {
-						break
-					}
-				}
-				var args []string
-				for _, arg := range binaryArgs {
-					switch arg {
-					case INPUT_PLACEHOLDER:
-						args = append(args, inputFile)
-					case OUTPUT_PLACEHOLDER:
-						args = append(args, tempFilePath)
-					default:
-						args = append(args, arg)
-					}
-				}
-				tc.Log("Execute binary %q %v", binary, args)
-				output, err = exec.Command(binary, args...).CombinedOutput()
-				if err == nil && !util.FileExists(tempFilePath) {
-					err = ErrNoOutputFile
+			}
+			var args []string
+			for _, arg := range binaryArgs {
+				switch arg {
+				case INPUT_PLACEHOLDER:
+					args = append(args, inputFile)
+				case OUTPUT_PLACEHOLDER:
+					args = append(args, tempFilePath)
+				default:
+					args = append(args, arg)
 				}
-				if err == nil {
-					tc.Log("Success executed")
-					break
-				} else if options.OnError == nil {
-					tc.Log("Binary process exitted with error: %v", err)
-					break
-				} else if binaryArgs, err = options.OnError(output, err, tc.Log); err != nil {
-					tc.Log("Binary process failed, OnError return: %v", err)
-					break
-				} else if binaryArgs == nil {
-					return nil
+			}
+			tc.Log("Execute binary %q %v", binary, args)
+			output, err = tc.Exec(options.Binary, binary, args...)
+			if err == nil && !util.FileExists(tempFilePath) {
+				err = ErrNoOutputFile
+			}
+			if err == nil {
+				tc.Log("Success executed")
+				break
+			} else if options.OnError == nil || errors.Is(err, transform.ErrTimeout) ||
+				errors.Is(err, transform.ErrCanceled) {
+				tc.Log("Binary process exitted with error: %v", err)
+				break
+			} else if binaryArgs, err = options.OnError(output, err, tc.Log); err != nil {
+				tc.Log("Binary process failed, OnError return: %v", err)
+				break
+			} else if binaryArgs == nil {
+				return false, nil
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if doBackup {
+		err = tc.Backup(path)
+	} else {
+		err = tc.Discard(path)
+	}
+	if err != nil {
+		return true, err
+	}
+	if err = atomic.ReplaceFile(tempFilePath, targetFilePath); err != nil {
+		return true, err
+	}
+	if err = tc.Created(targetFilePath); err != nil {
+		return true, err
+	}
+	if basename != targetFilename { // replaced with a new name file
+		for _, suffix := range options.RenameAdditionalSuffixes {
+			oldpath := path + suffix
+			newpath := targetFilePath + suffix
+			if util.FileExists(oldpath) && !util.FileExists(newpath) {
+				if err := tc.Rename(oldpath, newpath); err != nil {
+					tc.Log("! failed to rename %q => %q: %v", oldpath, newpath, err)
 				}
 			}
+		}
+	}
+	return true, nil
+}
+
+// Plan mode. Record the conversion of path to targetFilePath.
+// Funcs are executed if the contents of path is available, with output written to a temp dir outside of tc.Dir,
+// so only changed files are recorded. Binary is never executed.
+func (options *ExecutorOptions) plan(tc *transform.TransformerContext, binary string,
+	path string, targetFilePath string, doBackup bool) (changed bool, err error) {
+	note := ""
+	if options.Binary != "" {
+		note = filepath.Base(binary)
+	} else if file, err := tc.Open(path); err == transform.ErrUnknownContents {
+		note = "if required"
+	} else if err != nil {
+		return false, err
+	} else {
+		source := file.Name()
+		file.Close()
+		if options.Func != nil {
+			tmpdir, err := os.MkdirTemp("", "plan")
 			if err != nil {
-				return err
+				return false, err
 			}
-		}
-		changed = true
-		if doBackup {
-			if err = atomic.ReplaceFile(path, helper.GetNewFilePath(tc.BackupDir, basename)); err != nil {
-				return nil
+			defer os.RemoveAll(tmpdir)
+			if changed, err = options.Func(source, filepath.Join(tmpdir, filepath.Base(targetFilePath)),
+				tc.Options, tc.Log); err != nil || !changed {
+				return false, err
 			}
-			return atomic.ReplaceFile(tempFilePath, targetFilePath)
 		} else {
-			if basename != targetFilename { // replace with a new name file
-				if err = atomic.ReplaceFile(tempFilePath, targetFilePath); err != nil {
-					return err
-				}
-				for _, suffix := range options.RenameAdditionalSuffixes {
-					oldpath := path + suffix
-					newpath := targetFilePath + suffix
-					if util.FileExists(oldpath) && !util.FileExists(newpath) {
-						if err := atomic.ReplaceFile(oldpath, newpath); err != nil {
-							tc.Log("! failed to rename %q => %q: %v", oldpath, newpath, err)
-						}
-					}
+			tc.Options.Set("input", source)
+			contents, err := os.ReadFile(source)
+			if err != nil {
+				return false, err
+			}
+			if _, changed, err = options.ContentsFunc(contents, tc.Options, tc.Log); err != nil || !changed {
+				return false, err
+			}
+		}
+	}
+	if !tc.Convert(path, targetFilePath, note) {
+		return false, nil
+	}
+	if doBackup {
+		tc.Record(transform.OP_BACKUP, path, "", "")
+	}
+	if path != targetFilePath {
+		for _, suffix := range options.RenameAdditionalSuffixes {
+			if tc.Exists(path+suffix) && !tc.Exists(targetFilePath+suffix) {
+				if err = tc.Rename(path+suffix, targetFilePath+suffix); err != nil {
+					return true, err
 				}
-				return os.Remove(path)
-			} else { // replace file in place
-				os.Chmod(targetFilePath, 0600)
-				return atomic.ReplaceFile(tempFilePath, targetFilePath)
 			}
 		}
-	})
-	return
+	}
+	return true, nil
 }
 
 func init() {
 	transform.Register(&transform.Transformer{
 		Name:   "executor",
 		Action: Transformer,
+		Options: append([]*transform.Option{
+			{Name: "binary", Description: "External binary executed on each file"},
+			{Name: "binary_args", Description: `Args of binary, must contain "` + INPUT_PLACEHOLDER + `" and "` +
+				OUTPUT_PLACEHOLDER + `". E.g. "-i {{input}} {{output}}"`},
+			{Name: "ext", Description: `Processed file exts (could be set multiple times). E.g. ".mp4"`},
+		}, CommonOptions...),
 	})
 }
@@ -0,0 +1,440 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/natefinch/atomic"
+
+	"github.com/sagan/erodownloader/util"
+)
+
+// Journal file in backup dir, JSON lines of JournalEntry.
+const JOURNAL_FILE = ".tfjournal"
+
+// Ops that are only written to journal.
+const (
+	OP_CREATE  = "create"  // new file or dir, e.g. extracted or converted file
+	OP_DISCARD = "discard" // file removed without backup, which can not be undone
+	OP_MOVE    = "move"    // content dir moved, e.g. by lock or move-to of normalize
+)
+
+// An entry of journal. All entries of a single Transform of a content dir have the same Run.
+// Src and Dst are "/" separated pathes relative to Root (the content dir), except for OP_MOVE,
+// in which case they are the absolute pathes of content dir. Backup is relative to backup dir.
+// Fingerprint is the size and mtime (see fileFingerprint) of Dst (rename), Src (create) or Backup (backup) file after the op.
+type JournalEntry struct {
+	Run         string `json:"run"`
+	Time        int64  `json:"time"`
+	Root        string `json:"root"`
+	Transformer string `json:"transformer,omitempty"`
+	Op          string `json:"op"`
+	Src         string `json:"src"`
+	Dst         string `json:"dst,omitempty"`
+	Backup      string `json:"backup,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	IsDir       bool   `json:"is_dir,omitempty"`
+}
+
+// Append an entry of current run to journal. It's a no-op in plan mode.
+// name and target are absolute pathes inside content dir, backup is the absolute path inside backup dir.
+func (tc *TransformerContext) Journal(op string, name string, target string, backup string) error {
+	if tc.journal == nil {
+		return nil
+	}
+	entry := &JournalEntry{Run: tc.Run, Time: time.Now().Unix(), Root: tc.Dir, Op: op, Src: tc.rel(name)}
+	if tc.CurrentTransformer != nil {
+		entry.Transformer = tc.CurrentTransformer.Name
+	}
+	file := name
+	if target != "" {
+		entry.Dst = tc.rel(target)
+		file = target
+	}
+	if backup != "" {
+		rel, err := filepath.Rel(tc.BackupDir, backup)
+		if err != nil {
+			return err
+		}
+		entry.Backup = filepath.ToSlash(rel)
+		file = backup
+	}
+	if op != OP_DISCARD && op != OP_DELETE {
+		if stat, err := os.Stat(file); err != nil {
+			return err
+		} else if stat.IsDir() {
+			entry.IsDir = true
+		} else {
+			entry.Fingerprint = fileFingerprint(stat)
+		}
+	}
+	return writeJournal(tc.journal, entry)
+}
+
+// Journal the creation of file or dir (with all contents inside it).
+func (tc *TransformerContext) Created(name string) error {
+	if tc.journal == nil {
+		return nil
+	}
+	return filepath.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return tc.Journal(OP_CREATE, path, "", "")
+	})
+}
+
+// Remove file without backup, e.g. the original of a converted file with "backup=0" option.
+// The file is moved to backup dir first and only removed by commitDiscards after all transforms completed,
+// so that a canceled run can still be rolled back. Once removed, the op can not be undone.
+func (tc *TransformerContext) Discard(name string) error {
+	if tc.Plan != nil {
+		return tc.Remove(name)
+	}
+	backup, err := tc.moveToBackup(name)
+	if err != nil {
+		return err
+	}
+	if err = tc.Journal(OP_BACKUP, name, "", backup); err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.discards = append(tc.discards, &discard{name: name, backup: backup, transformer: tc.CurrentTransformer})
+	return nil
+}
+
+// A file pending removal by Discard.
+type discard struct {
+	name        string
+	backup      string // the backup of file in backup dir
+	transformer *Transformer
+}
+
+// Remove the backups of discarded files of current run.
+func (tc *TransformerContext) commitDiscards() error {
+	current := tc.CurrentTransformer
+	defer func() { tc.CurrentTransformer = current }()
+	for _, d := range tc.discards {
+		if err := os.Remove(d.backup); err != nil {
+			return err
+		}
+		tc.CurrentTransformer = d.transformer
+		if err := tc.Journal(OP_DISCARD, d.name, "", ""); err != nil {
+			return err
+		}
+	}
+	tc.discards = nil
+	return nil
+}
+
+// Journal the move of content dir from src to dst, after transforms.
+// If backup dir is inside content dir, it's moved together.
+func (tc *TransformerContext) JournalMove(src string, dst string) error {
+	if tc.Run == "" {
+		return nil
+	}
+	bakDir := tc.BackupDir
+	if rel, ok := strings.CutPrefix(bakDir, tc.Dir+string(filepath.Separator)); ok {
+		bakDir = filepath.Join(dst, rel)
+	}
+	file, err := os.OpenFile(filepath.Join(bakDir, JOURNAL_FILE), os.O_SYNC|os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeJournal(file, &JournalEntry{
+		Run:  tc.Run,
+		Time: time.Now().Unix(),
+		Root: tc.Dir,
+		Op:   OP_MOVE,
+		Src:  src,
+		Dst:  dst,
+	})
+}
+
+// Return a cheap fingerprint (size and mtime) of file, which is changed if file is modified.
+// Hashing the contents is too slow for large files, so modifications that keep both are not detected.
+func fileFingerprint(stat fs.FileInfo) string {
+	return fmt.Sprintf("%d-%d", stat.Size(), stat.ModTime().UnixNano())
+}
+
+func writeJournal(file *os.File, entry *JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Read all entries of journal in bakDir.
+func ReadJournal(bakDir string) (entries []*JournalEntry, err error) {
+	contents, err := os.ReadFile(filepath.Join(bakDir, JOURNAL_FILE))
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		entry, err := util.UnmarshalJson[*JournalEntry](scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("invalid journal: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Undo all runs of content dir recorded in journal of bakDir, latest first, restoring the original state of dir.
+// Before undoing a run, verify that the files touched by it are not changed since,
+// otherwise return an error without touching anything of that run.
+// Return the original path of dir (it could be moved by normalize) and the count of undone runs.
+func Undo(bakDir string, dir string) (original string, undone int, err error) {
+	entries, err := ReadJournal(bakDir)
+	if err != nil {
+		return dir, 0, err
+	}
+	var runs []*journalRun // in order of start
+	runsMap := map[string]*journalRun{}
+	for _, entry := range entries {
+		if runsMap[entry.Run] == nil {
+			runsMap[entry.Run] = &journalRun{id: entry.Run}
+			runs = append(runs, runsMap[entry.Run])
+		}
+		runsMap[entry.Run].entries = append(runsMap[entry.Run].entries, entry)
+	}
+	original = dir
+	undoneRuns := map[string]bool{}
+	for {
+		// if backup dir is inside dir, all runs are of dir, which could be moved or copied since
+		inside := strings.HasPrefix(bakDir, original+string(filepath.Separator))
+		var run *journalRun
+		for i := len(runs) - 1; i >= 0; i-- {
+			if !undoneRuns[runs[i].id] && (inside || runs[i].location() == original) {
+				run = runs[i]
+				break
+			}
+		}
+		if run == nil {
+			break
+		}
+		if err = run.verify(bakDir, original); err != nil {
+			break
+		}
+		var runOriginal string
+		runOriginal, err = run.undo(bakDir, original)
+		if runOriginal != original {
+			if rel, ok := strings.CutPrefix(bakDir, original+string(filepath.Separator)); ok {
+				bakDir = filepath.Join(runOriginal, rel)
+			}
+			original = runOriginal
+		}
+		if err != nil {
+			break
+		}
+		undoneRuns[run.id] = true
+		undone++
+	}
+	if undone > 0 {
+		if rewriteErr := rewriteJournal(bakDir, original, util.FilterSlice(entries, func(entry *JournalEntry) bool {
+			return !undoneRuns[entry.Run]
+		})); rewriteErr != nil && err == nil {
+			err = fmt.Errorf("failed to update journal: %w", rewriteErr)
+		}
+	}
+	return original, undone, err
+}
+
+// Undo current run, e.g. when transforms are canceled. If it can not be undone
+// (e.g. some files were removed without backup), return an error without touching anything.
+func (tc *TransformerContext) rollback() error {
+	entries, err := ReadJournal(tc.BackupDir)
+	if err != nil {
+		return err
+	}
+	run := &journalRun{id: tc.Run}
+	var others []*JournalEntry
+	for _, entry := range entries {
+		if entry.Run == tc.Run {
+			run.entries = append(run.entries, entry)
+		} else {
+			others = append(others, entry)
+		}
+	}
+	if len(run.entries) == 0 {
+		return nil
+	}
+	if err = run.verify(tc.BackupDir, tc.Dir); err != nil {
+		return err
+	}
+	if _, err = run.undo(tc.BackupDir, tc.Dir); err != nil {
+		return err
+	}
+	return rewriteJournal(tc.BackupDir, tc.Dir, others)
+}
+
+// Write remaining entries to journal. If backup dir is inside dir and nothing else than logs is left, remove it.
+func rewriteJournal(bakDir string, dir string, entries []*JournalEntry) error {
+	journalFile := filepath.Join(bakDir, JOURNAL_FILE)
+	if len(entries) > 0 {
+		buf := &bytes.Buffer{}
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			buf.Write(append(data, '\n'))
+		}
+		return atomic.WriteFile(journalFile, buf)
+	}
+	if err := os.Remove(journalFile); err != nil {
+		return err
+	}
+	if strings.HasPrefix(bakDir, dir+string(filepath.Separator)) {
+		if files, err := os.ReadDir(bakDir); err == nil && !slices.ContainsFunc(files, func(file fs.DirEntry) bool {
+			return file.Name() != LOG_FILE
+		}) {
+			return os.RemoveAll(bakDir)
+		}
+	}
+	return nil
+}
+
+type journalRun struct {
+	id      string
+	entries []*JournalEntry
+}
+
+// Return the current location of content dir after the run.
+func (r *journalRun) location() string {
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if r.entries[i].Op == OP_MOVE {
+			return r.entries[i].Dst
+		}
+	}
+	return r.entries[0].Root
+}
+
+// Return the location of content dir before the run.
+func (r *journalRun) original() string {
+	for _, entry := range r.entries {
+		if entry.Op == OP_MOVE {
+			return entry.Src
+		}
+	}
+	return r.entries[0].Root
+}
+
+// Verify that the files created, renamed or backed up by the run are not changed since.
+func (r *journalRun) verify(bakDir string, dir string) error {
+	files := map[string]*JournalEntry{}   // relative path in dir => entry whose fingerprint applies
+	backups := map[string]*JournalEntry{} // relative path in bakDir => entry
+	for _, entry := range r.entries {
+		switch entry.Op {
+		case OP_DISCARD:
+			return fmt.Errorf(`%q was removed without backup by %s ("backup=0" option), which can not be undone`,
+				entry.Src, entry.Transformer)
+		case OP_RENAME:
+			for name, file := range files {
+				if rel, ok := strings.CutPrefix(name, entry.Src); ok && (rel == "" || rel[0] == '/') {
+					delete(files, name)
+					files[entry.Dst+rel] = file
+				}
+			}
+			files[entry.Dst] = entry
+		case OP_CREATE:
+			files[entry.Src] = entry
+		case OP_BACKUP, OP_DELETE:
+			for name := range files {
+				if name == entry.Src || strings.HasPrefix(name, entry.Src+"/") {
+					delete(files, name)
+				}
+			}
+			if entry.Op == OP_BACKUP {
+				backups[entry.Backup] = entry
+			}
+		}
+	}
+	check := func(path string, entry *JournalEntry) error {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%q not found: %w", path, err)
+		}
+		if stat.IsDir() != entry.IsDir {
+			return fmt.Errorf("%q was changed since", path)
+		}
+		if entry.Fingerprint != "" && fileFingerprint(stat) != entry.Fingerprint {
+			return fmt.Errorf("%q was changed since", path)
+		}
+		return nil
+	}
+	for name, entry := range files {
+		if err := check(filepath.Join(dir, filepath.FromSlash(name)), entry); err != nil {
+			return err
+		}
+	}
+	for name, entry := range backups {
+		if err := check(filepath.Join(bakDir, filepath.FromSlash(name)), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay the run in reverse. Return the original location of content dir.
+func (r *journalRun) undo(bakDir string, dir string) (original string, err error) {
+	path := func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	}
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		entry := r.entries[i]
+		switch entry.Op {
+		case OP_RENAME:
+			err = restore(path(entry.Dst), path(entry.Src))
+		case OP_BACKUP:
+			err = restore(filepath.Join(bakDir, filepath.FromSlash(entry.Backup)), path(entry.Src))
+		case OP_CREATE:
+			// dir is removed only if it's empty. The file may be removed as junk since.
+			if err = os.Remove(path(entry.Src)); errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		case OP_DELETE:
+			// removed junk files are not restored
+		}
+		if err != nil {
+			return dir, fmt.Errorf("failed to undo %s %q: %w", entry.Op, entry.Src, err)
+		}
+	}
+	if original = r.original(); original == r.location() {
+		original = dir
+	} else if original != dir {
+		if err = restore(dir, original); err != nil {
+			return dir, fmt.Errorf("failed to move %q back to %q: %w", dir, original, err)
+		}
+	}
+	return original, nil
+}
+
+// Move src back to dst. dst must not exist.
+func restore(src string, dst string) error {
+	if util.FileExists(dst) {
+		return fmt.Errorf("%q already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return atomic.ReplaceFile(src, dst)
+}
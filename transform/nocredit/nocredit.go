@@ -4,7 +4,6 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io/fs"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -37,7 +36,7 @@ var CreditFiles = map[string][]*CreditFile{
 
 // 移除一些常见的发布者 credit 文件。
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
-	entries, err := os.ReadDir(tc.Dir)
+	entries, err := tc.ReadDir(tc.Dir)
 	if err != nil {
 		return
 	}
@@ -51,7 +50,7 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		}
 		filepath := filepath.Join(tc.Dir, entry.Name())
 		var stat fs.FileInfo
-		stat, err = os.Stat(filepath)
+		stat, err = entry.Info()
 		if err != nil {
 			return
 		}
@@ -59,7 +58,7 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 			continue
 		}
 		var contents []byte
-		contents, err = os.ReadFile(filepath)
+		contents, err = tc.ReadFile(filepath)
 		if err != nil {
 			return
 		}
@@ -95,7 +94,7 @@ func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 		}
 		tc.Log("Remove credit file %s", entry.Name())
 		changed = true
-		if err = os.Remove(filepath); err != nil {
+		if err = tc.Remove(filepath); err != nil {
 			return
 		}
 	}
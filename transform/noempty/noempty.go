@@ -18,23 +18,24 @@ var IgnoreNames = []string{"cover"}
 // 确保文件夹非空
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
 	totalSize := int64(0)
-	filepath.Walk(tc.Dir, func(path string, info fs.FileInfo, err error) error {
-		if path == tc.Dir {
+	tc.WalkDir(tc.Dir, func(path string, d fs.DirEntry, err error) error {
+		if path == tc.Dir || err != nil {
 			return err
 		}
-		basename := info.Name()
+		basename := d.Name()
 		if strings.HasPrefix(basename, ".") {
-			if info.IsDir() {
+			if d.IsDir() {
 				return fs.SkipDir
 			}
 			return nil
 		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			return nil
-		}
 		ext := strings.ToLower(filepath.Ext(basename))
 		base := strings.ToLower(basename[:len(basename)-len(ext)])
 		if slices.Contains(IgnoreFiles, basename) ||
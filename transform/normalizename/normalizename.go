@@ -1,32 +1,26 @@
 package normalizename
 
 import (
-	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/sagan/erodownloader/transform"
 	"github.com/sagan/erodownloader/util/helper"
 )
 
+// Log renames of transformer.
+type nameFs struct {
+	*transform.TransformerContext
+}
+
+func (fsys nameFs) Rename(oldpath string, newpath string) error {
+	fsys.Log("rename %q => %q", oldpath, filepath.Base(newpath))
+	return fsys.TransformerContext.Rename(oldpath, newpath)
+}
+
 // 规格化文件名
 func Transformer(tc *transform.TransformerContext) (changed bool, err error) {
-	entries, err := os.ReadDir(tc.Dir)
-	if err != nil {
-		return
-	}
-	var pathes []string
-	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), ".") {
-			continue
-		}
-		pathes = append(pathes, filepath.Join(tc.Dir, entry.Name()))
-	}
-	renamed, err := helper.NormalizeName(false, pathes...)
-	if renamed > 0 {
-		changed = true
-	}
-	return
+	renamed, err := helper.NormalizeNameFs(nameFs{tc}, tc.Dir)
+	return renamed > 0, err
 }
 
 func init() {
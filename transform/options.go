@@ -0,0 +1,160 @@
+package transform
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// An option supported by transformer.
+type Option struct {
+	Name        string
+	Description string
+}
+
+// Options that are supported by all transformers.
+// Except "bakdir", they can also be scoped to a transformer (e.g. "wav.binary_timeout=1h").
+var GlobalOptions = []*Option{
+	{Name: "bakdir", Description: `Backup dir. Default is the "` + BAK_DIR + `" dir inside content dir`},
+	{Name: "content_type", Description: `Content type of dir: "audio", "cg" or "game". Recorded in log`},
+	{Name: "binary_timeout", Description: `Timeout of each execution of external binary. E.g. "30m"`},
+	{Name: "binary_nice", Description: "Niceness of external binaries (Linux only)"},
+	{Name: "binary_ionice", Description: `IO scheduling class of external binaries: "idle", "best-effort" or "realtime"`},
+	{Name: "binary_memory", Description: `Max (virtual) memory of external binaries. E.g. "4GiB"`},
+}
+
+// Options of the external binary name used by transformer, e.g. "flac_binary" and "flac_timeout".
+// The limits override the "binary_*" ones (see CommandLimits).
+func BinaryOptions(name string) []*Option {
+	return []*Option{
+		{Name: name + "_binary", Description: "Path of " + name + " binary"},
+		{Name: name + "_timeout", Description: "Timeout of " + name},
+		{Name: name + "_nice", Description: "Niceness of " + name},
+		{Name: name + "_ionice", Description: "IO scheduling class of " + name},
+		{Name: name + "_memory", Description: "Max memory of " + name},
+	}
+}
+
+// Internal unscoped options that are passed to all transformers, besides GlobalOptions.
+// They are set by normalize or transformers, e.g. "input" of executor and "sevenzip_binary".
+var internalOptions = []string{"input", "password"}
+
+// Whether unscoped option key is delivered to transformer.
+func (transformer *Transformer) accepts(key string) bool {
+	return slices.Contains(internalOptions, key) || strings.HasSuffix(key, "_binary") ||
+		slices.ContainsFunc(GlobalOptions, func(option *Option) bool { return option.Name == key }) ||
+		slices.ContainsFunc(transformer.Options, func(option *Option) bool { return option.Name == key })
+}
+
+// Return the options view of the instance-th (1-based) instance of transformer in pipeline.
+// Unscoped options are only included if they are supported by transformer (see accepts).
+// Options can be scoped by prefixing the key with "name." (all instances) or "name.instance." (that instance),
+// e.g. "executor.1.binary=ffmpeg". Scoped options override unscoped ones; other scoped options are removed.
+func ScopedOptions(options url.Values, transformer *Transformer, instance int) url.Values {
+	name := transformer.Name
+	scoped := url.Values{}
+	instanceScoped := url.Values{}
+	view := url.Values{}
+	for key, values := range options {
+		scope, scopedKey, found := strings.Cut(key, ".")
+		if !found {
+			if transformer.accepts(key) {
+				view[key] = values
+			}
+		} else if scope == name {
+			if index, indexKey, found := strings.Cut(scopedKey, "."); found {
+				if index == strconv.Itoa(instance) {
+					instanceScoped[indexKey] = values
+				}
+			} else {
+				scoped[scopedKey] = values
+			}
+		}
+	}
+	for key, values := range scoped {
+		view[key] = values
+	}
+	for key, values := range instanceScoped {
+		view[key] = values
+	}
+	return view
+}
+
+// Return the instance index (1-based) of each transformer of each step in pipeline.
+func (ts Transformers) instances() [][]int {
+	counts := map[string]int{}
+	var instances [][]int
+	for _, step := range ts {
+		var indexes []int
+		for _, transformer := range step.Transformers {
+			counts[transformer.Name]++
+			indexes = append(indexes, counts[transformer.Name])
+		}
+		instances = append(instances, indexes)
+	}
+	return instances
+}
+
+// Validate options against the pipeline. Return an error if any key is not supported by
+// the transformer (instance) it's scoped to, or by any transformer of pipeline if it's unscoped.
+func (ts Transformers) ValidateOptions(options url.Values) error {
+	counts := map[string]int{}
+	transformers := map[string]*Transformer{}
+	for _, step := range ts {
+		for _, transformer := range step.Transformers {
+			counts[transformer.Name]++
+			transformers[transformer.Name] = transformer
+		}
+	}
+	supports := func(transformer *Transformer, key string) bool {
+		return slices.ContainsFunc(transformer.Options, func(option *Option) bool { return option.Name == key }) ||
+			key != "bakdir" && slices.ContainsFunc(GlobalOptions, func(option *Option) bool { return option.Name == key })
+	}
+	for key := range options {
+		scope, scopedKey, found := strings.Cut(key, ".")
+		if !found {
+			if slices.ContainsFunc(GlobalOptions, func(option *Option) bool { return option.Name == key }) {
+				continue
+			}
+			supported := false
+			for _, transformer := range transformers {
+				if supports(transformer, key) {
+					supported = true
+					break
+				}
+			}
+			if !supported {
+				return fmt.Errorf("unknown option %q: not supported by any transformer of pipeline", key)
+			}
+			continue
+		}
+		transformer := transformers[scope]
+		if transformer == nil {
+			return fmt.Errorf("invalid option %q: transformer %s is not in pipeline", key, scope)
+		}
+		if index, indexKey, found := strings.Cut(scopedKey, "."); found {
+			if i, err := strconv.Atoi(index); err != nil || i < 1 || i > counts[scope] {
+				return fmt.Errorf("invalid option %q: pipeline has %d instance(s) of transformer %s",
+					key, counts[scope], scope)
+			}
+			scopedKey = indexKey
+		}
+		if !supports(transformer, scopedKey) {
+			return fmt.Errorf("unknown option %q: not supported by transformer %s", key, scope)
+		}
+	}
+	return nil
+}
+
+// Return all registered transformers, sorted by name.
+func AllTransformers() (transformers []*Transformer) {
+	for _, transformer := range allTransformers {
+		transformers = append(transformers, transformer)
+	}
+	slices.SortFunc(transformers, func(a, b *Transformer) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return transformers
+}
@@ -0,0 +1,380 @@
+package transform
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/natefinch/atomic"
+
+	"github.com/sagan/erodownloader/util"
+	"github.com/sagan/erodownloader/util/helper"
+)
+
+// Types of planned operations.
+const (
+	OP_RENAME  = "rename"
+	OP_DELETE  = "delete"
+	OP_EXTRACT = "extract"
+	OP_CONVERT = "convert"
+	OP_BACKUP  = "backup" // move to backup dir
+)
+
+var (
+	// Returned by transformers in plan mode if they need file contents that are not available,
+	// e.g. contents of an archive that can not be listed. The plan stops there.
+	ErrUnknownContents = fmt.Errorf("contents are unknown in plan mode")
+)
+
+// An intended operation of a transformer. Path and Target are relative to content dir ("/" separated).
+type Operation struct {
+	Transformer string
+	Op          string
+	Path        string
+	Target      string
+	Note        string
+}
+
+func (op *Operation) String() string {
+	str := fmt.Sprintf("[%s] %s %q", op.Transformer, op.Op, op.Path)
+	if op.Target != "" {
+		str += fmt.Sprintf(" => %q", op.Target)
+	}
+	if op.Note != "" {
+		str += fmt.Sprintf(" (%s)", op.Note)
+	}
+	return str
+}
+
+// Plan of transforms of a dir. In plan mode, transformers operate on a virtual view of the dir tree,
+// which is loaded from disk at the start and updated by planned operations.
+type Plan struct {
+	Operations []*Operation
+	// If not empty, the plan stopped before all transformers are planned, due to this reason.
+	Incomplete string
+	files      map[string]*VirtualFile // "/" separated relative path => file
+	seen       map[string]bool         // "transformer:path" of files that are already converted
+}
+
+// A file or dir of virtual tree. It implements fs.DirEntry and fs.FileInfo.
+type VirtualFile struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+	// Real path of file contents. Empty if contents are unknown (e.g. extracted or converted file).
+	source string
+}
+
+func (f *VirtualFile) Name() string               { return f.name }
+func (f *VirtualFile) IsDir() bool                { return f.dir }
+func (f *VirtualFile) Type() fs.FileMode          { return f.Mode().Type() }
+func (f *VirtualFile) Info() (fs.FileInfo, error) { return f, nil }
+func (f *VirtualFile) Size() int64                { return f.size }
+func (f *VirtualFile) ModTime() time.Time         { return f.modTime }
+func (f *VirtualFile) Sys() any                   { return nil }
+func (f *VirtualFile) Mode() fs.FileMode {
+	if f.dir {
+		return fs.ModeDir | 0700
+	}
+	return 0600
+}
+
+// Load virtual tree of dir from disk.
+func NewPlan(dir string) (*Plan, error) {
+	plan := &Plan{files: map[string]*VirtualFile{}, seen: map[string]bool{}}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		file := &VirtualFile{name: d.Name(), dir: d.IsDir(), size: info.Size(), modTime: info.ModTime()}
+		if !d.IsDir() {
+			file.source = p
+		}
+		plan.files[filepath.ToSlash(rel)] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// Return sorted children of rel dir ("" is root).
+func (p *Plan) children(rel string) (entries []fs.DirEntry) {
+	for name, file := range p.files {
+		if parent := path.Dir(name); parent == rel || (rel == "" && parent == ".") {
+			entries = append(entries, file)
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries
+}
+
+// Add file to tree, creating parent dirs if necessary.
+func (p *Plan) add(rel string, file *VirtualFile) {
+	file.name = path.Base(rel)
+	p.files[rel] = file
+	for parent := path.Dir(rel); parent != "." && p.files[parent] == nil; parent = path.Dir(parent) {
+		p.files[parent] = &VirtualFile{name: path.Base(parent), dir: true, modTime: time.Now()}
+	}
+}
+
+func (p *Plan) remove(rel string) {
+	for name := range p.files {
+		if name == rel || strings.HasPrefix(name, rel+"/") {
+			delete(p.files, name)
+		}
+	}
+}
+
+func (p *Plan) move(oldrel string, newrel string) {
+	moved := map[string]*VirtualFile{}
+	for name, file := range p.files {
+		if name == oldrel || strings.HasPrefix(name, oldrel+"/") {
+			moved[newrel+name[len(oldrel):]] = file
+			delete(p.files, name)
+		}
+	}
+	for name, file := range moved {
+		p.add(name, file)
+	}
+}
+
+// Whether tc is in plan (dry-run) mode. In plan mode, transformers must not touch disk;
+// all file system operations should be done via the methods of tc, which work in both modes.
+func (tc *TransformerContext) DryRun() bool {
+	return tc.Plan != nil
+}
+
+// Return "/" separated path of name relative to content dir.
+func (tc *TransformerContext) rel(name string) string {
+	rel, err := filepath.Rel(tc.Dir, name)
+	if err != nil {
+		return filepath.ToSlash(name)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Record an operation in plan mode. It's a no-op in normal mode.
+func (tc *TransformerContext) Record(op string, name string, target string, note string) {
+	if tc.Plan == nil {
+		return
+	}
+	operation := &Operation{Op: op, Path: tc.rel(name), Note: note}
+	if tc.CurrentTransformer != nil {
+		operation.Transformer = tc.CurrentTransformer.Name
+	}
+	if target != "" {
+		operation.Target = tc.rel(target)
+	}
+	tc.Plan.Operations = append(tc.Plan.Operations, operation)
+}
+
+func (tc *TransformerContext) ReadDir(name string) ([]fs.DirEntry, error) {
+	if tc.Plan == nil {
+		return os.ReadDir(name)
+	}
+	rel := tc.rel(name)
+	if rel != "." {
+		if file := tc.Plan.files[rel]; file == nil || !file.dir {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+	} else {
+		rel = ""
+	}
+	return tc.Plan.children(rel), nil
+}
+
+// Similar to filepath.WalkDir. root must be content dir or a dir inside it.
+func (tc *TransformerContext) WalkDir(root string, fn fs.WalkDirFunc) error {
+	if tc.Plan == nil {
+		return filepath.WalkDir(root, fn)
+	}
+	rootFile := &VirtualFile{name: filepath.Base(root), dir: true}
+	if rel := tc.rel(root); rel != "." {
+		if rootFile = tc.Plan.files[rel]; rootFile == nil {
+			return fn(root, nil, &fs.PathError{Op: "lstat", Path: root, Err: fs.ErrNotExist})
+		}
+	}
+	err := tc.walkDir(root, rootFile, fn)
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (tc *TransformerContext) walkDir(name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := tc.ReadDir(name)
+	if err != nil {
+		if err = fn(name, d, err); err != nil {
+			if err == fs.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := tc.walkDir(filepath.Join(name, entry.Name()), entry, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (tc *TransformerContext) Exists(name string) bool {
+	if tc.Plan == nil {
+		return util.FileExists(name)
+	}
+	rel := tc.rel(name)
+	return rel == "." || tc.Plan.files[rel] != nil
+}
+
+// Rename (move) file or dir.
+func (tc *TransformerContext) Rename(oldpath string, newpath string) error {
+	if tc.Plan == nil {
+		if err := atomic.ReplaceFile(oldpath, newpath); err != nil {
+			return err
+		}
+		return tc.Journal(OP_RENAME, oldpath, newpath, "")
+	}
+	if !tc.Exists(oldpath) {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	tc.Record(OP_RENAME, oldpath, newpath, "")
+	tc.Plan.move(tc.rel(oldpath), tc.rel(newpath))
+	return nil
+}
+
+// Remove file or dir (recursively). It's for junk files, which are not restored by undo;
+// use Backup for files that should be restored.
+func (tc *TransformerContext) Remove(name string) error {
+	if tc.Plan == nil {
+		if err := os.RemoveAll(name); err != nil {
+			return err
+		}
+		return tc.Journal(OP_DELETE, name, "", "")
+	}
+	tc.Record(OP_DELETE, name, "", "")
+	tc.Plan.remove(tc.rel(name))
+	return nil
+}
+
+// Move file to backup dir.
+func (tc *TransformerContext) Backup(name string) error {
+	if tc.Plan == nil {
+		backup, err := tc.moveToBackup(name)
+		if err != nil {
+			return err
+		}
+		return tc.Journal(OP_BACKUP, name, "", backup)
+	}
+	tc.Record(OP_BACKUP, name, "", "")
+	tc.Plan.remove(tc.rel(name))
+	return nil
+}
+
+// Move file to a new path in backup dir and return it.
+func (tc *TransformerContext) moveToBackup(name string) (backup string, err error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	backup = helper.GetNewFilePath(tc.BackupDir, filepath.Base(name))
+	return backup, atomic.ReplaceFile(name, backup)
+}
+
+// Open file for reading. In plan mode, return ErrUnknownContents if contents of file is unknown.
+func (tc *TransformerContext) Open(name string) (*os.File, error) {
+	if tc.Plan == nil {
+		return os.Open(name)
+	}
+	if file := tc.Plan.files[tc.rel(name)]; file == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	} else if file.source == "" {
+		return nil, ErrUnknownContents
+	} else {
+		return os.Open(file.source)
+	}
+}
+
+func (tc *TransformerContext) ReadFile(name string) ([]byte, error) {
+	file, err := tc.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// Read at most the first size bytes of file.
+func (tc *TransformerContext) ReadFileHeader(name string, size int) ([]byte, error) {
+	file, err := tc.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b := make([]byte, size)
+	n, err := io.ReadAtLeast(file, b, size)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return b[:n], err
+}
+
+// Plan mode only. Add a file (or dir) whose contents are unknown, e.g. a file extracted from archive.
+func (tc *TransformerContext) AddVirtualFile(name string, dir bool, size int64) {
+	if tc.Plan != nil {
+		tc.Plan.add(tc.rel(name), &VirtualFile{dir: dir, size: size, modTime: time.Now()})
+	}
+}
+
+// Plan mode only. Record a conversion of file to target (which could be the same as file).
+// The contents of target become unknown. Return false if the conversion of file by current transformer
+// has already been recorded.
+func (tc *TransformerContext) Convert(name string, target string, note string) bool {
+	if tc.Plan == nil {
+		return false
+	}
+	key := tc.rel(name)
+	if tc.CurrentTransformer != nil {
+		key = tc.CurrentTransformer.Name + ":" + key
+	}
+	if tc.Plan.seen[key] {
+		return false
+	}
+	size := int64(0)
+	if file := tc.Plan.files[tc.rel(name)]; file != nil {
+		size = file.size
+	}
+	tc.Record(OP_CONVERT, name, target, note)
+	tc.Plan.remove(tc.rel(name))
+	tc.AddVirtualFile(target, false, size)
+	if tc.CurrentTransformer != nil {
+		tc.Plan.seen[tc.CurrentTransformer.Name+":"+tc.rel(target)] = true
+	}
+	return true
+}
@@ -18,5 +18,8 @@ func init() {
 	transform.Register(&transform.Transformer{
 		Name:   "text",
 		Action: executorOptions.Transformer,
+		Options: append([]*transform.Option{
+			{Name: "bom", Description: `"1": add UTF-8 BOM to text files. By default BOM is stripped`},
+		}, executor.CommonOptions...),
 	})
 }
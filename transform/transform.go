@@ -1,14 +1,21 @@
 package transform
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/sagan/erodownloader/util"
 )
 
 // Max execution times for a single transformer
@@ -38,6 +45,11 @@ var (
 type Transformer struct {
 	Name   string
 	Action func(tc *TransformerContext) (changed bool, err error)
+	// CPU heavy transformer (e.g. audio encoding).
+	// It should wrap each unit of heavy work (e.g. a file) in AcquireHeavy, see SetHeavyConcurrency.
+	Heavy bool
+	// Supported options, besides GlobalOptions.
+	Options []*Option
 }
 
 type TransformerContext struct {
@@ -45,9 +57,16 @@ type TransformerContext struct {
 	Dir                string
 	BackupDir          string
 	Changed            bool
-	Err                error // error processing file
-	Options            url.Values
-	log                *os.File // opened *os.File of LogFile
+	Err                error      // error processing file
+	Options            url.Values // options of current transformer instance (see ScopedOptions)
+	Plan               *Plan      // non-nil in plan (dry-run) mode
+	Run                string     // id of current run in journal
+	log                *os.File   // opened *os.File of LogFile
+	journal            *os.File   // opened *os.File of JOURNAL_FILE
+	ctx                context.Context
+	discards           []*discard // files discarded by current run, removed after all transforms completed
+	// Guards log and backup dir. Transformers may process files concurrently (e.g. executor).
+	mu sync.Mutex
 }
 
 type TransformStep struct {
@@ -55,19 +74,81 @@ type TransformStep struct {
 	// At most execute Transformers these times. -1 == unlimited.
 	// If the final one of Transformers return changed=false, it will stop further invocations.
 	Times int
+	// Options applied only in this step, override the options of TransformerContext.
+	Options url.Values
 }
 
 type Transformers []*TransformStep
 
 type Logger func(format string, v ...any)
 
+// E.g. "[decompress denesting]*-1" (loop until no change), "[wav]".
+func (step *TransformStep) String() string {
+	var names []string
+	for _, transformer := range step.Transformers {
+		names = append(names, transformer.Name)
+	}
+	str := fmt.Sprintf("%v", names)
+	if step.Times != 0 && step.Times != 1 {
+		str += fmt.Sprintf("*%d", step.Times)
+	}
+	if len(step.Options) > 0 {
+		str += fmt.Sprintf("(%s)", step.Options.Encode())
+	}
+	return str
+}
+
+// Whether any step has the named transformer.
+func (ts Transformers) Has(name string) bool {
+	for _, step := range ts {
+		for _, transformer := range step.Transformers {
+			if transformer.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 var (
 	allTransformers = map[string]*Transformer{}
+	heavySemaphore  chan struct{} // nil: unlimited
 )
 
+// Limit the max number of concurrently running heavy works (e.g. a file being encoded) of heavy transformers
+// (across all dirs). n <= 0 means unlimited. It must be called before any transforms.
+func SetHeavyConcurrency(n int) {
+	if n > 0 {
+		heavySemaphore = make(chan struct{}, n)
+	} else {
+		heavySemaphore = nil
+	}
+}
+
+// Wait for a slot of heavy work if current transformer is heavy, and return the func that releases it.
+// If tc is canceled while waiting, it returns immediately.
+func (tc *TransformerContext) AcquireHeavy() (release func()) {
+	if tc.CurrentTransformer == nil || !tc.CurrentTransformer.Heavy || tc.Plan != nil || heavySemaphore == nil {
+		return func() {}
+	}
+	select {
+	case heavySemaphore <- struct{}{}:
+		return func() { <-heavySemaphore }
+	case <-tc.Context().Done():
+		return func() {}
+	}
+}
+
 // Normalizer a dir.
 // It's idempotent. Successive invocation will have output.Changed == false and output.Err == nil.
 func (ts Transformers) Transform(dir string, options url.Values) (output *TransformerContext) {
+	return ts.TransformContext(context.Background(), dir, options)
+}
+
+// Similar to Transform. If ctx is done, running external binaries are killed
+// and transforms stop with ErrCanceled before next transformer.
+func (ts Transformers) TransformContext(ctx context.Context, dir string, options url.Values) (
+	output *TransformerContext) {
 	bakDir := options.Get("bakdir")
 	if bakDir == "" {
 		bakDir = filepath.Join(dir, BAK_DIR)
@@ -76,6 +157,7 @@ func (ts Transformers) Transform(dir string, options url.Values) (output *Transf
 		Dir:       dir,
 		BackupDir: bakDir,
 		Options:   options,
+		ctx:       ctx,
 	}
 	if err := os.MkdirAll(bakDir, 0700); err != nil {
 		tc.Err = err
@@ -88,14 +170,87 @@ func (ts Transformers) Transform(dir string, options url.Values) (output *Transf
 	}
 	defer log.Close()
 	tc.log = log
+	journal, err := os.OpenFile(filepath.Join(bakDir, JOURNAL_FILE), os.O_SYNC|os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		tc.Err = fmt.Errorf("failed to open journal file: %w", err)
+		return tc
+	}
+	tc.journal = journal
+	tc.Run = fmt.Sprintf("%d-%s", time.Now().UnixNano(), util.Md5(dir)[:8])
 	tc.Log("[dir %q]Start transforms", dir)
+	if contentType := options.Get("content_type"); contentType != "" {
+		tc.Log("[dir %q]Content type: %s", dir, contentType)
+	}
 	defer tc.Log("[dir %q]All transforms completed, changed=%t, err=%v", dir, tc.Changed, tc.Err)
+	ts.run(tc)
+	if !errors.Is(tc.Err, ErrCanceled) {
+		if err := tc.commitDiscards(); err != nil && tc.Err == nil {
+			tc.Err = fmt.Errorf("failed to remove discarded files: %w", err)
+		}
+	}
+	tc.journal = nil
+	journal.Close()
+	// leave dir untouched on cancel
+	if errors.Is(tc.Err, ErrCanceled) {
+		if err := tc.rollback(); err != nil {
+			tc.Err = fmt.Errorf("%w (failed to roll back: %v)", tc.Err, err)
+		} else {
+			tc.Err = fmt.Errorf("%w (rolled back)", tc.Err)
+			tc.Changed = false
+		}
+		tc.Log("[dir %q]Canceled: %v", dir, tc.Err)
+	}
+	return tc
+}
+
+// Plan transforms of a dir without touching disk. Each transformer reports intended operations
+// against a virtual view of the dir tree, which are collected in output.Plan.
+// If a transformer needs contents that are unknown in plan mode, the plan stops there
+// and output.Plan.Incomplete is set.
+func (ts Transformers) Plan(dir string, options url.Values) (output *TransformerContext) {
+	bakDir := options.Get("bakdir")
+	if bakDir == "" {
+		bakDir = filepath.Join(dir, BAK_DIR)
+	}
+	tc := &TransformerContext{
+		Dir:       dir,
+		BackupDir: bakDir,
+		Options:   options,
+	}
+	plan, err := NewPlan(dir)
+	if err != nil {
+		tc.Err = fmt.Errorf("failed to read dir: %w", err)
+		return tc
+	}
+	tc.Plan = plan
+	ts.run(tc)
+	return tc
+}
+
+func (ts Transformers) run(tc *TransformerContext) {
+	options := tc.Options
+	defer func() {
+		tc.Options = options
+	}()
+	instances := ts.instances()
 main:
-	for _, step := range ts {
+	for k, step := range ts {
+		stepOptions := options
+		if len(step.Options) > 0 {
+			stepOptions = maps.Clone(options)
+			for key, values := range step.Options {
+				stepOptions[key] = values
+			}
+		}
 		i := 0
 		for {
 			for j, transformer := range step.Transformers {
 				tc.CurrentTransformer = transformer
+				tc.Options = ScopedOptions(stepOptions, transformer, instances[k][j])
+				if tc.Context().Err() != nil {
+					tc.Err = ErrCanceled
+					break main
+				}
 				tc.Log("Start")
 				changed, err := transformer.Action(tc)
 				if changed {
@@ -103,7 +258,11 @@ main:
 				}
 				tc.Log("Finished with changed=%t, err=%v", changed, err)
 				if err != nil {
-					tc.Err = fmt.Errorf("[transformer %s]%w", transformer.Name, err)
+					if tc.Plan != nil && errors.Is(err, ErrUnknownContents) {
+						tc.Plan.Incomplete = fmt.Sprintf("[transformer %s]%v", transformer.Name, err)
+					} else {
+						tc.Err = fmt.Errorf("[transformer %s]%w", transformer.Name, err)
+					}
 					break main
 				}
 				if !changed && j == len(step.Transformers)-1 {
@@ -120,7 +279,6 @@ main:
 		}
 	}
 	tc.CurrentTransformer = nil
-	return tc
 }
 
 // Log() should be called before action.
@@ -131,6 +289,11 @@ func (tc *TransformerContext) Log(format string, v ...any) {
 	}
 	msg += fmt.Sprintf(format, v...)
 	log.Tracef(msg)
+	if tc.log == nil {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
 	tc.log.WriteString(msg)
 	if !strings.HasSuffix(msg, "\n") {
 		tc.log.WriteString("\n")
@@ -1,6 +1,7 @@
 package wav
 
 import (
+	"runtime"
 	"strings"
 
 	"github.com/sagan/erodownloader/transform"
@@ -48,9 +49,12 @@ func init() {
 		NewExt: ".flac",
 		// Output: executor.BASE_PLACEHOLDER + ".flac",
 		RenameAdditionalSuffixes: []string{".vtt", ".ass", ".srt", ".lrc"},
+		Jobs:                     runtime.NumCPU(),
 	}
 	transform.Register(&transform.Transformer{
-		Name:   "wav",
-		Action: executorOptions.Transformer,
+		Name:    "wav",
+		Action:  executorOptions.Transformer,
+		Heavy:   true,
+		Options: append(transform.BinaryOptions("flac"), executor.CommonOptions...),
 	})
 }
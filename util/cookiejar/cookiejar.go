@@ -0,0 +1,362 @@
+// A persistent RFC 6265 cookie jar.
+// Cookies are stored in a json file; Netscape cookies.txt format import / export is supported.
+package cookiejar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/natefinch/atomic"
+	"golang.org/x/net/publicsuffix"
+)
+
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Domain   string `json:"domain"` // lower cased, without leading "."
+	Path     string `json:"path"`
+	HostOnly bool   `json:"host_only,omitempty"` // only sent to Domain host, not it's sub domains
+	Secure   bool   `json:"secure,omitempty"`
+	HttpOnly bool   `json:"http_only,omitempty"`
+	Expires  int64  `json:"expires,omitempty"` // unix timestamp (seconds). 0 == session cookie
+	Created  int64  `json:"created,omitempty"` // unix timestamp (nanoseconds)
+}
+
+// Jar is safe for concurrent use. Session cookies are also persisted,
+// as a command run is too short to be considered a "session".
+type Jar struct {
+	mu       sync.Mutex
+	filename string
+	cookies  map[string]*Cookie // key: "domain;path;name"
+	changed  bool
+}
+
+// Create a jar that persists cookies to filename. Existing cookies in filename are loaded.
+// If filename is empty, the jar is in-memory only.
+func New(filename string) (*Jar, error) {
+	jar := &Jar{filename: filename, cookies: map[string]*Cookie{}}
+	if filename == "" {
+		return jar, nil
+	}
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return jar, nil
+		}
+		return nil, err
+	}
+	var cookies []*Cookie
+	if err := json.Unmarshal(contents, &cookies); err != nil {
+		return nil, fmt.Errorf("malformed cookies file: %w", err)
+	}
+	jar.Add(cookies...)
+	jar.changed = false
+	return jar, nil
+}
+
+func (c *Cookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *Cookie) Expired(now time.Time) bool {
+	return c.Expires != 0 && c.Expires <= now.Unix()
+}
+
+// Whether cookie should be sent to u. See RFC 6265 5.4.
+func (c *Cookie) Match(u *url.URL) bool {
+	host := canonicalHost(u.Hostname())
+	if c.HostOnly {
+		if host != c.Domain {
+			return false
+		}
+	} else if !domainMatch(host, c.Domain) {
+		return false
+	}
+	if c.Secure && u.Scheme != "https" && u.Scheme != "wss" {
+		return false
+	}
+	return pathMatch(u.EscapedPath(), c.Path)
+}
+
+func (c *Cookie) HttpCookie() *fhttp.Cookie {
+	cookie := &fhttp.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Path:     c.Path,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+	}
+	if !c.HostOnly {
+		cookie.Domain = c.Domain
+	}
+	if c.Expires != 0 {
+		cookie.Expires = time.Unix(c.Expires, 0)
+	}
+	return cookie
+}
+
+// Return an url that the cookie could be set from.
+func (c *Cookie) Url() *url.URL {
+	scheme := "http"
+	if c.Secure {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: c.Domain, Path: c.Path}
+}
+
+// Add (or replace) cookies directly, without checking it against a request url.
+// It's used to import trusted cookies, e.g. from browsers.
+func (j *Jar) Add(cookies ...*Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, cookie := range cookies {
+		cookie.Domain = canonicalHost(strings.TrimPrefix(cookie.Domain, "."))
+		if cookie.Name == "" || cookie.Domain == "" {
+			continue
+		}
+		if cookie.Path == "" || cookie.Path[0] != '/' {
+			cookie.Path = "/"
+		}
+		j.set(cookie, now)
+	}
+}
+
+func (j *Jar) set(cookie *Cookie, now time.Time) {
+	key := cookie.key()
+	old := j.cookies[key]
+	if cookie.Expired(now) {
+		if old != nil {
+			delete(j.cookies, key)
+			j.changed = true
+		}
+		return
+	}
+	if old != nil {
+		cookie.Created = old.Created // keep the original creation time, see RFC 6265 5.3 (11.3)
+		if *old == *cookie {
+			return
+		}
+	}
+	if cookie.Created == 0 {
+		cookie.Created = now.UnixNano()
+	}
+	j.cookies[key] = cookie
+	j.changed = true
+}
+
+// SetCookies stores cookies received in the response of u, as specified by RFC 6265 5.3.
+// Invalid cookies (e.g. domain does not match u, or domain is a public suffix like "com") are ignored.
+func (j *Jar) SetCookies(u *url.URL, cookies []*fhttp.Cookie) {
+	if u == nil || u.Hostname() == "" {
+		return
+	}
+	host := canonicalHost(u.Hostname())
+	secureUrl := u.Scheme == "https" || u.Scheme == "wss"
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		if c.Name == "" || (c.Secure && !secureUrl) {
+			continue
+		}
+		cookie := &Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		domain := canonicalHost(strings.TrimPrefix(c.Domain, "."))
+		if domain == "" || domain == host {
+			cookie.Domain = host
+			// a public suffix domain is only allowed as host-only cookie of that host. See RFC 6265 5.3 (5).
+			cookie.HostOnly = domain == "" || isPublicSuffix(domain)
+		} else if net.ParseIP(host) == nil && !isPublicSuffix(domain) && domainMatch(host, domain) {
+			cookie.Domain = domain
+		} else {
+			continue
+		}
+		if cookie.Path == "" || cookie.Path[0] != '/' {
+			cookie.Path = defaultPath(u.EscapedPath())
+		}
+		if c.MaxAge < 0 {
+			cookie.Expires = now.Unix() - 1
+		} else if c.MaxAge > 0 {
+			cookie.Expires = now.Unix() + int64(c.MaxAge)
+		} else if !c.Expires.IsZero() {
+			cookie.Expires = max(c.Expires.Unix(), 1)
+		}
+		j.set(cookie, now)
+	}
+}
+
+// Cookies returns cookies that should be sent to u, as specified by RFC 6265 5.4:
+// cookies with longer paths are listed first, then the earlier created ones.
+func (j *Jar) Cookies(u *url.URL) (cookies []*fhttp.Cookie) {
+	for _, cookie := range j.MatchedCookies(u) {
+		cookies = append(cookies, &fhttp.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	return cookies
+}
+
+func (j *Jar) MatchedCookies(u *url.URL) (cookies []*Cookie) {
+	if u == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, cookie := range j.cookies {
+		if !cookie.Expired(now) && cookie.Match(u) {
+			cookies = append(cookies, cookie)
+		}
+	}
+	slices.SortFunc(cookies, func(a, b *Cookie) int {
+		if len(a.Path) != len(b.Path) {
+			return len(b.Path) - len(a.Path)
+		}
+		if a.Created < b.Created {
+			return -1
+		} else if a.Created > b.Created {
+			return 1
+		}
+		return 0
+	})
+	return cookies
+}
+
+// Return "Cookie" header value ("a=1; b=2") of u. Return empty string if no cookie matches.
+func (j *Jar) CookieHeader(u *url.URL) string {
+	var pairs []string
+	for _, cookie := range j.Cookies(u) {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// Return all unexpired cookies, sorted by domain, path and name.
+// If domain is not empty, only return cookies which domain match it (including sub domains).
+func (j *Jar) All(domain string) (cookies []*Cookie) {
+	domain = canonicalHost(strings.TrimPrefix(domain, "."))
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, cookie := range j.cookies {
+		if !cookie.Expired(now) && (domain == "" || domainMatch(cookie.Domain, domain)) {
+			cookies = append(cookies, cookie)
+		}
+	}
+	slices.SortFunc(cookies, func(a, b *Cookie) int {
+		return strings.Compare(a.key(), b.key())
+	})
+	return cookies
+}
+
+// Remove all cookies which domain match domain (including sub domains). Return removed cookies count.
+func (j *Jar) Clear(domain string) (cnt int) {
+	domain = canonicalHost(strings.TrimPrefix(domain, "."))
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for key, cookie := range j.cookies {
+		if domain == "" || domainMatch(cookie.Domain, domain) {
+			delete(j.cookies, key)
+			cnt++
+		}
+	}
+	if cnt > 0 {
+		j.changed = true
+	}
+	return cnt
+}
+
+// Remove cookies of name that would be sent to u. Return removed cookies count.
+func (j *Jar) Delete(u *url.URL, name string) (cnt int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for key, cookie := range j.cookies {
+		if cookie.Name == name && cookie.Match(u) {
+			delete(j.cookies, key)
+			cnt++
+		}
+	}
+	if cnt > 0 {
+		j.changed = true
+	}
+	return cnt
+}
+
+// Save cookies to file, if there are changes since last save. Expired cookies are discarded.
+func (j *Jar) Save() error {
+	if j.filename == "" {
+		return nil
+	}
+	j.mu.Lock()
+	if !j.changed {
+		j.mu.Unlock()
+		return nil
+	}
+	j.changed = false
+	j.mu.Unlock()
+	contents, err := json.MarshalIndent(j.All(""), "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomic.WriteFile(j.filename, bytes.NewReader(contents))
+}
+
+// Whether domain is a public suffix, e.g. "com", "co.jp", "github.io".
+func isPublicSuffix(domain string) bool {
+	if !strings.Contains(domain, ".") {
+		return true
+	}
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Whether host domain-matches domain. See RFC 6265 5.1.3.
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+// See RFC 6265 5.1.4.
+func pathMatch(requestPath, cookiePath string) bool {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	if requestPath == cookiePath {
+		return true
+	}
+	if strings.HasPrefix(requestPath, cookiePath) {
+		return cookiePath[len(cookiePath)-1] == '/' || requestPath[len(cookiePath)] == '/'
+	}
+	return false
+}
+
+// Return the default-path of a request path. See RFC 6265 5.1.4.
+func defaultPath(requestPath string) string {
+	if requestPath == "" || requestPath[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(requestPath, "/")
+	if i == 0 {
+		return "/"
+	}
+	return requestPath[:i]
+}
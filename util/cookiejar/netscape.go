@@ -0,0 +1,86 @@
+package cookiejar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const NETSCAPE_HEADER = "# Netscape HTTP Cookie File"
+
+// curl / browser extensions mark httpOnly cookies using this prefix of domain field.
+const HTTPONLY_PREFIX = "#HttpOnly_"
+
+// Parse Netscape cookies.txt format contents. Each line is a cookie of 7 tab-separated fields:
+// domain, include subdomains (TRUE / FALSE), path, secure (TRUE / FALSE), expires (unix timestamp), name, value.
+func ParseNetscape(r io.Reader) (cookies []*Cookie, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, HTTPONLY_PREFIX) {
+			line = line[len(HTTPONLY_PREFIX):]
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 { // empty value
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: invalid cookie (expect 7 fields, got %d)", lineno, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expires %q", lineno, fields[4])
+		}
+		cookies = append(cookies, &Cookie{
+			Domain:   strings.TrimPrefix(fields[0], "."),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE") && !strings.HasPrefix(fields[0], "."),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Expires:  max(expires, 0),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
+
+// Write cookies in Netscape cookies.txt format.
+func WriteNetscape(w io.Writer, cookies []*Cookie) error {
+	bool2str := func(b bool) string {
+		if b {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	if _, err := fmt.Fprintf(w, "%s\n\n", NETSCAPE_HEADER); err != nil {
+		return err
+	}
+	for _, cookie := range cookies {
+		domain := cookie.Domain
+		if !cookie.HostOnly {
+			domain = "." + domain
+		}
+		if cookie.HttpOnly {
+			domain = HTTPONLY_PREFIX + domain
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, bool2str(!cookie.HostOnly), cookie.Path,
+			bool2str(cookie.Secure), cookie.Expires, cookie.Name, cookie.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
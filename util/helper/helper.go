@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/url"
 	"os"
 	"os/exec"
@@ -199,6 +200,7 @@ func AddDownloadTask(clientInstance client.Client, id string, savePath string) (
 			FileId:   file.Id(),
 			FileUrl:  fileUrl,
 			Filename: file.Name(),
+			Site:     sitename,
 		})
 	}
 	for _, download := range downloads {
@@ -294,82 +296,129 @@ func ReadFileHeader(name string, size int) ([]byte, error) {
 	return b[:n], err
 }
 
+// File system used by NormalizeNameFs, e.g. a virtual tree of plan mode.
+type NameFs interface {
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Exists(name string) bool
+	Rename(oldpath string, newpath string) error
+}
+
+type osNameFs struct{}
+
+func (osNameFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osNameFs) Exists(name string) bool {
+	return util.FileExists(name)
+}
+
+func (osNameFs) Rename(oldpath string, newpath string) error {
+	return atomic.ReplaceFile(oldpath, newpath)
+}
+
 // Normalize file path names, truncate long names and replace restrictive chars.
 func NormalizeName(continueOnError bool, pathes ...string) (renamed int, err error) {
 	if len(pathes) == 0 {
 		return 0, fmt.Errorf("no path provided")
 	}
 	errorCnt := 0
-	renamedCnt := 0
-	for len(pathes) > 0 {
-		currentpath := pathes[0]
-		pathes = pathes[1:]
-
-		stat, err := os.Stat(currentpath)
+	var entries []nameEntry
+	for _, path := range pathes {
+		stat, err := os.Stat(path)
 		if err != nil {
 			if !continueOnError {
-				return renamed, err
+				return 0, err
 			}
-			log.Errorf("%q: %v", currentpath, err)
+			log.Errorf("%q: %v", path, err)
 			errorCnt++
 			continue
 		}
+		entries = append(entries, nameEntry{path, stat.IsDir()})
+	}
+	renamed, cnt, err := normalizeNames(osNameFs{}, continueOnError, entries)
+	if err != nil {
+		return renamed, err
+	}
+	if errorCnt += cnt; errorCnt > 0 {
+		return renamed, fmt.Errorf("%d errors", errorCnt)
+	}
+	return renamed, nil
+}
 
-		dir := filepath.Dir(currentpath)
-		basename := filepath.Base(currentpath)
+// Normalize names of all files inside dir (excluding dir itself) of fsys. Stop at first error.
+func NormalizeNameFs(fsys NameFs, dir string) (renamed int, err error) {
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	renamed, _, err = normalizeNames(fsys, false, childNameEntries(dir, files))
+	return renamed, err
+}
 
+type nameEntry struct {
+	path  string
+	isDir bool
+}
+
+// Return entries of not hidden files of dir.
+func childNameEntries(dir string, files []fs.DirEntry) (entries []nameEntry) {
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		entries = append(entries, nameEntry{filepath.Join(dir, file.Name()), file.IsDir()})
+	}
+	return entries
+}
+
+// Normalize names of entries, and all files inside dir entries recursively.
+// If continueOnError is true, errors are logged and counted instead of returned.
+func normalizeNames(fsys NameFs, continueOnError bool, entries []nameEntry) (renamed int, errorCnt int, err error) {
+	for len(entries) > 0 {
+		current := entries[0]
+		entries = entries[1:]
+		currentpath := current.path
+		basename := filepath.Base(currentpath)
 		var newbasename string
-		if stat.IsDir() {
+		if current.isDir {
 			newbasename = util.CleanBasename(basename)
 		} else {
 			newbasename = util.CleanFileBasename(basename)
 		}
 		if newbasename != basename {
-			newpath := filepath.Join(dir, newbasename)
-			if util.FileExists(newpath) {
-				if !continueOnError {
-					return renamed, err
-				}
-				log.Errorf("%q: rename target %q exists", currentpath, newbasename)
-				errorCnt++
-				continue
+			newpath := filepath.Join(filepath.Dir(currentpath), newbasename)
+			if fsys.Exists(newpath) {
+				err = fmt.Errorf("%q: rename target %q exists", currentpath, newbasename)
+			} else if err = fsys.Rename(currentpath, newpath); err != nil {
+				err = fmt.Errorf("%q => %q: %w", currentpath, newbasename, err)
 			}
-			err = atomic.ReplaceFile(currentpath, newpath)
 			if err != nil {
 				if !continueOnError {
-					return renamed, err
+					return renamed, errorCnt, err
 				}
-				log.Errorf("%q => %q: %v", currentpath, newbasename, err)
+				log.Errorf("%v", err)
 				errorCnt++
+				err = nil
 				continue
 			}
 			log.Tracef("%q => %q\n", currentpath, newbasename)
-			renamedCnt++
+			renamed++
 			currentpath = newpath
 		}
-
-		if !stat.IsDir() {
+		if !current.isDir {
 			continue
 		}
-		entries, err := os.ReadDir(currentpath)
+		files, err := fsys.ReadDir(currentpath)
 		if err != nil {
 			if !continueOnError {
-				return renamed, err
+				return renamed, errorCnt, err
 			}
 			log.Errorf("%q: %v", currentpath, err)
 			errorCnt++
 			continue
 		}
-		for _, entry := range entries {
-			if strings.HasPrefix(entry.Name(), ".") {
-				continue
-			}
-			pathes = append(pathes, filepath.Join(currentpath, entry.Name()))
-		}
+		entries = append(entries, childNameEntries(currentpath, files)...)
 	}
-
-	if errorCnt > 0 {
-		return renamed, fmt.Errorf("%d errors", errorCnt)
-	}
-	return renamed, nil
+	return renamed, errorCnt, nil
 }
@@ -0,0 +1,206 @@
+// Folder name templates of library contents. E.g. "{author}/{date:2006}/<[{number}] >{title}".
+//
+// Syntax:
+//   - "{field}" is replaced by the field value. Supported fields are listed in Fields.
+//   - "{date:layout}" formats date using a Go time layout, e.g. "{date:2006}" (year).
+//   - "<...>" is an optional group, which is omitted if any field inside it is empty. It can not contain "/".
+//   - "/" separates path components. Empty components are omitted.
+//   - "{{", "}}", "<<" and ">>" are literal "{", "}", "<" and ">".
+//
+// Field values never produce path separators, as restricted chars in them are replaced (see util.CleanBasenameComponent).
+// Each component is cleaned and truncated to FILENAME_MAX_LENGTH bytes by util.CleanBasename.
+package pathtemplate
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sagan/erodownloader/util"
+)
+
+// "[number][author]title". The number and author parts are omitted if empty.
+const DEFAULT = "<[{number}]><[{author}]>{title}"
+
+// Supported fields. List fields (narrator, tags) are joined by ", ".
+var Fields = []string{"number", "title", "author", "series", "date", "narrator", "tags", "source", "site"}
+
+// Layouts of date field value. The first one that parses the value is used.
+var DateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+type Template struct {
+	str        string
+	components [][]*node // nodes of each path component
+}
+
+// A literal text, a field or an optional group.
+type node struct {
+	text   string
+	field  string
+	format string
+	group  []*node
+}
+
+var Default = MustParse(DEFAULT)
+
+// Parse a template string.
+func Parse(str string) (*Template, error) {
+	t := &Template{str: str}
+	for _, component := range strings.Split(str, "/") {
+		nodes, rest, err := parseNodes(component, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %w", str, err)
+		}
+		if rest != "" {
+			return nil, fmt.Errorf("invalid template %q: unexpected %q", str, rest)
+		}
+		if len(nodes) > 0 {
+			t.components = append(t.components, nodes)
+		}
+	}
+	if len(t.components) == 0 {
+		return nil, fmt.Errorf("invalid template %q: empty", str)
+	}
+	return t, nil
+}
+
+func MustParse(str string) *Template {
+	t, err := Parse(str)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Parse nodes until end of str, or the closing ">" of group if inGroup is true.
+// Return the remaining str, which starts with the closing ">" (if found).
+func parseNodes(str string, inGroup bool) (nodes []*node, rest string, err error) {
+	text := ""
+	flush := func() {
+		if text != "" {
+			nodes = append(nodes, &node{text: text})
+			text = ""
+		}
+	}
+	for str != "" {
+		switch {
+		case strings.HasPrefix(str, "{{"), strings.HasPrefix(str, "}}"),
+			strings.HasPrefix(str, "<<"), strings.HasPrefix(str, ">>"):
+			text += str[:1]
+			str = str[2:]
+		case str[0] == '{':
+			end := strings.IndexByte(str, '}')
+			if end == -1 {
+				return nil, "", fmt.Errorf("unclosed {")
+			}
+			field, format, _ := strings.Cut(str[1:end], ":")
+			if !slices.Contains(Fields, field) {
+				return nil, "", fmt.Errorf("unknown field %q", field)
+			}
+			if format != "" && field != "date" {
+				return nil, "", fmt.Errorf("field %q does not support format", field)
+			}
+			flush()
+			nodes = append(nodes, &node{field: field, format: format})
+			str = str[end+1:]
+		case str[0] == '<':
+			group, groupRest, err := parseNodes(str[1:], true)
+			if err != nil {
+				return nil, "", err
+			}
+			if groupRest == "" {
+				return nil, "", fmt.Errorf("unclosed <")
+			}
+			flush()
+			nodes = append(nodes, &node{group: group})
+			str = groupRest[1:]
+		case str[0] == '>':
+			if !inGroup {
+				return nil, "", fmt.Errorf("unexpected >")
+			}
+			flush()
+			return nodes, str, nil
+		case str[0] == '}':
+			return nil, "", fmt.Errorf("unexpected }")
+		default:
+			text += str[:1]
+			str = str[1:]
+		}
+	}
+	flush()
+	return nodes, "", nil
+}
+
+func (t *Template) String() string {
+	return t.str
+}
+
+// Render the template using fields values. Return the cleaned path components.
+// Return nil if all components are empty.
+func (t *Template) Execute(fields map[string]string) (components []string) {
+	for _, nodes := range t.components {
+		value, _ := execute(nodes, fields)
+		if value = util.CleanBasename(value); value != "" {
+			components = append(components, value)
+		}
+	}
+	return components
+}
+
+// Similar to Execute, but return a path joined by sep.
+func (t *Template) Path(fields map[string]string, sep string) string {
+	return strings.Join(t.Execute(fields), sep)
+}
+
+// Return rendered nodes. ok is false if any field is empty.
+func execute(nodes []*node, fields map[string]string) (value string, ok bool) {
+	ok = true
+	for _, n := range nodes {
+		if n.group != nil {
+			if groupValue, groupOk := execute(n.group, fields); groupOk {
+				value += groupValue
+			}
+		} else if n.field != "" {
+			fieldValue := util.CleanBasenameComponent(fields[n.field])
+			if fieldValue != "" && n.format != "" {
+				fieldValue = formatDate(fieldValue, n.format)
+			}
+			if fieldValue == "" {
+				ok = false
+			}
+			value += fieldValue
+		} else {
+			value += n.text
+		}
+	}
+	return value, ok
+}
+
+// Format date value using layout. Return empty string if value can't be parsed.
+func formatDate(value string, layout string) string {
+	for _, dateLayout := range DateLayouts {
+		if t, err := time.Parse(dateLayout, value); err == nil {
+			return t.Format(layout)
+		}
+	}
+	return ""
+}
+
+// Return the root dir of library content dir, whose relative path to root is name ("/" separated).
+// It's the parent of dir, with trailing components that equal the leading components of name removed.
+// E.g. Root("/lib/Circle/Old", "Circle/New") == "/lib".
+func Root(dir string, name string) string {
+	root := filepath.Dir(dir)
+	components := strings.Split(name, "/")
+	parents := components[:len(components)-1]
+	parent := root
+	for i := len(parents) - 1; i >= 0; i-- {
+		if filepath.Base(parent) != parents[i] {
+			return root
+		}
+		parent = filepath.Dir(parent)
+	}
+	return parent
+}
@@ -43,6 +43,43 @@ func Clean(s string) string {
 	return s
 }
 
+// Compare strings in natural order, that is, digit sequences are compared numerically.
+// E.g. "track2.mp3" < "track10.mp3".
+func NaturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			i, j := digitsLen(a), digitsLen(b)
+			na, nb := strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")
+			if len(na) != len(nb) {
+				return len(na) - len(nb)
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		ra, sa := utf8.DecodeRuneInString(a)
+		rb, sb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			return int(ra) - int(rb)
+		}
+		a, b = a[sa:], b[sb:]
+	}
+	return len(a) - len(b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func digitsLen(s string) (i int) {
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
+
 func HasAnySuffix(str string, suffixes ...string) bool {
 	for _, suffix := range suffixes {
 		if strings.HasSuffix(str, suffix) {
@@ -0,0 +1,247 @@
+package tagutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// See https://xiph.org/flac/format.html#metadata_block .
+const (
+	FLAC_STREAMINFO     = 0
+	FLAC_VORBIS_COMMENT = 4
+	FLAC_PICTURE        = 6
+)
+
+const FLAC_MAGIC = "fLaC"
+
+// Picture type of front cover, used by both FLAC & ID3v2.
+const PICTURE_FRONT_COVER = 3
+
+type flacBlock struct {
+	typ  byte
+	data []byte
+}
+
+// Write tags to flac file as Vorbis comments and PICTURE block.
+func WriteFlac(input string, output string, tags *Tags) (changed bool, err error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if err = skipId3v2(file); err != nil {
+		return false, err
+	}
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(file, magic); err != nil || string(magic) != FLAC_MAGIC {
+		return false, fmt.Errorf("%w: not a flac file", ErrUnsupported)
+	}
+	var blocks []*flacBlock
+	for {
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(file, header); err != nil {
+			return false, fmt.Errorf("invalid flac metadata block: %w", err)
+		}
+		block := &flacBlock{typ: header[0] & 0x7f, data: make([]byte, int(header[1])<<16|int(header[2])<<8|int(header[3]))}
+		if _, err = io.ReadFull(file, block.data); err != nil {
+			return false, fmt.Errorf("invalid flac metadata block: %w", err)
+		}
+		blocks = append(blocks, block)
+		if header[0]&0x80 != 0 {
+			break
+		}
+	}
+	if len(blocks) == 0 || blocks[0].typ != FLAC_STREAMINFO {
+		return false, fmt.Errorf("%w: flac has no STREAMINFO", ErrUnsupported)
+	}
+
+	vendor := "erodownloader"
+	var comments []string
+	commentIndex := -1
+	for i, block := range blocks {
+		if block.typ == FLAC_VORBIS_COMMENT {
+			if vendor, comments, err = parseVorbisComment(block.data); err != nil {
+				return false, err
+			}
+			commentIndex = i
+			break
+		}
+	}
+	newComments := applyVorbisComments(comments, tags)
+	newBlocks := []*flacBlock{}
+	for i, block := range blocks {
+		if i == commentIndex {
+			continue
+		}
+		if block.typ == FLAC_PICTURE && tags.Cover != nil && pictureType(block.data) == PICTURE_FRONT_COVER {
+			continue
+		}
+		newBlocks = append(newBlocks, block)
+	}
+	commentBlock := &flacBlock{typ: FLAC_VORBIS_COMMENT, data: marshalVorbisComment(vendor, newComments)}
+	newBlocks = slices.Insert(newBlocks, 1, commentBlock)
+	if tags.Cover != nil {
+		newBlocks = slices.Insert(newBlocks, 2, &flacBlock{typ: FLAC_PICTURE, data: marshalFlacPicture(tags.Cover)})
+	}
+	if slices.EqualFunc(blocks, newBlocks, func(a, b *flacBlock) bool {
+		return a.typ == b.typ && bytes.Equal(a.data, b.data)
+	}) {
+		return false, nil
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(FLAC_MAGIC)
+	for i, block := range newBlocks {
+		if len(block.data) >= 1<<24 {
+			return false, fmt.Errorf("flac metadata block too large")
+		}
+		typ := block.typ
+		if i == len(newBlocks)-1 {
+			typ |= 0x80
+		}
+		buf.Write([]byte{typ, byte(len(block.data) >> 16), byte(len(block.data) >> 8), byte(len(block.data))})
+		buf.Write(block.data)
+	}
+	if err = writeOutput(output, buf.Bytes(), file); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Replace comments of tags fields. Other comments are kept in original order,
+// the new ones are appended in a fixed order, so that it's idempotent.
+func applyVorbisComments(comments []string, tags *Tags) []string {
+	values := [][2]string{}
+	add := func(key string, vals ...string) {
+		for _, val := range vals {
+			if val != "" {
+				values = append(values, [2]string{key, val})
+			}
+		}
+	}
+	add("ALBUM", tags.Album)
+	add("ALBUMARTIST", tags.AlbumArtist)
+	add("ARTIST", tags.Artists...)
+	add("GENRE", tags.Genres...)
+	add("DATE", tags.Date)
+	if tags.TrackNumber > 0 {
+		add("TRACKNUMBER", strconv.Itoa(tags.TrackNumber))
+	}
+	if tags.TrackTotal > 0 {
+		add("TRACKTOTAL", strconv.Itoa(tags.TrackTotal))
+	}
+	// existing titles are kept, but moved to the fixed position
+	var titles []string
+	for _, comment := range comments {
+		if key, value, _ := strings.Cut(comment, "="); strings.EqualFold(key, "TITLE") && value != "" {
+			titles = append(titles, value)
+		}
+	}
+	if len(titles) == 0 {
+		titles = append(titles, tags.Title)
+	}
+	add("TITLE", titles...)
+	replaced := map[string]bool{}
+	for _, value := range values {
+		replaced[value[0]] = true
+	}
+	var newComments []string
+	for _, comment := range comments {
+		key, _, _ := strings.Cut(comment, "=")
+		if !replaced[strings.ToUpper(key)] {
+			newComments = append(newComments, comment)
+		}
+	}
+	for _, value := range values {
+		newComments = append(newComments, value[0]+"="+value[1])
+	}
+	return newComments
+}
+
+// See https://xiph.org/vorbis/doc/v-comment.html . All integers are little-endian.
+func parseVorbisComment(data []byte) (vendor string, comments []string, err error) {
+	r := bytes.NewReader(data)
+	readString := func() (string, error) {
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return "", err
+		}
+		if int64(length) > int64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		str := make([]byte, length)
+		_, err := io.ReadFull(r, str)
+		return string(str), err
+	}
+	if vendor, err = readString(); err != nil {
+		return "", nil, fmt.Errorf("invalid vorbis comment: %w", err)
+	}
+	var count uint32
+	if err = binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return "", nil, fmt.Errorf("invalid vorbis comment: %w", err)
+	}
+	for i := uint32(0); i < count; i++ {
+		comment, err := readString()
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid vorbis comment: %w", err)
+		}
+		comments = append(comments, comment)
+	}
+	return vendor, comments, nil
+}
+
+func marshalVorbisComment(vendor string, comments []string) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(len(vendor)))
+	buf.WriteString(vendor)
+	binary.Write(buf, binary.LittleEndian, uint32(len(comments)))
+	for _, comment := range comments {
+		binary.Write(buf, binary.LittleEndian, uint32(len(comment)))
+		buf.WriteString(comment)
+	}
+	return buf.Bytes()
+}
+
+// See https://xiph.org/flac/format.html#metadata_block_picture . All integers are big-endian.
+func marshalFlacPicture(picture *Picture) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(PICTURE_FRONT_COVER))
+	binary.Write(buf, binary.BigEndian, uint32(len(picture.Mime)))
+	buf.WriteString(picture.Mime)
+	binary.Write(buf, binary.BigEndian, uint32(0)) // description
+	binary.Write(buf, binary.BigEndian, uint32(picture.Width))
+	binary.Write(buf, binary.BigEndian, uint32(picture.Height))
+	binary.Write(buf, binary.BigEndian, uint32(24)) // color depth
+	binary.Write(buf, binary.BigEndian, uint32(0))  // number of colors of indexed-color pictures
+	binary.Write(buf, binary.BigEndian, uint32(len(picture.Data)))
+	buf.Write(picture.Data)
+	return buf.Bytes()
+}
+
+func pictureType(data []byte) uint32 {
+	if len(data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+// Skip ID3v2 tag at the start of file, if any. Some encoders prepend it to flac files.
+func skipId3v2(file *os.File) error {
+	header := make([]byte, 10)
+	if n, _ := io.ReadFull(file, header); n == 10 && string(header[:3]) == ID3_MAGIC {
+		size := int64(syncsafe(header[6:10])) + 10
+		if header[5]&0x10 != 0 {
+			size += 10 // footer
+		}
+		_, err := file.Seek(size, io.SeekStart)
+		return err
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,256 @@
+package tagutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// See https://id3.org/id3v2.3.0 .
+const ID3_MAGIC = "ID3"
+
+const (
+	ID3_ENCODING_LATIN1  = 0
+	ID3_ENCODING_UTF16   = 1 // with BOM
+	ID3_ENCODING_UTF16BE = 2 // v2.4 only
+	ID3_ENCODING_UTF8    = 3 // v2.4 only
+)
+
+type id3Frame struct {
+	id   string
+	data []byte
+}
+
+// Frames that are not defined in ID3v2.3 and are dropped when upgrading a v2.4 tag.
+var id3v24OnlyFrames = []string{"TDRC", "TDOR", "TDRL", "TDTG", "TDEN", "TIPL", "TMCL", "TMOO", "TPRO",
+	"TSOA", "TSOP", "TSOT", "TSST", "ASPI", "EQU2", "RVA2", "SEEK", "SIGN"}
+
+// Write tags to mp3 file as ID3v2.3 frames. Existing ID3v2.3 and v2.4 frames are kept (v2.4 is converted to v2.3),
+// ID3v1 tag at the end of file is untouched.
+func WriteMp3(input string, output string, tags *Tags) (changed bool, err error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	frames, version, err := readId3v2(file)
+	if err != nil {
+		return false, err
+	}
+	newFrames := applyId3Frames(frames, tags)
+	body := marshalId3Frames(newFrames)
+	if version == 3 && bytes.Equal(body, marshalId3Frames(frames)) {
+		return false, nil
+	}
+	header := []byte(ID3_MAGIC)
+	header = append(header, 3, 0, 0)
+	header = append(header, toSyncsafe(len(body))...)
+	if err = writeOutput(output, append(header, body...), file); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Read ID3v2 tag at the start of file. After return, file is positioned at the end of tag (start of audio data).
+// version is 0 if file has no ID3v2 tag.
+func readId3v2(file *os.File) (frames []*id3Frame, version byte, err error) {
+	header := make([]byte, 10)
+	if n, _ := io.ReadFull(file, header); n < 10 || string(header[:3]) != ID3_MAGIC {
+		_, err = file.Seek(0, io.SeekStart)
+		return nil, 0, err
+	}
+	version = header[3]
+	flags := header[5]
+	if version != 3 && version != 4 {
+		return nil, 0, fmt.Errorf("%w: ID3v2.%d tag", ErrUnsupported, version)
+	}
+	// unsynchronisation, extended header or experimental
+	if flags&0xe0 != 0 {
+		return nil, 0, fmt.Errorf("%w: ID3v2 tag with flags %x", ErrUnsupported, flags)
+	}
+	body := make([]byte, syncsafe(header[6:10]))
+	if _, err = io.ReadFull(file, body); err != nil {
+		return nil, 0, fmt.Errorf("invalid ID3v2 tag: %w", err)
+	}
+	if flags&0x10 != 0 {
+		if _, err = file.Seek(10, io.SeekCurrent); err != nil {
+			return nil, 0, err
+		}
+	}
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		var size int
+		if version == 4 {
+			size = syncsafe(body[4:8])
+		} else {
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		}
+		formatFlags := body[9]
+		if size > len(body)-10 {
+			return nil, 0, fmt.Errorf("invalid ID3v2 frame %q", id)
+		}
+		data := body[10 : 10+size]
+		body = body[10+size:]
+		if version == 4 {
+			// compressed, encrypted, unsynchronised or other frames which can't be simply copied
+			if formatFlags != 0 || slices.Contains(id3v24OnlyFrames, id) {
+				continue
+			}
+			if strings.HasPrefix(id, "T") && id != "TXXX" && len(data) > 0 &&
+				(data[0] == ID3_ENCODING_UTF16BE || data[0] == ID3_ENCODING_UTF8) {
+				data = encodeId3Text(strings.ReplaceAll(decodeId3Text(data), "\x00", "/"))
+			}
+		}
+		frames = append(frames, &id3Frame{id: id, data: data})
+	}
+	return frames, version, nil
+}
+
+// Replace frames of tags fields. Other frames are kept in original order,
+// the new ones are appended in a fixed order, so that it's idempotent.
+func applyId3Frames(frames []*id3Frame, tags *Tags) []*id3Frame {
+	var values []*id3Frame
+	addText := func(id string, value string) {
+		if value != "" {
+			values = append(values, &id3Frame{id: id, data: encodeId3Text(value)})
+		}
+	}
+	addText("TALB", tags.Album)
+	addText("TPE2", tags.AlbumArtist)
+	addText("TPE1", strings.Join(tags.Artists, "/"))
+	addText("TCON", strings.Join(tags.Genres, "; "))
+	if len(tags.Date) >= 4 {
+		addText("TYER", tags.Date[:4])
+		// TDAT is DDMM
+		if len(tags.Date) == 10 {
+			addText("TDAT", tags.Date[8:10]+tags.Date[5:7])
+		}
+	}
+	if tags.TrackNumber > 0 {
+		track := strconv.Itoa(tags.TrackNumber)
+		if tags.TrackTotal > 0 {
+			track += "/" + strconv.Itoa(tags.TrackTotal)
+		}
+		addText("TRCK", track)
+	}
+	// existing title is kept, but moved to the fixed position
+	if i := slices.IndexFunc(frames, func(f *id3Frame) bool {
+		return f.id == "TIT2" && decodeId3Text(f.data) != ""
+	}); i >= 0 {
+		values = append(values, frames[i])
+	} else {
+		addText("TIT2", tags.Title)
+	}
+	if tags.Cover != nil {
+		data := []byte{ID3_ENCODING_LATIN1}
+		data = append(data, tags.Cover.Mime...)
+		data = append(data, 0, PICTURE_FRONT_COVER, 0) // mime terminator, picture type, empty description
+		data = append(data, tags.Cover.Data...)
+		values = append(values, &id3Frame{id: "APIC", data: data})
+	}
+	replaced := map[string]bool{}
+	for _, value := range values {
+		replaced[value.id] = true
+	}
+	var newFrames []*id3Frame
+	for _, frame := range frames {
+		if frame.id == "APIC" {
+			if replaced["APIC"] && apicPictureType(frame.data) == PICTURE_FRONT_COVER {
+				continue
+			}
+		} else if replaced[frame.id] {
+			continue
+		}
+		newFrames = append(newFrames, frame)
+	}
+	return append(newFrames, values...)
+}
+
+func marshalId3Frames(frames []*id3Frame) []byte {
+	buf := &bytes.Buffer{}
+	for _, frame := range frames {
+		buf.WriteString(frame.id)
+		binary.Write(buf, binary.BigEndian, uint32(len(frame.data)))
+		buf.Write([]byte{0, 0}) // flags
+		buf.Write(frame.data)
+	}
+	return buf.Bytes()
+}
+
+// Encode text frame data. Use ISO-8859-1 if possible, otherwise UTF-16 with BOM.
+func encodeId3Text(value string) []byte {
+	latin1 := []byte{ID3_ENCODING_LATIN1}
+	for _, r := range value {
+		if r > 0xff {
+			latin1 = nil
+			break
+		}
+		latin1 = append(latin1, byte(r))
+	}
+	if latin1 != nil {
+		return latin1
+	}
+	data := []byte{ID3_ENCODING_UTF16, 0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(value)) {
+		data = binary.LittleEndian.AppendUint16(data, u)
+	}
+	return data
+}
+
+// Decode text frame data. Trailing null terminators are removed.
+func decodeId3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	encoding, data := data[0], data[1:]
+	var value string
+	switch encoding {
+	case ID3_ENCODING_LATIN1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		value = string(runes)
+	case ID3_ENCODING_UTF16, ID3_ENCODING_UTF16BE:
+		var order binary.ByteOrder = binary.BigEndian
+		if encoding == ID3_ENCODING_UTF16 && len(data) >= 2 {
+			if data[0] == 0xff && data[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			data = data[2:]
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[i*2:])
+		}
+		value = string(utf16.Decode(units))
+	default:
+		value = string(data)
+	}
+	return strings.TrimRight(value, "\x00")
+}
+
+// Return picture type of APIC frame data.
+func apicPictureType(data []byte) byte {
+	if len(data) < 2 {
+		return 0
+	}
+	if i := bytes.IndexByte(data[1:], 0); i >= 0 && i+2 < len(data) {
+		return data[i+2]
+	}
+	return 0
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func toSyncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
@@ -0,0 +1,89 @@
+// Write common tags of audio files: FLAC Vorbis comments and MP3 ID3v2.3 frames.
+package tagutil
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Tags to be written to an audio file. Zero value fields are not written, existing values are kept.
+type Tags struct {
+	Album       string
+	AlbumArtist string
+	Artists     []string
+	Genres      []string
+	Date        string // "2006-01-02" or "2006"
+	Title       string // only written if the file has no title
+	TrackNumber int
+	TrackTotal  int
+	Cover       *Picture // front cover
+}
+
+type Picture struct {
+	Mime   string // "image/jpeg" or "image/png"
+	Data   []byte
+	Width  int
+	Height int
+}
+
+var (
+	ErrUnsupported = fmt.Errorf("unsupported file format")
+)
+
+// Read a jpeg or png image file as cover picture.
+func ReadPicture(filename string) (*Picture, error) {
+	var mime string
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		mime = "image/jpeg"
+	case ".png":
+		mime = "image/png"
+	default:
+		return nil, ErrUnsupported
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+	return &Picture{Mime: mime, Data: data, Width: config.Width, Height: config.Height}, nil
+}
+
+// Write tags to audio file input, output to output file. The format is determined by ext of input.
+// If the tags of input are already up to date, output is not created and changed is false.
+func Write(input string, output string, tags *Tags) (changed bool, err error) {
+	switch strings.ToLower(filepath.Ext(input)) {
+	case ".flac":
+		return WriteFlac(input, output, tags)
+	case ".mp3":
+		return WriteMp3(input, output, tags)
+	}
+	return false, ErrUnsupported
+}
+
+// Write contents of tag (without audio data) followed by the remaining contents of src to output.
+func writeOutput(output string, header []byte, src *os.File) (err error) {
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err = file.Write(header); err != nil {
+		return err
+	}
+	_, err = file.ReadFrom(src)
+	return err
+}